@@ -1,37 +1,263 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/rs/zerolog"
+	"github.com/runs-on/snapshot/internal/github"
 	"github.com/runs-on/snapshot/internal/utils"
 	"github.com/sethvargo/go-githubactions"
 )
 
 const requiredTagKey = "runs-on-stack-name"
 
+const defaultResultFile = "/runs-on/snapshot-result.json"
+
+// Supported filesystems for new volumes
+const (
+	FilesystemExt4  = "ext4"
+	FilesystemXfs   = "xfs"
+	FilesystemBtrfs = "btrfs"
+)
+
+// mkfsOptionPattern matches a single argument of 'mkfs_options', which may also use ^ to disable features (e.g. ^has_journal).
+var mkfsOptionPattern = regexp.MustCompile(`^[A-Za-z0-9,=_./:+^-]+$`)
+
+// maxFilesystemLabelLengths holds the maximum length of a filesystem label, per filesystem.
+var maxFilesystemLabelLengths = map[string]int{
+	FilesystemExt4:  16,
+	FilesystemXfs:   12,
+	FilesystemBtrfs: 255,
+}
+
+// Supported container runtimes, whose service is managed when the path is within their data directory
+const (
+	RuntimeDocker     = "docker"
+	RuntimeContainerd = "containerd"
+)
+
+// SharedVolumeMountPoint is where the single volume is mounted in 'shared_volume' mode. Each path is then a bind mount of
+// a subdirectory of it.
+const SharedVolumeMountPoint = "/runs-on/shared-volume"
+
+// OverlayVolumeMountPoint is where the volume is mounted in 'overlay' mode. It holds the upper and work directories of
+// the overlayfs mounted over the path.
+const OverlayVolumeMountPoint = "/runs-on/overlay-volume"
+
+// RawDeviceMountPoint identifies the volume in 'raw_device' mode, in place of the path. Nothing is mounted there.
+const RawDeviceMountPoint = "/runs-on/raw-device"
+
+// DefaultTagPrefix is the default prefix of the tags identifying compatible volumes and snapshots.
+const DefaultTagPrefix = "runs-on-snapshot"
+
+// tagPrefixPattern matches the characters allowed in EC2 tag keys.
+var tagPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9 _.:/=+@-]+$`)
+
+// FallbackBackendS3 stores the path as a tarball in S3 when EBS snapshots are not available.
+const FallbackBackendS3 = "s3"
+
+// Policies applied to snapshots that did not complete in time
+const (
+	IncompleteSnapshotPolicyDelete = "delete"
+	IncompleteSnapshotPolicyTag    = "tag"
+	IncompleteSnapshotPolicyKeep   = "keep"
+)
+
+// Storage tiers of new snapshots
+const (
+	StorageTierStandard = "standard"
+	StorageTierArchive  = "archive"
+)
+
+// VolumeInitializationRateAuto computes the initialization rate from the size of the restored snapshot.
+const VolumeInitializationRateAuto int32 = -1
+
+// Volume initialization rates (MiB/s) supported by AWS. 0 disables the volume initialization rate.
+const (
+	MinVolumeInitializationRate int32 = 100
+	MaxVolumeInitializationRate int32 = 300
+)
+
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
+)
+
+// AWS limits for user-defined tags
+const (
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+	// MaxTagsPerResource is the maximum number of tags on a single EC2 resource.
+	MaxTagsPerResource = 50
+)
+
+const (
+	// ModeSnapshot restores the volume from the latest snapshot, and snapshots it again in the post step.
+	ModeSnapshot = "snapshot"
+	// ModePersistentVolume re-attaches a long-lived volume per branch, and only detaches it in the post step.
+	ModePersistentVolume = "persistent_volume"
+)
+
+// volumeSizeLimits is the minimum and maximum size (in GiB) of each supported volume type.
+var volumeSizeLimits = map[types.VolumeType]struct{ min, max int32 }{
+	types.VolumeTypeGp2:      {1, 16384},
+	types.VolumeTypeGp3:      {1, 65536},
+	types.VolumeTypeIo1:      {4, 16384},
+	types.VolumeTypeIo2:      {4, 65536},
+	types.VolumeTypeSt1:      {125, 16384},
+	types.VolumeTypeSc1:      {125, 16384},
+	types.VolumeTypeStandard: {1, 1024},
+}
+
+// Performance limits of gp3 volumes, whose IOPS and throughput are provisioned independently of their size.
+const (
+	gp3MinIops       = 3000
+	gp3MaxIops       = 80000
+	gp3MaxIopsPerGiB = 500
+	gp3MinThroughput = 125
+	gp3MaxThroughput = 2000
+	// gp3ThroughputPerIops is the maximum throughput (MiB/s) per provisioned IOPS, e.g. 750 MiB/s requires 3000 IOPS
+	gp3ThroughputPerIops = 0.25
+)
+
+// deviceNamePattern matches the device names recommended by AWS for attaching EBS volumes.
+var deviceNamePattern = regexp.MustCompile(`^/dev/(sd[f-p]|xvd[a-z]{1,2})$`)
+
+// accountIDPattern matches AWS account IDs.
+var accountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// roleARNPattern matches IAM role ARNs, with an optional path.
+var roleARNPattern = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/[A-Za-z0-9+=,.@_/-]+$`)
+
+// eventBusPattern matches EventBridge event bus names and ARNs.
+var eventBusPattern = regexp.MustCompile(`^(arn:aws[a-z-]*:events:[a-z0-9-]+:[0-9]{12}:event-bus/)?[A-Za-z0-9._/-]{1,256}$`)
+
+// kmsKeyIDPattern matches the KMS key identifiers accepted by EC2: key ID, key ARN, alias name or alias ARN.
+var kmsKeyIDPattern = regexp.MustCompile(`^(arn:aws[a-z-]*:kms:[a-z0-9-]+:[0-9]{12}:)?(key/)?([0-9a-f-]{36}|mrk-[0-9a-f]{32}|alias/[A-Za-z0-9/_-]+)$`)
+
+// unsafePaths are directories that must never be mounted over, since that would hide content the runner relies on.
+var unsafePaths = []string{"/", "/home", "/mnt", "/opt", "/root", "/srv", "/tmp", "/var", "/var/lib"}
+
+// unsafePathPrefixes are system trees in which no mount point is allowed.
+var unsafePathPrefixes = []string{"/bin", "/boot", "/dev", "/etc", "/lib", "/lib32", "/lib64", "/proc", "/run", "/sbin", "/sys", "/usr"}
+
+// sizePattern matches sizes such as 100, 100GiB or 1.5TB.
+var sizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?) *([A-Za-z]*)$`)
+
+// sizeUnitsGiB maps the (lowercase) units accepted for sizes to their value in GiB. EBS sizes are always in GiB, so
+// decimal units (GB, TB) are treated as their binary counterparts.
+var sizeUnitsGiB = map[string]float64{
+	"": 1, "g": 1, "gb": 1, "gi": 1, "gib": 1,
+	"t": 1024, "tb": 1024, "ti": 1024, "tib": 1024,
+}
+
+// safeOptionsPattern matches option strings that are safe to pass as a single argument to exec'd commands.
+var safeOptionsPattern = regexp.MustCompile(`^[A-Za-z0-9,=_./:+-]*$`)
+
 type Config struct {
-	Path                     string
-	Version                  string
-	WaitForCompletion        bool
-	Save                     bool
-	VolumeType               types.VolumeType
-	VolumeIops               int32
-	VolumeThroughput         int32
-	VolumeSize               int32
-	VolumeInitializationRate int32
-	VolumeName               string
-	GithubRef                string
-	GithubRepository         string
-	InstanceID               string
-	Az                       string
-	CustomTags               []Tag
-	SnapshotName             string
-	RunnerConfig             *RunnerConfig
+	Path                         string
+	SharedVolume                 bool
+	RawDevice                    bool
+	SharedPaths                  []string
+	Overlay                      bool
+	OverlayPath                  string
+	Mode                         string
+	Version                      string
+	RestoreVersions              []string
+	PreferWarmSnapshots          bool
+	WaitForCompletion            bool
+	WaitForInitialSnapshot       bool
+	HeartbeatInterval            time.Duration
+	Save                         bool
+	VolumeType                   types.VolumeType
+	VolumeIops                   int32
+	VolumeThroughput             int32
+	VolumeSize                   int32
+	VolumeInitializationRate     int32
+	VolumeName                   string
+	DeviceName                   string
+	MountOptions                 string
+	Filesystem                   string
+	FilesystemLabel              string
+	MkfsOptions                  []string
+	BtrfsCompression             string
+	Runtime                      string
+	RuntimeReadyTimeout          time.Duration
+	ManageRuntime                bool
+	DockerPruneUntil             string
+	DockerPruneFilters           []string
+	ReadOnly                     bool
+	StrictArch                   bool
+	AllowUnsafePath              bool
+	AllowWorkspaceMount          bool
+	MultiAttach                  bool
+	KeepVolumeOnFailure          bool
+	KeepVolume                   bool
+	DeleteSourceVolume           bool
+	ReuseVolumes                 bool
+	ForceDetach                  bool
+	DropCaches                   bool
+	SnapshotLock                 bool
+	ReplacePrevious              bool
+	FastSnapshotRestore          bool
+	StorageTier                  string
+	ArchivedRestoreTimeout       time.Duration
+	SkipUnchanged                bool
+	FailOnCacheMiss              bool
+	ContinueOnError              bool
+	IncompleteSnapshotPolicy     string
+	GithubRef                    string
+	GithubRepository             string
+	GithubSha                    string
+	GithubRunID                  string
+	GithubWorkflow               string
+	GithubJob                    string
+	InstanceID                   string
+	Az                           string
+	CustomTags                   []Tag
+	RestoreFilters               []Tag
+	TagPrefix                    string
+	SnapshotName                 string
+	SnapshotID                   string
+	SnapshotOwnerIDs             []string
+	ShareWithAccounts            []string
+	KmsKeyID                     string
+	AssumeRoleARN                string
+	AssumeRoleExternalID         string
+	CheckPermissions             bool
+	MaxSnapshotAgeHours          int32
+	DisableDefaultBranchFallback bool
+	BranchAgnostic               bool
+	GrowToSnapshot               bool
+	ReformatOnMismatch           bool
+	ForceFormatOnMountFailure    bool
+	// PullRequestBranches are the head and base branches of the pull request that triggered the workflow, if any
+	PullRequestBranches []string
+	RunnerConfig        *RunnerConfig
+	ResultFile          string
+	MetricsFile         string
+	FallbackBackend     string
+	FallbackS3Bucket    string
+	FallbackS3Prefix    string
+	WebhookURL          string
+	WebhookAuthHeader   string
+	EventBusName        string
+	LogLevel            zerolog.Level
+	LogFormat           string
 }
 
 type Tag struct {
@@ -39,6 +265,23 @@ type Tag struct {
 	Value string `json:"value"`
 }
 
+// Validate checks the tag against AWS limits, so that resource creation doesn't fail midway.
+func (t Tag) Validate() error {
+	if t.Key == "" {
+		return fmt.Errorf("tag key cannot be empty")
+	}
+	if len(t.Key) > maxTagKeyLength {
+		return fmt.Errorf("tag key '%s' is longer than %d characters", t.Key, maxTagKeyLength)
+	}
+	if len(t.Value) > maxTagValueLength {
+		return fmt.Errorf("value of tag '%s' is longer than %d characters", t.Key, maxTagValueLength)
+	}
+	if strings.HasPrefix(strings.ToLower(t.Key), "aws:") {
+		return fmt.Errorf("tag key '%s' uses the reserved 'aws:' prefix", t.Key)
+	}
+	return nil
+}
+
 type RunnerConfig struct {
 	DefaultBranch string `json:"defaultBranch"`
 	CustomTags    []Tag  `json:"customTags"`
@@ -49,23 +292,52 @@ func NewConfigFromInputs(action *githubactions.Action) *Config {
 	cfg := &Config{
 		GithubRef:        os.Getenv("GITHUB_REF_NAME"),
 		GithubRepository: os.Getenv("GITHUB_REPOSITORY"),
+		GithubSha:        os.Getenv("GITHUB_SHA"),
+		GithubRunID:      os.Getenv("GITHUB_RUN_ID"),
+		GithubWorkflow:   sanitizeTagValue(os.Getenv("GITHUB_WORKFLOW")),
+		GithubJob:        sanitizeTagValue(os.Getenv("GITHUB_JOB")),
 		InstanceID:       os.Getenv("RUNS_ON_INSTANCE_ID"),
 		Az:               os.Getenv("RUNS_ON_AWS_AZ"),
 	}
 
+	in := newInputs(action)
+
+	// Outside of RunsOn (or before v2.8.3), the config file is missing: the instance ID and AZ are then taken from IMDS,
+	// and the default branch from the GitHub API
+	runnerConfigFound := false
+	cfg.RunnerConfig = &RunnerConfig{}
 	configBytes, err := os.ReadFile(filepath.Join(os.Getenv("RUNS_ON_HOME"), "config.json"))
 	if err != nil {
-		action.Fatalf("Error reading RunsOn config file: %v. You must be using RunsOn v2.8.3+", err)
+		action.Warningf("Error reading RunsOn config file: %v. Continuing without it (it is provided by RunsOn v2.8.3+)", err)
 	} else {
 		var runnerConfig RunnerConfig
 		if err := json.Unmarshal(configBytes, &runnerConfig); err != nil {
 			action.Warningf("Error parsing RunsOn config file: %v", err)
 		} else {
 			cfg.RunnerConfig = &runnerConfig
+			runnerConfigFound = true
 			action.Infof("Runner config: %s", utils.PrettyPrint(cfg.RunnerConfig))
 		}
 	}
 
+	githubToken := in.get("github_token")
+	if githubToken == "" {
+		githubToken = os.Getenv("GITHUB_TOKEN")
+	}
+	if githubToken != "" {
+		action.AddMask(githubToken)
+	}
+	if cfg.RunnerConfig.DefaultBranch == "" {
+		cfg.RunnerConfig.DefaultBranch = defaultBranchFromGithub(action, githubToken, cfg.GithubRepository)
+	}
+
+	cfg.PullRequestBranches, err = pullRequestBranches(os.Getenv("GITHUB_EVENT_NAME"), os.Getenv("GITHUB_EVENT_PATH"), cfg.GithubRepository)
+	if err != nil {
+		action.Warningf("Failed to read the pull request event: %v. Snapshots of its head and base branches will not be used as a fallback.", err)
+	} else if len(cfg.PullRequestBranches) > 0 {
+		action.Infof("Pull request branches: %s", strings.Join(cfg.PullRequestBranches, ", "))
+	}
+
 	requiredTagPresent := false
 	for _, tag := range cfg.RunnerConfig.CustomTags {
 		if tag.Key == requiredTagKey {
@@ -77,48 +349,586 @@ func NewConfigFromInputs(action *githubactions.Action) *Config {
 		})
 	}
 
-	if !requiredTagPresent {
+	if runnerConfigFound && !requiredTagPresent {
 		action.Fatalf("Required tag '%s' is not present in the RunsOn config file.", requiredTagKey)
 	}
 
-	path := action.GetInput("path")
-	path = strings.TrimSpace(path)
-	if path == "" {
+	cfg.TagPrefix = strings.TrimSpace(in.get("tag_prefix"))
+	if !tagPrefixPattern.MatchString(cfg.TagPrefix) || strings.HasPrefix(strings.ToLower(cfg.TagPrefix), "aws:") {
+		action.Fatalf("Invalid value for 'tag_prefix' '%s': must be a valid tag key, not starting with 'aws:'", cfg.TagPrefix)
+	}
+	// Leave room for the longest suffix, "-repository"
+	if len(cfg.TagPrefix) > maxTagKeyLength-len("-repository") {
+		action.Fatalf("Invalid value for 'tag_prefix' '%s': must be at most %d characters", cfg.TagPrefix, maxTagKeyLength-len("-repository"))
+	}
+
+	inputTags, err := parseTags(in.get("tags"))
+	if err != nil {
+		action.Fatalf("Invalid value for 'tags': %v", err)
+	}
+	cfg.CustomTags = mergeTags(cfg.CustomTags, inputTags)
+	for _, tag := range cfg.CustomTags {
+		if err := tag.Validate(); err != nil {
+			action.Fatalf("Invalid custom tag: %v", err)
+		}
+	}
+
+	cfg.RestoreFilters, err = parseRestoreFilters(in.get("restore_filters"))
+	if err != nil {
+		action.Fatalf("Invalid value for 'restore_filters': %v", err)
+	}
+
+	cfg.AllowUnsafePath = in.get("allow_unsafe_path") == "true"
+	cfg.AllowWorkspaceMount = in.get("allow_workspace_mount") == "true"
+	cfg.SharedVolume = in.get("shared_volume") == "true"
+	cfg.RawDevice, err = rawDeviceMode(in)
+	if err != nil {
+		action.Fatalf("Input %v.", err)
+	}
+	var paths []string
+	for _, path := range strings.Split(in.get("path"), "\n") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			action.Fatalf("Path '%s' must be an absolute path.", path)
+		}
+		if err := validatePathIsSafe(path); err != nil {
+			if !cfg.AllowUnsafePath {
+				action.Fatalf("%v. Set 'allow_unsafe_path' to true if you really want to mount over it.", err)
+			}
+			action.Warningf("%v, but 'allow_unsafe_path' is set.", err)
+		}
+		if err := validatePathIsNotWorkspace(path, os.Getenv("GITHUB_WORKSPACE")); err != nil {
+			if !cfg.AllowWorkspaceMount {
+				action.Fatalf("%v. Set 'allow_workspace_mount' to true if you really want to mount over it.", err)
+			}
+			action.Warningf("%v, but 'allow_workspace_mount' is set.", err)
+		}
+		paths = append(paths, filepath.Clean(path))
+	}
+	if len(paths) == 0 && !cfg.RawDevice {
 		action.Fatalf("Path is required.")
 	}
-	if !strings.HasPrefix(path, "/") {
-		action.Fatalf("Path '%s' must be an absolute path.", path)
+	if cfg.RawDevice {
+		if len(paths) > 0 {
+			action.Fatalf("Input 'path' cannot be set with 'raw_device', since the volume is not mounted.")
+		}
+		if cfg.SharedVolume {
+			action.Fatalf("Input 'raw_device' cannot be combined with 'shared_volume'.")
+		}
+		cfg.Path = RawDeviceMountPoint
+	} else if cfg.SharedVolume {
+		if err := validateSharedPaths(paths); err != nil {
+			action.Fatalf("Invalid value for 'path': %v", err)
+		}
+		cfg.SharedPaths = paths
+		cfg.Path = SharedVolumeMountPoint
+	} else if len(paths) > 1 {
+		action.Fatalf("Multiple paths are only supported with 'shared_volume'.")
+	} else {
+		cfg.Path = paths[0]
 	}
-	cfg.Path = path
 
-	cfg.Version = action.GetInput("version")
+	cfg.Overlay = in.get("overlay") == "true"
+	if cfg.Overlay {
+		if cfg.SharedVolume || cfg.RawDevice {
+			action.Fatalf("Input 'overlay' cannot be combined with 'shared_volume' or 'raw_device'.")
+		}
+		// The path is given as an overlayfs mount option, where commas and colons are separators
+		if strings.ContainsAny(cfg.Path, ",: \t") {
+			action.Fatalf("Path '%s' cannot contain commas, colons or whitespace with 'overlay'.", cfg.Path)
+		}
+		cfg.OverlayPath = cfg.Path
+		cfg.Path = OverlayVolumeMountPoint
+	}
+
+	cfg.Mode = in.get("mode")
+	if cfg.Mode == "" {
+		cfg.Mode = ModeSnapshot
+	}
+	if cfg.Mode != ModeSnapshot && cfg.Mode != ModePersistentVolume {
+		action.Fatalf("Invalid value for 'mode' '%s': must be one of %s, %s", cfg.Mode, ModeSnapshot, ModePersistentVolume)
+	}
+
+	cfg.Version = in.get("version")
 	if cfg.Version == "" {
 		cfg.Version = "v1"
 	}
+	for _, version := range strings.Split(in.get("restore_versions"), ",") {
+		version = strings.TrimSpace(version)
+		if version != "" && !slices.Contains(cfg.RestoreVersions, version) {
+			cfg.RestoreVersions = append(cfg.RestoreVersions, version)
+		}
+	}
+	if len(cfg.RestoreVersions) == 0 {
+		cfg.RestoreVersions = []string{cfg.Version}
+	} else if !slices.Contains(cfg.RestoreVersions, cfg.Version) {
+		action.Warningf("Input 'restore_versions' does not include 'version' %s: snapshots saved by this job will not be restored by it.", cfg.Version)
+	}
 
-	cfg.WaitForCompletion = action.GetInput("wait_for_completion") != "false"
-	cfg.Save = action.GetInput("save") != "false"
+	cfg.SnapshotID = strings.TrimSpace(in.get("snapshot_id"))
+	if cfg.SnapshotID != "" && !strings.HasPrefix(cfg.SnapshotID, "snap-") {
+		action.Fatalf("Invalid value for 'snapshot_id' '%s': must be a snapshot ID such as snap-0123456789abcdef0", cfg.SnapshotID)
+	}
 
-	volumeType := action.GetInput("volume_type")
+	for _, ownerID := range strings.Split(in.get("snapshot_owner_ids"), ",") {
+		ownerID = strings.TrimSpace(ownerID)
+		if ownerID == "" {
+			continue
+		}
+		if ownerID != "self" && !accountIDPattern.MatchString(ownerID) {
+			action.Fatalf("Invalid value for 'snapshot_owner_ids' '%s': must be 'self' or a 12-digit AWS account ID", ownerID)
+		}
+		cfg.SnapshotOwnerIDs = append(cfg.SnapshotOwnerIDs, ownerID)
+	}
+	if len(cfg.SnapshotOwnerIDs) == 0 {
+		cfg.SnapshotOwnerIDs = []string{"self"}
+	}
+
+	for _, accountID := range strings.Split(in.get("share_with_accounts"), ",") {
+		accountID = strings.TrimSpace(accountID)
+		if accountID == "" {
+			continue
+		}
+		if !accountIDPattern.MatchString(accountID) {
+			action.Fatalf("Invalid value for 'share_with_accounts' '%s': must be a 12-digit AWS account ID", accountID)
+		}
+		cfg.ShareWithAccounts = append(cfg.ShareWithAccounts, accountID)
+	}
+
+	cfg.KmsKeyID = strings.TrimSpace(in.get("kms_key_id"))
+	if cfg.KmsKeyID != "" && !kmsKeyIDPattern.MatchString(cfg.KmsKeyID) {
+		action.Fatalf("Invalid value for 'kms_key_id' '%s': must be a KMS key ID, key ARN, alias name (alias/...) or alias ARN", cfg.KmsKeyID)
+	}
+
+	cfg.AssumeRoleARN = strings.TrimSpace(in.get("assume_role_arn"))
+	if cfg.AssumeRoleARN != "" && !roleARNPattern.MatchString(cfg.AssumeRoleARN) {
+		action.Fatalf("Invalid value for 'assume_role_arn' '%s': must be an IAM role ARN (arn:aws:iam::<account>:role/<name>)", cfg.AssumeRoleARN)
+	}
+	cfg.AssumeRoleExternalID = strings.TrimSpace(in.get("assume_role_external_id"))
+	if cfg.AssumeRoleExternalID != "" && cfg.AssumeRoleARN == "" {
+		action.Fatalf("'assume_role_external_id' requires 'assume_role_arn'")
+	}
+
+	cfg.MaxSnapshotAgeHours = parseInt(action, in, "max_snapshot_age_hours", 0, 0)
+	cfg.DisableDefaultBranchFallback = in.get("disable_default_branch_fallback") == "true"
+	cfg.BranchAgnostic = in.get("branch_agnostic") == "true"
+	cfg.GrowToSnapshot = in.get("grow_to_snapshot") != "false"
+	cfg.PreferWarmSnapshots = in.get("prefer_warm_snapshots") == "true"
+
+	cfg.WaitForCompletion = in.get("wait_for_completion") != "false"
+	cfg.WaitForInitialSnapshot = in.get("wait_for_initial_snapshot") != "false"
+	cfg.HeartbeatInterval = time.Duration(parseInt(action, in, "heartbeat_interval_seconds", 0, 0)) * time.Second
+	cfg.Save = in.get("save") != "false"
+	cfg.ReadOnly = in.get("read_only") == "true"
+	if cfg.ReadOnly && cfg.Overlay {
+		action.Fatalf("Input 'overlay' cannot be combined with 'read_only', since the volume holds the writable layer.")
+	}
+	if cfg.ReadOnly && cfg.RawDevice {
+		action.Fatalf("Input 'raw_device' cannot be combined with 'read_only', since the volume is not mounted. Set 'save' to false to not snapshot it.")
+	}
+	cfg.StrictArch = in.get("strict_arch") == "true"
+	cfg.KeepVolumeOnFailure = in.get("keep_volume_on_failure") == "true"
+	cfg.KeepVolume = in.get("keep_volume") == "true"
+	cfg.DeleteSourceVolume = in.get("delete_source_volume") != "false"
+	cfg.ReuseVolumes = in.get("reuse_volumes") == "true"
+	cfg.ForceDetach = in.get("force_detach") == "true"
+	cfg.DropCaches = in.get("drop_caches") == "true"
+	cfg.SnapshotLock = in.get("snapshot_lock") == "true"
+	cfg.ReplacePrevious = in.get("replace_previous") == "true"
+	cfg.FastSnapshotRestore = in.get("fast_snapshot_restore") == "true"
+	cfg.StorageTier = strings.TrimSpace(in.get("storage_tier"))
+	if cfg.StorageTier != StorageTierStandard && cfg.StorageTier != StorageTierArchive {
+		action.Fatalf("Invalid value for 'storage_tier' '%s': must be one of %s, %s", cfg.StorageTier, StorageTierStandard, StorageTierArchive)
+	}
+	if cfg.StorageTier == StorageTierArchive && cfg.FastSnapshotRestore {
+		action.Fatalf("Input 'fast_snapshot_restore' cannot be combined with 'storage_tier' '%s'", StorageTierArchive)
+	}
+	cfg.ArchivedRestoreTimeout = time.Duration(parseInt(action, in, "archive_restore_timeout_minutes", 0, 0)) * time.Minute
+	cfg.SkipUnchanged = in.get("skip_unchanged") == "true"
+	cfg.FailOnCacheMiss = in.get("fail_on_cache_miss") == "true"
+	cfg.ContinueOnError = in.get("continue_on_error") == "true"
+	cfg.CheckPermissions = in.get("check_permissions") != "false"
+
+	cfg.IncompleteSnapshotPolicy = in.get("incomplete_snapshot_policy")
+	if cfg.IncompleteSnapshotPolicy == "" {
+		cfg.IncompleteSnapshotPolicy = IncompleteSnapshotPolicyTag
+	}
+	switch cfg.IncompleteSnapshotPolicy {
+	case IncompleteSnapshotPolicyDelete, IncompleteSnapshotPolicyTag, IncompleteSnapshotPolicyKeep:
+	default:
+		action.Fatalf("Invalid value for 'incomplete_snapshot_policy' '%s': must be one of %s, %s, %s", cfg.IncompleteSnapshotPolicy, IncompleteSnapshotPolicyDelete, IncompleteSnapshotPolicyTag, IncompleteSnapshotPolicyKeep)
+	}
+
+	volumeType := in.get("volume_type")
 	if volumeType == "" {
 		volumeType = "gp3"
 	}
 	cfg.VolumeType = types.VolumeType(volumeType)
+	if _, ok := volumeSizeLimits[cfg.VolumeType]; !ok {
+		action.Fatalf("Invalid value for 'volume_type' '%s': must be one of gp2, gp3, io1, io2, st1, sc1, standard", volumeType)
+	}
+
+	cfg.MultiAttach = in.get("multi_attach") == "true"
+	if cfg.MultiAttach && cfg.VolumeType != types.VolumeTypeIo1 && cfg.VolumeType != types.VolumeTypeIo2 {
+		action.Fatalf("Input 'multi_attach' requires an io1 or io2 volume type, got '%s'", cfg.VolumeType)
+	}
+	if cfg.MultiAttach && cfg.Mode == ModePersistentVolume {
+		action.Fatalf("Input 'multi_attach' cannot be combined with mode '%s'", ModePersistentVolume)
+	}
+	if cfg.SnapshotID != "" && (cfg.MultiAttach || cfg.Mode == ModePersistentVolume) {
+		action.Warningf("Input 'snapshot_id' is only used when no existing volume is found for 'multi_attach' or mode '%s'", ModePersistentVolume)
+	}
+	if cfg.MultiAttach && !cfg.ReadOnly {
+		action.Warningf("Input 'multi_attach' is enabled without 'read_only': concurrent writes from multiple runners will corrupt a non-clustered filesystem")
+	}
+
+	if strings.TrimSpace(in.get("volume_initialization_rate")) == "auto" {
+		cfg.VolumeInitializationRate = VolumeInitializationRateAuto
+	} else {
+		cfg.VolumeInitializationRate = parseInt(action, in, "volume_initialization_rate", 0, 0)
+		if rate := cfg.VolumeInitializationRate; rate != 0 && (rate < MinVolumeInitializationRate || rate > MaxVolumeInitializationRate) {
+			action.Fatalf("Invalid value for 'volume_initialization_rate' '%d': must be between %d and %d MiB/s, 0 to disable it, or auto", rate, MinVolumeInitializationRate, MaxVolumeInitializationRate)
+		}
+	}
+	cfg.VolumeIops = parseInt(action, in, "volume_iops", 100, 0)
+	cfg.VolumeThroughput = parseInt(action, in, "volume_throughput", 100, 0)
+	volumeSize, err := parseSizeGiB(in.get("volume_size"))
+	if err != nil {
+		action.Fatalf("Invalid value for 'volume_size' '%s': %v", in.get("volume_size"), err)
+	}
+	cfg.VolumeSize = volumeSize
+	if err := validateVolumeSize(cfg.VolumeType, cfg.VolumeSize); err != nil {
+		action.Fatalf("Invalid value for 'volume_size' %d: %v", cfg.VolumeSize, err)
+	}
+	if cfg.VolumeType == types.VolumeTypeGp3 {
+		if err := validateGp3Performance(cfg.VolumeIops, cfg.VolumeThroughput, cfg.VolumeSize); err != nil {
+			action.Fatalf("Invalid gp3 volume performance: %v", err)
+		}
+	}
+
+	logLevel := strings.TrimSpace(in.get("log_level"))
+	if logLevel == "" {
+		logLevel = "info"
+	}
+	switch logLevel {
+	case "trace", "debug", "info", "warn", "error":
+		cfg.LogLevel, _ = zerolog.ParseLevel(logLevel)
+	default:
+		action.Fatalf("Invalid value for 'log_level' '%s': must be one of trace, debug, info, warn, error", logLevel)
+	}
+
+	cfg.LogFormat = strings.TrimSpace(in.get("log_format"))
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = LogFormatJSON
+	}
+	if cfg.LogFormat != LogFormatJSON && cfg.LogFormat != LogFormatConsole {
+		action.Fatalf("Invalid value for 'log_format' '%s': must be one of %s, %s", cfg.LogFormat, LogFormatJSON, LogFormatConsole)
+	}
+
+	cfg.ResultFile = strings.TrimSpace(in.get("result_file"))
+	if cfg.ResultFile == "" {
+		cfg.ResultFile = defaultResultFile
+	}
+
+	cfg.MetricsFile = strings.TrimSpace(in.get("metrics_file"))
+
+	cfg.FallbackBackend = strings.TrimSpace(in.get("fallback_backend"))
+	if cfg.FallbackBackend != "" && cfg.FallbackBackend != FallbackBackendS3 {
+		action.Fatalf("Invalid value for 'fallback_backend' '%s': must be empty or %s", cfg.FallbackBackend, FallbackBackendS3)
+	}
+	cfg.FallbackS3Bucket = strings.TrimSpace(in.get("fallback_s3_bucket"))
+	if cfg.FallbackBackend == FallbackBackendS3 && (cfg.SharedVolume || cfg.Overlay || cfg.RawDevice) {
+		action.Fatalf("Input 'fallback_backend' is not supported with 'shared_volume', 'overlay' or 'raw_device'.")
+	}
+	if cfg.FallbackBackend == FallbackBackendS3 && cfg.FallbackS3Bucket == "" {
+		action.Fatalf("Input 'fallback_s3_bucket' is required when 'fallback_backend' is %s", FallbackBackendS3)
+	}
+	cfg.FallbackS3Prefix = strings.Trim(strings.TrimSpace(in.get("fallback_s3_prefix")), "/")
+
+	cfg.WebhookURL = strings.TrimSpace(in.get("webhook_url"))
+	if cfg.WebhookURL != "" && !strings.HasPrefix(cfg.WebhookURL, "https://") && !strings.HasPrefix(cfg.WebhookURL, "http://") {
+		action.Fatalf("Invalid value for 'webhook_url' '%s': must be an http(s) URL", cfg.WebhookURL)
+	}
+	cfg.WebhookAuthHeader = strings.TrimSpace(in.get("webhook_auth_header"))
+	if cfg.WebhookAuthHeader != "" {
+		action.AddMask(cfg.WebhookAuthHeader)
+	}
+
+	cfg.EventBusName = strings.TrimSpace(in.get("event_bus_name"))
+	if cfg.EventBusName != "" && !eventBusPattern.MatchString(cfg.EventBusName) {
+		action.Fatalf("Invalid value for 'event_bus_name' '%s': must be an EventBridge event bus name or ARN", cfg.EventBusName)
+	}
+
+	cfg.MountOptions = strings.TrimSpace(in.get("mount_options"))
+	if !safeOptionsPattern.MatchString(cfg.MountOptions) {
+		action.Fatalf("Invalid value for 'mount_options' '%s': only letters, digits and ,=_./:+- are allowed", cfg.MountOptions)
+	}
+
+	cfg.Filesystem = strings.TrimSpace(in.get("filesystem"))
+	if cfg.Filesystem == "" {
+		cfg.Filesystem = FilesystemExt4
+	}
+	switch cfg.Filesystem {
+	case FilesystemExt4, FilesystemXfs, FilesystemBtrfs:
+	default:
+		action.Fatalf("Invalid value for 'filesystem' '%s': must be one of %s, %s, %s", cfg.Filesystem, FilesystemExt4, FilesystemXfs, FilesystemBtrfs)
+	}
+	cfg.ReformatOnMismatch = in.get("reformat_on_mismatch") == "true"
+	cfg.ForceFormatOnMountFailure = in.get("force_format_on_mount_failure") == "true"
+
+	cfg.FilesystemLabel = strings.TrimSpace(in.get("filesystem_label"))
+	if maxLength := maxFilesystemLabelLengths[cfg.Filesystem]; len(cfg.FilesystemLabel) > maxLength {
+		action.Fatalf("Invalid value for 'filesystem_label' '%s': %s labels are limited to %d characters", cfg.FilesystemLabel, cfg.Filesystem, maxLength)
+	}
+	if strings.ContainsAny(cfg.FilesystemLabel, " \t\n") {
+		action.Fatalf("Invalid value for 'filesystem_label' '%s': must not contain whitespace", cfg.FilesystemLabel)
+	}
+
+	cfg.MkfsOptions = strings.Fields(in.get("mkfs_options"))
+	for _, option := range cfg.MkfsOptions {
+		if !mkfsOptionPattern.MatchString(option) {
+			action.Fatalf("Invalid value for 'mkfs_options' '%s': only letters, digits and ,=_./:+^- are allowed", option)
+		}
+	}
+
+	cfg.BtrfsCompression = strings.TrimSpace(in.get("btrfs_compression"))
+	if cfg.BtrfsCompression == "none" {
+		cfg.BtrfsCompression = ""
+	}
+	if !safeOptionsPattern.MatchString(cfg.BtrfsCompression) || strings.Contains(cfg.BtrfsCompression, ",") {
+		action.Fatalf("Invalid value for 'btrfs_compression' '%s': must be a single compression option such as zstd or zstd:3", cfg.BtrfsCompression)
+	}
+
+	cfg.DeviceName = strings.TrimSpace(in.get("device_name"))
+	if err := validateDeviceName(cfg.DeviceName); err != nil {
+		action.Fatalf("Invalid value for 'device_name' '%s': %v", cfg.DeviceName, err)
+	}
+
+	cfg.Runtime = strings.TrimSpace(in.get("runtime"))
+	if cfg.Runtime != RuntimeDocker && cfg.Runtime != RuntimeContainerd {
+		action.Fatalf("Invalid value for 'runtime' '%s': must be one of %s, %s", cfg.Runtime, RuntimeDocker, RuntimeContainerd)
+	}
+	cfg.RuntimeReadyTimeout = time.Duration(parseInt(action, in, "runtime_ready_timeout_seconds", 0, 0)) * time.Second
+	cfg.ManageRuntime = in.get("manage_runtime") != "false"
 
-	cfg.VolumeInitializationRate = parseInt(action, "volume_initialization_rate", 0, 0)
-	cfg.VolumeIops = parseInt(action, "volume_iops", 100, 0)
-	cfg.VolumeThroughput = parseInt(action, "volume_throughput", 100, 0)
-	cfg.VolumeSize = parseInt(action, "volume_size", 1, 0)
+	cfg.DockerPruneUntil = strings.TrimSpace(in.get("docker_prune_until"))
+	if strings.ContainsAny(cfg.DockerPruneUntil, " \t\n") {
+		action.Fatalf("Invalid value for 'docker_prune_until' '%s': must be a duration (e.g. 24h) or a timestamp", cfg.DockerPruneUntil)
+	}
+	for _, filter := range strings.Split(in.get("docker_prune_filters"), "\n") {
+		filter = strings.TrimSpace(filter)
+		if filter == "" {
+			continue
+		}
+		if !strings.Contains(filter, "=") {
+			action.Fatalf("Invalid value for 'docker_prune_filters' '%s': filters must be in the form key=value or key!=value", filter)
+		}
+		cfg.DockerPruneFilters = append(cfg.DockerPruneFilters, filter)
+	}
 
 	action.Infof("Input 'path': %v", cfg.Path)
+	action.Infof("Input 'tag_prefix': %s", cfg.TagPrefix)
+	action.Infof("Input 'allow_workspace_mount': %t", cfg.AllowWorkspaceMount)
+	action.Infof("Input 'shared_volume': %t", cfg.SharedVolume)
+	if cfg.SharedVolume {
+		action.Infof("Shared paths: %s", strings.Join(cfg.SharedPaths, ", "))
+	}
+	action.Infof("Input 'overlay': %t", cfg.Overlay)
+	if cfg.Overlay {
+		action.Infof("Overlay path: %s", cfg.OverlayPath)
+	}
+	action.Infof("Input 'raw_device': %t", cfg.RawDevice)
+	action.Infof("Input 'mode': %s", cfg.Mode)
 	action.Infof("Input 'version': %s", cfg.Version)
+	action.Infof("Input 'restore_versions': %s", strings.Join(cfg.RestoreVersions, ","))
+	action.Infof("Input 'snapshot_id': %s", cfg.SnapshotID)
+	action.Infof("Input 'snapshot_owner_ids': %s", strings.Join(cfg.SnapshotOwnerIDs, ","))
+	restoreFilters := []string{}
+	for _, filter := range cfg.RestoreFilters {
+		restoreFilters = append(restoreFilters, fmt.Sprintf("tag:%s=%s", filter.Key, filter.Value))
+	}
+	action.Infof("Input 'restore_filters': %s", strings.Join(restoreFilters, ", "))
+	action.Infof("Input 'share_with_accounts': %s", strings.Join(cfg.ShareWithAccounts, ","))
+	action.Infof("Input 'kms_key_id': %s", cfg.KmsKeyID)
+	action.Infof("Input 'assume_role_arn': %s", cfg.AssumeRoleARN)
+	action.Infof("Input 'max_snapshot_age_hours': %d", cfg.MaxSnapshotAgeHours)
+	action.Infof("Input 'disable_default_branch_fallback': %t", cfg.DisableDefaultBranchFallback)
+	action.Infof("Input 'branch_agnostic': %t", cfg.BranchAgnostic)
+	action.Infof("Input 'grow_to_snapshot': %t", cfg.GrowToSnapshot)
+	action.Infof("Input 'prefer_warm_snapshots': %t", cfg.PreferWarmSnapshots)
 	action.Infof("Input 'wait_for_completion': %t", cfg.WaitForCompletion)
+	action.Infof("Input 'wait_for_initial_snapshot': %t", cfg.WaitForInitialSnapshot)
+	action.Infof("Input 'heartbeat_interval_seconds': %d", int(cfg.HeartbeatInterval.Seconds()))
+	action.Infof("Input 'mount_options': %s", cfg.MountOptions)
+	action.Infof("Input 'device_name': %s", cfg.DeviceName)
+	action.Infof("Input 'filesystem': %s", cfg.Filesystem)
+	action.Infof("Input 'reformat_on_mismatch': %t", cfg.ReformatOnMismatch)
+	action.Infof("Input 'force_format_on_mount_failure': %t", cfg.ForceFormatOnMountFailure)
+	action.Infof("Input 'filesystem_label': %s", cfg.FilesystemLabel)
+	action.Infof("Input 'mkfs_options': %s", strings.Join(cfg.MkfsOptions, " "))
+	action.Infof("Input 'runtime': %s", cfg.Runtime)
+	action.Infof("Input 'runtime_ready_timeout_seconds': %d", int(cfg.RuntimeReadyTimeout.Seconds()))
+	action.Infof("Input 'manage_runtime': %t", cfg.ManageRuntime)
+	action.Infof("Input 'fallback_backend': %s", cfg.FallbackBackend)
+	action.Infof("Input 'event_bus_name': %s", cfg.EventBusName)
+	action.Infof("Input 'docker_prune_until': %s", cfg.DockerPruneUntil)
+	action.Infof("Input 'docker_prune_filters': %s", strings.Join(cfg.DockerPruneFilters, ", "))
+	action.Infof("Input 'read_only': %t", cfg.ReadOnly)
+	action.Infof("Input 'strict_arch': %t", cfg.StrictArch)
+	action.Infof("Input 'multi_attach': %t", cfg.MultiAttach)
+	action.Infof("Input 'keep_volume_on_failure': %t", cfg.KeepVolumeOnFailure)
+	action.Infof("Input 'keep_volume': %t", cfg.KeepVolume)
+	action.Infof("Input 'delete_source_volume': %t", cfg.DeleteSourceVolume)
+	action.Infof("Input 'reuse_volumes': %t", cfg.ReuseVolumes)
+	action.Infof("Input 'force_detach': %t", cfg.ForceDetach)
+	action.Infof("Input 'drop_caches': %t", cfg.DropCaches)
+	action.Infof("Input 'snapshot_lock': %t", cfg.SnapshotLock)
+	action.Infof("Input 'replace_previous': %t", cfg.ReplacePrevious)
+	action.Infof("Input 'fast_snapshot_restore': %t", cfg.FastSnapshotRestore)
+	action.Infof("Input 'storage_tier': %s", cfg.StorageTier)
+	action.Infof("Input 'archive_restore_timeout_minutes': %d", int(cfg.ArchivedRestoreTimeout.Minutes()))
+	action.Infof("Input 'skip_unchanged': %t", cfg.SkipUnchanged)
+	action.Infof("Input 'fail_on_cache_miss': %t", cfg.FailOnCacheMiss)
+	action.Infof("Input 'continue_on_error': %t", cfg.ContinueOnError)
+	action.Infof("Input 'check_permissions': %t", cfg.CheckPermissions)
+
+	in.validateFileKeys()
 
 	return cfg
 }
 
-func parseInt(action *githubactions.Action, input string, min int, max int) int32 {
-	value := action.GetInput(input)
+// defaultBranchFromGithub returns the default branch of the repository from the GitHub API, when it is not provided by
+// the RunsOn config file. It returns an empty string on failure, which disables the default branch fallback.
+func defaultBranchFromGithub(action *githubactions.Action, token string, repository string) string {
+	if repository == "" {
+		return ""
+	}
+	defaultBranch, err := github.DefaultBranch(context.Background(), os.Getenv("GITHUB_API_URL"), token, repository)
+	if err != nil {
+		action.Warningf("No default branch in the RunsOn config file, and failed to get it from the GitHub API: %v. Snapshots of the default branch will not be used as a fallback.", err)
+		return ""
+	}
+	action.Infof("Default branch from the GitHub API: %s", defaultBranch)
+	return defaultBranch
+}
+
+// pullRequestEvent is the subset of the pull_request event payload holding the head and base branches.
+type pullRequestEvent struct {
+	PullRequest struct {
+		Head struct {
+			Ref  string `json:"ref"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+}
+
+// pullRequestBranches returns the head and base branches of the pull request from the event payload at eventPath, in
+// that order, for pull_request and pull_request_target events. The head branch of a fork is ignored, since a branch
+// with the same name in the repository is unrelated.
+func pullRequestBranches(eventName, eventPath, repository string) ([]string, error) {
+	if (eventName != "pull_request" && eventName != "pull_request_target") || eventPath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(eventPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event payload: %w", err)
+	}
+	var event pullRequestEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("failed to parse event payload: %w", err)
+	}
+	var branches []string
+	head := event.PullRequest.Head
+	if head.Ref != "" && strings.EqualFold(head.Repo.FullName, repository) {
+		branches = append(branches, head.Ref)
+	}
+	if base := event.PullRequest.Base.Ref; base != "" && !slices.Contains(branches, base) {
+		branches = append(branches, base)
+	}
+	return branches, nil
+}
+
+// rawDeviceMode returns whether the volume is only attached, with 'raw_device' or its 'skip_mount' alias. 'skip_unmount'
+// is accepted along with them, but not alone, since a volume mounted by the action is always unmounted before being
+// detached.
+func rawDeviceMode(in *inputs) (bool, error) {
+	rawDevice := in.get("raw_device") == "true" || in.get("skip_mount") == "true"
+	if in.get("skip_unmount") == "true" && !rawDevice {
+		return false, fmt.Errorf("'skip_unmount' requires 'skip_mount' (or 'raw_device'), since the volumes mounted by the action are always unmounted before being detached")
+	}
+	return rawDevice, nil
+}
+
+// validateDeviceName checks that an explicit device name is one recommended by AWS for EBS volumes. An empty device
+// name selects the default device.
+func validateDeviceName(deviceName string) error {
+	if deviceName != "" && !deviceNamePattern.MatchString(deviceName) {
+		return fmt.Errorf("must be in the /dev/sd[f-p] or /dev/xvd* range")
+	}
+	return nil
+}
+
+// validateVolumeSize checks the size against the minimum and maximum size of the volume type.
+func validateVolumeSize(volumeType types.VolumeType, sizeGiB int32) error {
+	if limits := volumeSizeLimits[volumeType]; sizeGiB < limits.min || sizeGiB > limits.max {
+		return fmt.Errorf("%s volumes must be between %d and %d GiB", volumeType, limits.min, limits.max)
+	}
+	return nil
+}
+
+// validateGp3Performance checks the IOPS and throughput against the limits of gp3 volumes, so that the volume creation
+// is not rejected by EC2 midway through the restore.
+func validateGp3Performance(iops int32, throughput int32, sizeGiB int32) error {
+	if iops < gp3MinIops || iops > gp3MaxIops {
+		return fmt.Errorf("'volume_iops' %d must be between %d and %d", iops, gp3MinIops, gp3MaxIops)
+	}
+	if maxIops := int64(sizeGiB) * gp3MaxIopsPerGiB; int64(iops) > maxIops {
+		return fmt.Errorf("'volume_iops' %d exceeds %d IOPS per GiB for a %d GiB volume (at most %d): increase 'volume_size' to at least %d GiB", iops, gp3MaxIopsPerGiB, sizeGiB, maxIops, (iops+gp3MaxIopsPerGiB-1)/gp3MaxIopsPerGiB)
+	}
+	if throughput < gp3MinThroughput || throughput > gp3MaxThroughput {
+		return fmt.Errorf("'volume_throughput' %d must be between %d and %d MiB/s", throughput, gp3MinThroughput, gp3MaxThroughput)
+	}
+	if maxThroughput := int32(float64(iops) * gp3ThroughputPerIops); throughput > maxThroughput {
+		return fmt.Errorf("'volume_throughput' %d MiB/s requires at least %d IOPS (%g MiB/s per IOPS), but 'volume_iops' is %d: increase 'volume_iops' or lower 'volume_throughput' to %d", throughput, int32(math.Ceil(float64(throughput)/gp3ThroughputPerIops)), gp3ThroughputPerIops, iops, maxThroughput)
+	}
+	return nil
+}
+
+// parseSizeGiB parses a size in GiB, either as a bare integer or with a unit (e.g. 500GiB, 1TB). Sizes that are not a
+// whole number of GiB are rejected.
+func parseSizeGiB(value string) (int32, error) {
+	matches := sizePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if matches == nil {
+		return 0, fmt.Errorf("must be a number of GiB, optionally followed by a unit such as GiB or TiB")
+	}
+	multiplier, ok := sizeUnitsGiB[strings.ToLower(matches[2])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit '%s': must be one of G, GB, Gi, GiB, T, TB, Ti or TiB", matches[2])
+	}
+	number, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	size := number * multiplier
+	if size != math.Trunc(size) {
+		return 0, fmt.Errorf("must be a whole number of GiB")
+	}
+	if size < 1 || size > math.MaxInt32 {
+		return 0, fmt.Errorf("must be between 1 and %d GiB", math.MaxInt32)
+	}
+	return int32(size), nil
+}
+
+func parseInt(action *githubactions.Action, in *inputs, input string, min int, max int) int32 {
+	value := in.get(input)
 	if value == "" {
 		action.Fatalf("%s' cannot be empty", input)
 	}
@@ -134,3 +944,132 @@ func parseInt(action *githubactions.Action, input string, min int, max int) int3
 	}
 	return int32(valueInt)
 }
+
+// validatePathIsSafe returns an error if mounting a volume over p would break the runner.
+func validatePathIsSafe(p string) error {
+	cleaned := path.Clean(p)
+	for _, unsafePath := range unsafePaths {
+		if cleaned == unsafePath {
+			return fmt.Errorf("path '%s' is a system directory and cannot be used as a mount point", p)
+		}
+	}
+	for _, prefix := range unsafePathPrefixes {
+		if cleaned == prefix || strings.HasPrefix(cleaned, prefix+"/") {
+			return fmt.Errorf("path '%s' is within the system directory %s and cannot be used as a mount point", p, prefix)
+		}
+	}
+	return nil
+}
+
+// validatePathIsNotWorkspace rejects the workspace and its parents, since mounting over them would hide the checked-out
+// code. Directories within the workspace are allowed.
+func validatePathIsNotWorkspace(p string, workspace string) error {
+	if workspace == "" {
+		return nil
+	}
+	cleaned, workspace := path.Clean(p), path.Clean(workspace)
+	if cleaned == workspace {
+		return fmt.Errorf("path '%s' is the workspace and cannot be used as a mount point", p)
+	}
+	if cleaned == "/" || strings.HasPrefix(workspace, cleaned+"/") {
+		return fmt.Errorf("path '%s' contains the workspace %s and cannot be used as a mount point", p, workspace)
+	}
+	return nil
+}
+
+// validateSharedPaths rejects duplicate or nested paths in 'shared_volume' mode, since bind mounts of nested paths would
+// hide each other, as well as paths within the shared volume mount point itself.
+func validateSharedPaths(paths []string) error {
+	for i, p := range paths {
+		if p == SharedVolumeMountPoint || strings.HasPrefix(p, SharedVolumeMountPoint+"/") {
+			return fmt.Errorf("path '%s' is within the shared volume mount point %s", p, SharedVolumeMountPoint)
+		}
+		for _, other := range paths[i+1:] {
+			if p == other {
+				return fmt.Errorf("path '%s' is given more than once", p)
+			}
+			if strings.HasPrefix(other, p+"/") || strings.HasPrefix(p, other+"/") {
+				return fmt.Errorf("paths '%s' and '%s' are nested", p, other)
+			}
+		}
+	}
+	return nil
+}
+
+// sanitizeTagValue makes a value from the environment usable as a tag value: control characters are dropped, and the
+// value is truncated to the maximum length (in bytes) allowed by AWS, without splitting a character.
+func sanitizeTagValue(value string) string {
+	value = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value))
+	for len(value) > maxTagValueLength {
+		_, size := utf8.DecodeLastRuneInString(value)
+		value = value[:len(value)-size]
+	}
+	return value
+}
+
+// parseTags parses newline-separated key=value pairs.
+func parseTags(input string) ([]Tag, error) {
+	tags := []Tag{}
+	for _, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if !found || key == "" {
+			return nil, fmt.Errorf("'%s' must be in the form key=value", line)
+		}
+		tags = append(tags, Tag{Key: key, Value: value})
+	}
+	return tags, nil
+}
+
+// parseRestoreFilters parses newline-separated tag:key=value filters. Values may contain the * and ? wildcards
+// supported by EC2 filters.
+func parseRestoreFilters(input string) ([]Tag, error) {
+	filters := []Tag{}
+	for _, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, found := strings.CutPrefix(line, "tag:")
+		if !found {
+			return nil, fmt.Errorf("'%s' must be in the form tag:key=value", line)
+		}
+		tags, err := parseTags(key)
+		if err != nil || len(tags) != 1 || tags[0].Value == "" {
+			return nil, fmt.Errorf("'%s' must be in the form tag:key=value", line)
+		}
+		if err := tags[0].Validate(); err != nil {
+			return nil, err
+		}
+		filters = append(filters, tags[0])
+	}
+	return filters, nil
+}
+
+// mergeTags returns base with overrides applied: tags with the same key are replaced, others are appended.
+func mergeTags(base []Tag, overrides []Tag) []Tag {
+	merged := append([]Tag{}, base...)
+	for _, override := range overrides {
+		replaced := false
+		for i, tag := range merged {
+			if tag.Key == override.Key {
+				merged[i].Value = override.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, override)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,402 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestSanitizeTagValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "plain", value: "Build and test", want: "Build and test"},
+		{name: "control characters", value: "Build\n\tand\rtest\x00", want: "Buildandtest"},
+		{name: "surrounding spaces", value: "  build  ", want: "build"},
+		{name: "truncated", value: strings.Repeat("a", 300), want: strings.Repeat("a", maxTagValueLength)},
+		{name: "truncated without splitting a character", value: strings.Repeat("a", 255) + "é", want: strings.Repeat("a", 255)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeTagValue(tt.value)
+			if got != tt.want {
+				t.Errorf("sanitizeTagValue(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("sanitizeTagValue(%q) = %q, which is not valid UTF-8", tt.value, got)
+			}
+		})
+	}
+}
+
+func TestParseRestoreFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []Tag
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: []Tag{}},
+		{name: "single", input: "tag:team=infra", want: []Tag{{Key: "team", Value: "infra"}}},
+		{name: "several with blank lines", input: "tag:team=infra\n\n  tag:env=ci*  \n", want: []Tag{{Key: "team", Value: "infra"}, {Key: "env", Value: "ci*"}}},
+		{name: "missing prefix", input: "team=infra", wantErr: true},
+		{name: "missing value", input: "tag:team=", wantErr: true},
+		{name: "missing tag", input: "tag:", wantErr: true},
+		{name: "blank tag", input: "tag:   ", wantErr: true},
+		{name: "missing key", input: "tag:=infra", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRestoreFilters(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRestoreFilters(%q) error = %v, wantErr %t", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Errorf("parseRestoreFilters(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateGp3Performance(t *testing.T) {
+	tests := []struct {
+		name       string
+		iops       int32
+		throughput int32
+		sizeGiB    int32
+		wantErr    bool
+	}{
+		{name: "baseline", iops: 3000, throughput: 125, sizeGiB: 40},
+		{name: "max throughput for baseline IOPS", iops: 3000, throughput: 750, sizeGiB: 40},
+		{name: "throughput too high for IOPS", iops: 3000, throughput: 751, sizeGiB: 40, wantErr: true},
+		{name: "IOPS below minimum", iops: 2999, throughput: 125, sizeGiB: 40, wantErr: true},
+		{name: "IOPS above maximum", iops: 80001, throughput: 125, sizeGiB: 1000, wantErr: true},
+		{name: "IOPS too high for size", iops: 16000, throughput: 125, sizeGiB: 31, wantErr: true},
+		{name: "IOPS at the per-GiB limit", iops: 16000, throughput: 125, sizeGiB: 32},
+		{name: "throughput below minimum", iops: 3000, throughput: 124, sizeGiB: 40, wantErr: true},
+		{name: "throughput above maximum", iops: 80000, throughput: 2001, sizeGiB: 1000, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateGp3Performance(tt.iops, tt.throughput, tt.sizeGiB)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateGp3Performance(%d, %d, %d) error = %v, wantErr %t", tt.iops, tt.throughput, tt.sizeGiB, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSizeGiB(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int32
+		wantErr bool
+	}{
+		{value: "40", want: 40},
+		{value: " 40 ", want: 40},
+		{value: "100GB", want: 100},
+		{value: "100 GiB", want: 100},
+		{value: "500Gi", want: 500},
+		{value: "1TB", want: 1024},
+		{value: "2t", want: 2048},
+		{value: "1.5TB", want: 1536},
+		{value: "1.5", wantErr: true},
+		{value: "1.1TiB", wantErr: true},
+		{value: "10MB", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "", wantErr: true},
+		{value: "GiB", wantErr: true},
+		{value: "2147483647", want: 2147483647},
+		{value: "2147483648", wantErr: true},
+		{value: "99999999999999999999TB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSizeGiB(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSizeGiB(%q) error = %v, wantErr %t", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSizeGiB(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumeType types.VolumeType
+		sizeGiB    int32
+		wantErr    bool
+	}{
+		{name: "gp3 minimum", volumeType: types.VolumeTypeGp3, sizeGiB: 1},
+		{name: "gp3 below minimum", volumeType: types.VolumeTypeGp3, sizeGiB: 0, wantErr: true},
+		{name: "io2 minimum", volumeType: types.VolumeTypeIo2, sizeGiB: 4},
+		{name: "io2 below minimum", volumeType: types.VolumeTypeIo2, sizeGiB: 3, wantErr: true},
+		{name: "st1 minimum", volumeType: types.VolumeTypeSt1, sizeGiB: 125},
+		{name: "st1 below minimum", volumeType: types.VolumeTypeSt1, sizeGiB: 124, wantErr: true},
+		{name: "sc1 minimum", volumeType: types.VolumeTypeSc1, sizeGiB: 125},
+		{name: "sc1 below minimum", volumeType: types.VolumeTypeSc1, sizeGiB: 40, wantErr: true},
+		{name: "gp3 maximum", volumeType: types.VolumeTypeGp3, sizeGiB: 65536},
+		{name: "gp3 above maximum", volumeType: types.VolumeTypeGp3, sizeGiB: 65537, wantErr: true},
+		{name: "gp2 maximum", volumeType: types.VolumeTypeGp2, sizeGiB: 16384},
+		{name: "gp2 above maximum", volumeType: types.VolumeTypeGp2, sizeGiB: 16385, wantErr: true},
+		{name: "st1 above maximum", volumeType: types.VolumeTypeSt1, sizeGiB: 16385, wantErr: true},
+		{name: "standard maximum", volumeType: types.VolumeTypeStandard, sizeGiB: 1024},
+		{name: "standard above maximum", volumeType: types.VolumeTypeStandard, sizeGiB: 1025, wantErr: true},
+		{name: "unknown type", volumeType: "gp9", sizeGiB: 40, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateVolumeSize(tt.volumeType, tt.sizeGiB); (err != nil) != tt.wantErr {
+				t.Errorf("validateVolumeSize(%s, %d) error = %v, wantErr %t", tt.volumeType, tt.sizeGiB, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPullRequestBranches(t *testing.T) {
+	event := func(headRepository string, headRef string, baseRef string) string {
+		return `{"pull_request": {"head": {"ref": "` + headRef + `", "repo": {"full_name": "` + headRepository + `"}}, "base": {"ref": "` + baseRef + `"}}}`
+	}
+	tests := []struct {
+		name      string
+		eventName string
+		payload   string
+		noFile    bool
+		want      []string
+		wantErr   bool
+	}{
+		{name: "pull request", eventName: "pull_request", payload: event("owner/repo", "feature", "main"), want: []string{"feature", "main"}},
+		{name: "pull request target", eventName: "pull_request_target", payload: event("owner/repo", "feature", "develop"), want: []string{"feature", "develop"}},
+		{name: "repository name case", eventName: "pull_request", payload: event("Owner/Repo", "feature", "main"), want: []string{"feature", "main"}},
+		{name: "fork", eventName: "pull_request", payload: event("someone/repo", "main", "main"), want: []string{"main"}},
+		{name: "same head and base", eventName: "pull_request", payload: event("owner/repo", "main", "main"), want: []string{"main"}},
+		{name: "push", eventName: "push", payload: `{"ref": "refs/heads/main"}`},
+		{name: "no event path", eventName: "pull_request", noFile: true},
+		{name: "missing file", eventName: "pull_request", wantErr: true},
+		{name: "invalid payload", eventName: "pull_request", payload: "{", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventPath := ""
+			if !tt.noFile {
+				eventPath = filepath.Join(t.TempDir(), "event.json")
+			}
+			if tt.payload != "" {
+				if err := os.WriteFile(eventPath, []byte(tt.payload), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := pullRequestBranches(tt.eventName, eventPath, "owner/repo")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pullRequestBranches() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pullRequestBranches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRawDeviceMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		inputs  map[string]string
+		want    bool
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "raw_device", inputs: map[string]string{"raw_device": "true"}, want: true},
+		{name: "skip_mount", inputs: map[string]string{"skip_mount": "true"}, want: true},
+		{name: "skip_mount and skip_unmount", inputs: map[string]string{"skip_mount": "true", "skip_unmount": "true"}, want: true},
+		{name: "raw_device and skip_unmount", inputs: map[string]string{"raw_device": "true", "skip_unmount": "true"}, want: true},
+		{name: "skip_unmount alone", inputs: map[string]string{"skip_unmount": "true"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rawDeviceMode(newInputs(newTestAction(tt.inputs)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rawDeviceMode() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("rawDeviceMode() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDeviceName(t *testing.T) {
+	tests := []struct {
+		deviceName string
+		wantErr    bool
+	}{
+		{deviceName: ""},
+		{deviceName: "/dev/sdf"},
+		{deviceName: "/dev/sdp"},
+		{deviceName: "/dev/xvdf"},
+		{deviceName: "/dev/xvdba"},
+		{deviceName: "/dev/sde", wantErr: true},
+		{deviceName: "/dev/sdq", wantErr: true},
+		{deviceName: "/dev/nvme1n1", wantErr: true},
+		{deviceName: "sdf", wantErr: true},
+		{deviceName: "/dev/sdf; reboot", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.deviceName, func(t *testing.T) {
+			if err := validateDeviceName(tt.deviceName); (err != nil) != tt.wantErr {
+				t.Errorf("validateDeviceName(%q) error = %v, wantErr %t", tt.deviceName, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []Tag
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: []Tag{}},
+		{name: "single", input: "team=infra", want: []Tag{{Key: "team", Value: "infra"}}},
+		{name: "spaces and blank lines", input: " team = infra \n\ncost-center=42\n", want: []Tag{{Key: "team", Value: "infra"}, {Key: "cost-center", Value: "42"}}},
+		{name: "empty value", input: "team=", want: []Tag{{Key: "team", Value: ""}}},
+		{name: "value with equal sign", input: "query=a=b", want: []Tag{{Key: "query", Value: "a=b"}}},
+		{name: "missing equal sign", input: "team", wantErr: true},
+		{name: "missing key", input: "=infra", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTags(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTags(%q) error = %v, wantErr %t", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Errorf("parseTags(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     Tag
+		wantErr bool
+	}{
+		{name: "valid", tag: Tag{Key: "team", Value: "infra"}},
+		{name: "reserved prefix", tag: Tag{Key: "aws:team", Value: "infra"}, wantErr: true},
+		{name: "reserved prefix in uppercase", tag: Tag{Key: "AWS:team", Value: "infra"}, wantErr: true},
+		{name: "key too long", tag: Tag{Key: strings.Repeat("k", maxTagKeyLength+1)}, wantErr: true},
+		{name: "value too long", tag: Tag{Key: "team", Value: strings.Repeat("v", maxTagValueLength+1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.tag.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      []Tag
+		overrides []Tag
+		want      []Tag
+	}{
+		{name: "no overrides", base: []Tag{{Key: "a", Value: "1"}}, want: []Tag{{Key: "a", Value: "1"}}},
+		{name: "no base", overrides: []Tag{{Key: "a", Value: "1"}}, want: []Tag{{Key: "a", Value: "1"}}},
+		{
+			name:      "override replaces in place, new tags are appended",
+			base:      []Tag{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}},
+			overrides: []Tag{{Key: "c", Value: "3"}, {Key: "a", Value: "10"}},
+			want:      []Tag{{Key: "a", Value: "10"}, {Key: "b", Value: "2"}, {Key: "c", Value: "3"}},
+		},
+		{
+			name:      "last override wins",
+			base:      []Tag{{Key: "a", Value: "1"}},
+			overrides: []Tag{{Key: "a", Value: "2"}, {Key: "a", Value: "3"}},
+			want:      []Tag{{Key: "a", Value: "3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := slices.Clone(tt.base)
+			if got := mergeTags(tt.base, tt.overrides); !slices.Equal(got, tt.want) {
+				t.Errorf("mergeTags() = %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(tt.base, base) {
+				t.Errorf("mergeTags() modified its base to %v", tt.base)
+			}
+		})
+	}
+}
+
+func TestValidatePathIsSafe(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: "/", wantErr: true},
+		{path: "/etc", wantErr: true},
+		{path: "/etc/", wantErr: true},
+		{path: "/etc/docker", wantErr: true},
+		{path: "/usr/..", wantErr: true},
+		{path: "/usr/local/lib", wantErr: true},
+		{path: "/var/lib/", wantErr: true},
+		{path: "/tmp", wantErr: true},
+		{path: "/home/runner/../..", wantErr: true},
+		{path: "/var/lib/docker"},
+		{path: "/var/lib/docker/"},
+		{path: "/home/runner/.cache"},
+		{path: "/tmp/cache"},
+		{path: "/etcetera"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if err := validatePathIsSafe(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("validatePathIsSafe(%q) error = %v, wantErr %t", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePathIsNotWorkspace(t *testing.T) {
+	workspace := "/home/runner/work/repo/repo"
+	tests := []struct {
+		name      string
+		path      string
+		workspace string
+		wantErr   bool
+	}{
+		{name: "workspace", path: workspace, workspace: workspace, wantErr: true},
+		{name: "workspace with trailing slash", path: workspace + "/", workspace: workspace, wantErr: true},
+		{name: "workspace with trailing slash in GITHUB_WORKSPACE", path: workspace, workspace: workspace + "/", wantErr: true},
+		{name: "parent of the workspace", path: "/home/runner/work", workspace: workspace, wantErr: true},
+		{name: "parent of the workspace with dot-dot", path: workspace + "/..", workspace: workspace, wantErr: true},
+		{name: "root", path: "/", workspace: workspace, wantErr: true},
+		{name: "under the workspace", path: workspace + "/node_modules", workspace: workspace},
+		{name: "sibling with a common prefix", path: workspace + "-cache", workspace: workspace},
+		{name: "outside the workspace", path: "/var/lib/docker", workspace: workspace},
+		{name: "no workspace", path: "/home/runner/work", workspace: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePathIsNotWorkspace(tt.path, tt.workspace); (err != nil) != tt.wantErr {
+				t.Errorf("validatePathIsNotWorkspace(%q, %q) error = %v, wantErr %t", tt.path, tt.workspace, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sethvargo/go-githubactions"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultInputs holds the default value of inputs. Defaults are not declared in action.yml, since GitHub would then
+// always pass them as inputs, and they would take precedence over the values from the 'config_file'. The only exception
+// is 'github_token', whose default is an expression that can only be evaluated by GitHub.
+var defaultInputs = map[string]string{
+	"allow_unsafe_path":               "false",
+	"allow_workspace_mount":           "false",
+	"shared_volume":                   "false",
+	"overlay":                         "false",
+	"raw_device":                      "false",
+	"skip_mount":                      "false",
+	"skip_unmount":                    "false",
+	"mode":                            ModeSnapshot,
+	"version":                         "v1",
+	"tag_prefix":                      DefaultTagPrefix,
+	"snapshot_owner_ids":              "self",
+	"max_snapshot_age_hours":          "0",
+	"disable_default_branch_fallback": "false",
+	"branch_agnostic":                 "false",
+	"grow_to_snapshot":                "true",
+	"prefer_warm_snapshots":           "false",
+	"volume_type":                     "gp3",
+	"volume_iops":                     "3000",
+	"volume_throughput":               "750",
+	"volume_size":                     "40",
+	"volume_initialization_rate":      "0",
+	"wait_for_completion":             "false",
+	"wait_for_initial_snapshot":       "true",
+	"heartbeat_interval_seconds":      "30",
+	"incomplete_snapshot_policy":      IncompleteSnapshotPolicyTag,
+	"save":                            "true",
+	"keep_volume_on_failure":          "false",
+	"keep_volume":                     "false",
+	"delete_source_volume":            "true",
+	"reuse_volumes":                   "false",
+	"force_detach":                    "false",
+	"drop_caches":                     "false",
+	"snapshot_lock":                   "false",
+	"replace_previous":                "false",
+	"fast_snapshot_restore":           "false",
+	"storage_tier":                    StorageTierStandard,
+	"archive_restore_timeout_minutes": "0",
+	"skip_unchanged":                  "false",
+	"log_level":                       "info",
+	"log_format":                      LogFormatJSON,
+	"result_file":                     defaultResultFile,
+	"fail_on_cache_miss":              "false",
+	"continue_on_error":               "false",
+	"check_permissions":               "true",
+	"mount_options":                   "noatime",
+	"filesystem":                      FilesystemExt4,
+	"reformat_on_mismatch":            "false",
+	"force_format_on_mount_failure":   "false",
+	"btrfs_compression":               "zstd",
+	"runtime":                         RuntimeDocker,
+	"runtime_ready_timeout_seconds":   "60",
+	"manage_runtime":                  "true",
+	"fallback_s3_prefix":              "runs-on-snapshot",
+	"read_only":                       "false",
+	"strict_arch":                     "false",
+	"multi_attach":                    "false",
+}
+
+// envInputPrefix prefixes the environment variables overriding inputs, e.g. RUNS_ON_SNAPSHOT_VOLUME_SIZE for
+// 'volume_size', so that the binary can be used outside of the GitHub Actions input mechanism.
+const envInputPrefix = "RUNS_ON_SNAPSHOT_"
+
+// envInput returns the value of the environment variable overriding the input, if any.
+func envInput(name string) string {
+	return os.Getenv(envInputPrefix + strings.ToUpper(name))
+}
+
+// inputs resolves input values by precedence: action input, then RUNS_ON_SNAPSHOT_* environment variable, then
+// 'config_file', then default.
+type inputs struct {
+	action *githubactions.Action
+	file   map[string]string
+	read   map[string]bool
+}
+
+func newInputs(action *githubactions.Action) *inputs {
+	in := &inputs{action: action, read: map[string]bool{}}
+
+	configFile := strings.TrimSpace(action.GetInput("config_file"))
+	if configFile == "" {
+		configFile = strings.TrimSpace(envInput("config_file"))
+	}
+	if configFile == "" {
+		return in
+	}
+	if !filepath.IsAbs(configFile) {
+		configFile = filepath.Join(os.Getenv("GITHUB_WORKSPACE"), configFile)
+	}
+	file, err := loadConfigFile(configFile)
+	if err != nil {
+		action.Fatalf("Invalid 'config_file' %s: %v", configFile, err)
+	}
+	action.Infof("Loaded %d input(s) from config file %s", len(file), configFile)
+	in.file = file
+	return in
+}
+
+// get returns the value of the input, falling back to the environment variable, the config file and then to the
+// default value.
+func (in *inputs) get(name string) string {
+	in.read[name] = true
+	if value := in.action.GetInput(name); value != "" {
+		return value
+	}
+	if value := envInput(name); value != "" {
+		return value
+	}
+	if value, ok := in.file[name]; ok {
+		return value
+	}
+	return defaultInputs[name]
+}
+
+// validateFileKeys fails on keys of the config file that do not match any input, to catch typos.
+func (in *inputs) validateFileKeys() {
+	if unknown := in.unknownFileKeys(); len(unknown) > 0 {
+		in.action.Fatalf("Unknown key(s) in 'config_file': %s", strings.Join(unknown, ", "))
+	}
+}
+
+// unknownFileKeys returns the sorted keys of the config file that were never read, i.e. that do not match any input.
+func (in *inputs) unknownFileKeys() []string {
+	var unknown []string
+	for key := range in.file {
+		if !in.read[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// loadConfigFile parses a YAML (or JSON) file mapping input names to values. Lists are joined with newlines, and
+// maps are converted to newline-separated key=value pairs (e.g. for 'tags').
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse: %w", err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if key == "config_file" {
+			return nil, fmt.Errorf("'config_file' cannot be set from the config file itself")
+		}
+		switch v := value.(type) {
+		case nil:
+			values[key] = ""
+		case []any:
+			lines := make([]string, 0, len(v))
+			for _, item := range v {
+				lines = append(lines, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(lines, "\n")
+		case map[string]any:
+			lines := make([]string, 0, len(v))
+			for k, item := range v {
+				lines = append(lines, fmt.Sprintf("%s=%v", k, item))
+			}
+			slices.Sort(lines)
+			values[key] = strings.Join(lines, "\n")
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
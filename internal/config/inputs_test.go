@@ -0,0 +1,128 @@
+package config
+
+import (
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sethvargo/go-githubactions"
+)
+
+// newTestAction returns an action whose inputs are the given values, as set by the runner in INPUT_* variables.
+func newTestAction(actionInputs map[string]string) *githubactions.Action {
+	env := map[string]string{}
+	for name, value := range actionInputs {
+		env["INPUT_"+strings.ToUpper(name)] = value
+	}
+	return githubactions.New(
+		githubactions.WithWriter(io.Discard),
+		githubactions.WithGetenv(func(key string) string { return env[key] }),
+	)
+}
+
+// writeConfigFile writes content to a config file in a temporary directory, and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "snapshot.yml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "scalars",
+			content: "volume_size: 100\nsave: false\nvolume_name: cache\n",
+			want:    map[string]string{"volume_size": "100", "save": "false", "volume_name": "cache"},
+		},
+		{
+			name:    "list",
+			content: "path:\n  - /var/lib/docker\n  - /home/runner/.cache\n",
+			want:    map[string]string{"path": "/var/lib/docker\n/home/runner/.cache"},
+		},
+		{
+			name:    "map",
+			content: "tags:\n  team: infra\n  env: ci\n",
+			want:    map[string]string{"tags": "env=ci\nteam=infra"},
+		},
+		{name: "null", content: "volume_name:\n", want: map[string]string{"volume_name": ""}},
+		{name: "config_file itself", content: "config_file: other.yml\n", wantErr: true},
+		{name: "invalid YAML", content: "volume_size: [100\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadConfigFile(writeConfigFile(t, tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfigFile() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Errorf("loadConfigFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := loadConfigFile(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Errorf("loadConfigFile() of a missing file error = nil, want an error")
+	}
+}
+
+func TestInputsPrecedence(t *testing.T) {
+	tests := []struct {
+		name         string
+		actionInputs map[string]string
+		env          string
+		fileContent  string
+		envFile      bool
+		want         string
+	}{
+		{name: "default", want: defaultInputs["volume_size"]},
+		{name: "config file wins over the default", fileContent: "volume_size: 100\n", want: "100"},
+		{name: "config file from the environment", fileContent: "volume_size: 100\n", envFile: true, want: "100"},
+		{name: "environment wins over the default", env: "150", want: "150"},
+		{name: "environment wins over the config file", env: "150", fileContent: "volume_size: 100\n", want: "150"},
+		{name: "action input wins over the config file", actionInputs: map[string]string{"volume_size": "200"}, fileContent: "volume_size: 100\n", want: "200"},
+		{name: "action input wins over the environment", actionInputs: map[string]string{"volume_size": "200"}, env: "150", fileContent: "volume_size: 100\n", want: "200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Clear the variables possibly set by the environment running the tests
+			t.Setenv("RUNS_ON_SNAPSHOT_VOLUME_SIZE", tt.env)
+			t.Setenv("RUNS_ON_SNAPSHOT_CONFIG_FILE", "")
+			actionInputs := maps.Clone(tt.actionInputs)
+			if actionInputs == nil {
+				actionInputs = map[string]string{}
+			}
+			if tt.fileContent != "" && tt.envFile {
+				t.Setenv("RUNS_ON_SNAPSHOT_CONFIG_FILE", writeConfigFile(t, tt.fileContent))
+			} else if tt.fileContent != "" {
+				actionInputs["config_file"] = writeConfigFile(t, tt.fileContent)
+			}
+			in := newInputs(newTestAction(actionInputs))
+			if got := in.get("volume_size"); got != tt.want {
+				t.Errorf("get(volume_size) = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInputsUnknownFileKeys(t *testing.T) {
+	configFile := writeConfigFile(t, "volume_size: 100\nvolume_szie: 200\nsave: false\n")
+	in := newInputs(newTestAction(map[string]string{"config_file": configFile}))
+	in.get("volume_size")
+	in.get("save")
+
+	if got, want := in.unknownFileKeys(), []string{"volume_szie"}; !slices.Equal(got, want) {
+		t.Errorf("unknownFileKeys() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,57 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeout bounds each request to the GitHub API.
+const Timeout = 10 * time.Second
+
+// DefaultAPIURL is used when GITHUB_API_URL is not set.
+const DefaultAPIURL = "https://api.github.com"
+
+// DefaultBranch returns the default branch of the repository (owner/name), from the GitHub API at apiURL. The token
+// is optional for public repositories.
+func DefaultBranch(ctx context.Context, apiURL string, token string, repository string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	url := fmt.Sprintf("%s/repos/%s", strings.TrimSuffix(apiURL, "/"), repository)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create GitHub API request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "runs-on-snapshot")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query the GitHub API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub API returned status %s for %s", resp.Status, url)
+	}
+
+	var repo struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&repo); err != nil {
+		return "", fmt.Errorf("failed to parse GitHub API response: %w", err)
+	}
+	if repo.DefaultBranch == "" {
+		return "", fmt.Errorf("no default branch returned by the GitHub API for %s", repository)
+	}
+	return repo.DefaultBranch, nil
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/runs-on/snapshot/internal/result"
+)
+
+const bytesPerGiB = 1 << 30
+
+// metric describes a gauge exported for each path of the result.
+type metric struct {
+	name  string
+	help  string
+	value func(p *result.PathResult) (float64, bool)
+}
+
+var metrics = []metric{
+	{
+		name: "snapshot_cache_hit",
+		help: "Whether the volume was restored from an existing snapshot or volume (1) or not (0).",
+		value: func(p *result.PathResult) (float64, bool) {
+			if p.CacheHit {
+				return 1, true
+			}
+			return 0, true
+		},
+	},
+	{
+		name: "snapshot_restore_seconds",
+		help: "Duration of the restore, in seconds.",
+		value: func(p *result.PathResult) (float64, bool) {
+			return p.RestoreDurationSeconds, p.RestoreDurationSeconds > 0
+		},
+	},
+	{
+		name: "snapshot_create_seconds",
+		help: "Duration of the snapshot creation, in seconds.",
+		value: func(p *result.PathResult) (float64, bool) {
+			return p.SaveDurationSeconds, p.SaveDurationSeconds > 0
+		},
+	},
+	{
+		name: "snapshot_size_bytes",
+		help: "Size of the volume, in bytes.",
+		value: func(p *result.PathResult) (float64, bool) {
+			return float64(p.VolumeSizeGiB) * bytesPerGiB, p.VolumeSizeGiB > 0
+		},
+	},
+}
+
+// Format renders the result in the Prometheus text exposition format, with one sample per path and metric.
+// Metrics without a value yet (e.g. the snapshot duration during the main phase) are omitted.
+func Format(res *result.Result) string {
+	paths := make([]string, 0, len(res.Paths))
+	for path := range res.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", m.name)
+		for _, path := range paths {
+			if value, ok := m.value(res.Paths[path]); ok {
+				fmt.Fprintf(&b, "%s{path=\"%s\"} %g\n", m.name, escapeLabelValue(path), value)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Write writes the metrics of the result to filePath.
+func Write(filePath string, res *result.Result) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for metrics file: %w", err)
+	}
+	if err := os.WriteFile(filePath, []byte(Format(res)), 0644); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	return nil
+}
+
+// escapeLabelValue escapes backslashes, double quotes and newlines, as required by the exposition format.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
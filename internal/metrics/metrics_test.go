@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/runs-on/snapshot/internal/result"
+)
+
+func TestFormat(t *testing.T) {
+	res := result.New()
+	*res.Path("/var/lib/docker") = result.PathResult{
+		CacheHit:               true,
+		VolumeSizeGiB:          40,
+		RestoreDurationSeconds: 12.5,
+		SaveDurationSeconds:    3,
+	}
+	// Restored without a cache hit, and not snapshotted yet
+	*res.Path("/cache") = result.PathResult{
+		VolumeSizeGiB:          1,
+		RestoreDurationSeconds: 4,
+	}
+	res.Path("/odd \"path\"\\\n")
+
+	want := `# HELP snapshot_cache_hit Whether the volume was restored from an existing snapshot or volume (1) or not (0).
+# TYPE snapshot_cache_hit gauge
+snapshot_cache_hit{path="/cache"} 0
+snapshot_cache_hit{path="/odd \"path\"\\\n"} 0
+snapshot_cache_hit{path="/var/lib/docker"} 1
+# HELP snapshot_restore_seconds Duration of the restore, in seconds.
+# TYPE snapshot_restore_seconds gauge
+snapshot_restore_seconds{path="/cache"} 4
+snapshot_restore_seconds{path="/var/lib/docker"} 12.5
+# HELP snapshot_create_seconds Duration of the snapshot creation, in seconds.
+# TYPE snapshot_create_seconds gauge
+snapshot_create_seconds{path="/var/lib/docker"} 3
+# HELP snapshot_size_bytes Size of the volume, in bytes.
+# TYPE snapshot_size_bytes gauge
+snapshot_size_bytes{path="/cache"} 1.073741824e+09
+snapshot_size_bytes{path="/var/lib/docker"} 4.294967296e+10
+`
+	if got := Format(res); got != want {
+		t.Errorf("Format() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatEmpty(t *testing.T) {
+	want := `# HELP snapshot_cache_hit Whether the volume was restored from an existing snapshot or volume (1) or not (0).
+# TYPE snapshot_cache_hit gauge
+# HELP snapshot_restore_seconds Duration of the restore, in seconds.
+# TYPE snapshot_restore_seconds gauge
+# HELP snapshot_create_seconds Duration of the snapshot creation, in seconds.
+# TYPE snapshot_create_seconds gauge
+# HELP snapshot_size_bytes Size of the volume, in bytes.
+# TYPE snapshot_size_bytes gauge
+`
+	if got := Format(result.New()); got != want {
+		t.Errorf("Format() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "nested", "snapshot.prom")
+	res := result.New()
+	res.Path("/cache").CacheHit = true
+	if err := Write(filePath, res); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != Format(res) {
+		t.Errorf("metrics file = %q, want %q", data, Format(res))
+	}
+}
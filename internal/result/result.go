@@ -0,0 +1,107 @@
+package result
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SchemaVersion is bumped whenever the structure of the result file changes in a backward-incompatible way.
+const SchemaVersion = 1
+
+// Result is the machine-readable summary of the action, shared between the main and post phases.
+type Result struct {
+	SchemaVersion int                    `json:"schema_version"`
+	Paths         map[string]*PathResult `json:"paths"`
+}
+
+// PathResult holds the outcome of the restore and save phases for a single path.
+type PathResult struct {
+	VolumeID               string  `json:"volume_id,omitempty"`
+	SourceSnapshotID       string  `json:"source_snapshot_id,omitempty"`
+	SnapshotID             string  `json:"snapshot_id,omitempty"`
+	CacheHit               bool    `json:"cache_hit"`
+	VolumeSizeGiB          int32   `json:"volume_size_gib,omitempty"`
+	RestoreDurationSeconds float64 `json:"restore_duration_seconds,omitempty"`
+	SaveDurationSeconds    float64 `json:"save_duration_seconds,omitempty"`
+	RestoreError           string  `json:"restore_error,omitempty"`
+	SaveError              string  `json:"save_error,omitempty"`
+}
+
+// New returns an empty result.
+func New() *Result {
+	return &Result{SchemaVersion: SchemaVersion, Paths: map[string]*PathResult{}}
+}
+
+// Load reads the result file at filePath, returning an empty result if it doesn't exist yet.
+func Load(filePath string) (*Result, error) {
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result file: %w", err)
+	}
+
+	result := New()
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result file: %w", err)
+	}
+	if result.Paths == nil {
+		result.Paths = map[string]*PathResult{}
+	}
+	return result, nil
+}
+
+// Path returns the result for the given path, creating it if needed.
+func (r *Result) Path(path string) *PathResult {
+	if _, ok := r.Paths[path]; !ok {
+		r.Paths[path] = &PathResult{}
+	}
+	return r.Paths[path]
+}
+
+// AttachedVolumeIDs returns the sorted IDs of the volumes attached for all paths.
+func (r *Result) AttachedVolumeIDs() []string {
+	return r.collect(func(pathResult *PathResult) string { return pathResult.VolumeID })
+}
+
+// CreatedSnapshotIDs returns the sorted IDs of the snapshots created for all paths.
+func (r *Result) CreatedSnapshotIDs() []string {
+	return r.collect(func(pathResult *PathResult) string { return pathResult.SnapshotID })
+}
+
+// collect returns the sorted, distinct and non-empty values of a field of the path results.
+func (r *Result) collect(field func(pathResult *PathResult) string) []string {
+	seen := map[string]bool{}
+	values := []string{}
+	for _, pathResult := range r.Paths {
+		if value := field(pathResult); value != "" && !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// Save writes the result to filePath.
+func (r *Result) Save(filePath string) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for result file: %w", err)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write result file: %w", err)
+	}
+
+	return nil
+}
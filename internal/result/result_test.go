@@ -0,0 +1,73 @@
+package result
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "nested", "result.json")
+	result := New()
+	*result.Path("/var/lib/docker") = PathResult{
+		VolumeID:               "vol-1",
+		SourceSnapshotID:       "snap-1",
+		SnapshotID:             "snap-2",
+		CacheHit:               true,
+		VolumeSizeGiB:          40,
+		RestoreDurationSeconds: 12.5,
+		SaveDurationSeconds:    3,
+	}
+	result.Path("/cache").RestoreError = "failed to attach volume"
+
+	if err := result.Save(filePath); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	loaded, err := Load(filePath)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded, result) {
+		t.Errorf("Load() = %+v, want %+v", loaded, result)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	loaded, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded, New()) {
+		t.Errorf("Load() = %+v, want an empty result", loaded)
+	}
+}
+
+func TestLoadInvalidFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "result.json")
+	if err := os.WriteFile(filePath, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filePath); err == nil {
+		t.Errorf("Load() error = nil, want an error for an invalid file")
+	}
+}
+
+func TestAttachedVolumeIDs(t *testing.T) {
+	result := New()
+	result.Path("/a").VolumeID = "vol-2"
+	result.Path("/b").VolumeID = "vol-1"
+	result.Path("/c").VolumeID = "vol-2"
+	result.Path("/d").SnapshotID = "snap-1"
+
+	if got, want := result.AttachedVolumeIDs(), []string{"vol-1", "vol-2"}; !slices.Equal(got, want) {
+		t.Errorf("AttachedVolumeIDs() = %v, want %v", got, want)
+	}
+	if got, want := result.CreatedSnapshotIDs(), []string{"snap-1"}; !slices.Equal(got, want) {
+		t.Errorf("CreatedSnapshotIDs() = %v, want %v", got, want)
+	}
+	if got := New().AttachedVolumeIDs(); got == nil || len(got) != 0 {
+		t.Errorf("AttachedVolumeIDs() of an empty result = %#v, want an empty slice", got)
+	}
+}
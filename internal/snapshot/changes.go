@@ -0,0 +1,44 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrSnapshotUnchanged is returned by CreateSnapshot when 'skip_unchanged' is set and nothing was written to the volume
+// since it was restored, in which case the snapshot it was restored from is still up-to-date.
+var ErrSnapshotUnchanged = errors.New("nothing was written to the volume since it was restored")
+
+// writeSignature returns a cheap signature of the writes to the device: the number of sectors written since the
+// volume was attached, from the block device statistics. This is independent from the filesystem, and does not need
+// to walk the files. It returns an empty string if the statistics are not available.
+func (s *AWSSnapshotter) writeSignature(ctx context.Context, device string) string {
+	// Device names such as /dev/sdf may be symlinks to the actual NVMe device
+	output, err := s.runCommand(ctx, "bash", "-c", `cat "/sys/class/block/$(basename "$(readlink -f "$1")")/stat"`, "bash", device)
+	if err != nil {
+		return ""
+	}
+	// See https://www.kernel.org/doc/Documentation/block/stat.txt, the 7th field is the number of sectors written
+	fields := strings.Fields(string(output))
+	if len(fields) < 7 {
+		return ""
+	}
+	return fields[6]
+}
+
+// volumeUnchanged returns whether nothing was written to the volume since the signature recorded at restore time.
+// New volumes are always considered changed, since they have no snapshot yet.
+func (s *AWSSnapshotter) volumeUnchanged(ctx context.Context, volumeInfo *VolumeInfo) bool {
+	if volumeInfo.NewVolume || volumeInfo.WriteSignature == "" {
+		return false
+	}
+	// Flush pending writes first, so that they are accounted for
+	if _, err := s.runCommand(ctx, "sudo", "sync"); err != nil {
+		s.logger.Warn().Msgf("Warning: failed to sync filesystems: %v", err)
+		return false
+	}
+	signature := s.writeSignature(ctx, volumeInfo.DeviceName)
+	s.logger.Info().Msgf("CreateSnapshot: Sectors written to %s: %s at restore, %s now", volumeInfo.DeviceName, volumeInfo.WriteSignature, signature)
+	return signature == volumeInfo.WriteSignature
+}
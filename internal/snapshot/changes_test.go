@@ -0,0 +1,127 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+// statCommand is the prefix of the command reading the block device statistics.
+const statCommand = "bash -c cat"
+
+// blockStat returns the content of a block device stat file with the given number of sectors written.
+func blockStat(sectorsWritten string) string {
+	return "    1234        0    98765      456     2000        0  " + sectorsWritten + "      789        0      600     1245        0        0        0        0\n"
+}
+
+func TestWriteSignature(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		failing bool
+		want    string
+	}{
+		{name: "statistics", output: blockStat("16000"), want: "16000"},
+		{name: "truncated statistics", output: "1234 0 98765", want: ""},
+		{name: "no statistics", failing: true, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, recorder := newTestSnapshotter(t, testConfig())
+			recorder.outputs[statCommand] = tt.output
+			if tt.failing {
+				recorder.failures = []string{statCommand}
+			}
+			if got := s.writeSignature(context.Background(), "/dev/sdf"); got != tt.want {
+				t.Errorf("writeSignature() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVolumeUnchanged(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumeInfo VolumeInfo
+		signature  string
+		syncFails  bool
+		want       bool
+	}{
+		{name: "unchanged", volumeInfo: VolumeInfo{WriteSignature: "16000"}, signature: "16000", want: true},
+		{name: "changed", volumeInfo: VolumeInfo{WriteSignature: "16000"}, signature: "16008"},
+		{name: "new volume", volumeInfo: VolumeInfo{WriteSignature: "16000", NewVolume: true}, signature: "16000"},
+		{name: "no signature at restore", signature: "16000"},
+		{name: "no statistics", volumeInfo: VolumeInfo{WriteSignature: "16000"}},
+		{name: "sync fails", volumeInfo: VolumeInfo{WriteSignature: "16000"}, signature: "16000", syncFails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, recorder := newTestSnapshotter(t, testConfig())
+			if tt.signature != "" {
+				recorder.outputs[statCommand] = blockStat(tt.signature)
+			}
+			if tt.syncFails {
+				recorder.failures = []string{"sudo sync"}
+			}
+			tt.volumeInfo.DeviceName = "/dev/sdf"
+			if got := s.volumeUnchanged(context.Background(), &tt.volumeInfo); got != tt.want {
+				t.Errorf("volumeUnchanged() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotSkipUnchanged(t *testing.T) {
+	tests := []struct {
+		name        string
+		changed     bool
+		wantSkipped bool
+	}{
+		{name: "unchanged volume skipped", wantSkipped: true},
+		{name: "changed volume snapshotted", changed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.SkipUnchanged = true
+			cfg.Runtime = runsOnConfig.RuntimeDocker
+			cfg.DeleteSourceVolume = true
+			cfg.WaitForCompletion = true
+			s, ec2Client, recorder := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+			recorder.outputs[statCommand] = blockStat("16000")
+			if _, err := s.RestoreSnapshot(context.Background(), "/var/lib/docker"); err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if tt.changed {
+				recorder.outputs[statCommand] = blockStat("16008")
+			}
+
+			output, err := s.CreateSnapshot(context.Background(), "/var/lib/docker")
+			if tt.wantSkipped {
+				if !errors.Is(err, ErrSnapshotUnchanged) {
+					t.Fatalf("CreateSnapshot() error = %v, want %v", err, ErrSnapshotUnchanged)
+				}
+				if len(ec2Client.state.Snapshots) != 1 {
+					t.Errorf("%d snapshots, want only the restored one", len(ec2Client.state.Snapshots))
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("CreateSnapshot() error = %v", err)
+				}
+				if _, exists := ec2Client.state.Snapshots[output.SnapshotID]; !exists {
+					t.Errorf("snapshot %s was not created", output.SnapshotID)
+				}
+			}
+			if pruned := recorder.ran("sudo docker builder prune"); pruned == tt.wantSkipped {
+				t.Errorf("docker pruned = %t, want %t", pruned, !tt.wantSkipped)
+			}
+			if len(ec2Client.state.Volumes) != 0 {
+				t.Errorf("%d volumes left, want the volume deleted", len(ec2Client.state.Volumes))
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// SnapshotList describes all the snapshots of the repository, as reported by the --list-snapshots and
+// --clean-snapshots flags.
+type SnapshotList struct {
+	Repository   string           `json:"repository"`
+	Snapshots    []SnapshotStatus `json:"snapshots"`
+	TotalSizeGiB int64            `json:"total_size_gib"`
+	// Expired holds the snapshots exceeding the budget of --clean-snapshots, which are deleted unless DryRun is set
+	Expired []SnapshotStatus `json:"expired,omitempty"`
+	DryRun  bool             `json:"dry_run,omitempty"`
+}
+
+// CleanOptions is the budget of --clean-snapshots. Zero values mean no limit.
+type CleanOptions struct {
+	// MaxAge is the age above which snapshots are deleted
+	MaxAge time.Duration
+	// MaxCount is the number of most recent snapshots kept for the whole repository
+	MaxCount int
+	DryRun   bool
+}
+
+// ListSnapshots lists the snapshots created by the action for the repository, across all branches and versions,
+// from the most recent to the oldest. It does not modify anything.
+func (s *AWSSnapshotter) ListSnapshots(ctx context.Context) (*SnapshotList, error) {
+	snapshotsOutput, err := s.describeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		Filters: []types.Filter{
+			{Name: aws.String(fmt.Sprintf("tag:%s", s.tagKey(tagKeySuffixRepository))), Values: []string{s.config.GithubRepository}},
+		},
+		// Only snapshots of the account can be deleted
+		OwnerIds: []string{"self"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe snapshots for repository %s: %w", s.config.GithubRepository, err)
+	}
+	return buildSnapshotList(s.config.GithubRepository, s.config.TagPrefix, snapshotsOutput.Snapshots, time.Now()), nil
+}
+
+// CleanSnapshots deletes the snapshots of the repository exceeding the age or count budget, or only reports them
+// in dry-run mode. Deletion failures are logged, and reported as an error once all snapshots were processed.
+func (s *AWSSnapshotter) CleanSnapshots(ctx context.Context, options CleanOptions) (*SnapshotList, error) {
+	list, err := s.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list.Expired = expiredSnapshots(list.Snapshots, options)
+	list.DryRun = options.DryRun
+
+	failed := 0
+	for _, snapshot := range list.Expired {
+		if options.DryRun {
+			s.logger.Info().Msgf("CleanSnapshots: Would delete snapshot %s of branch %s (%s old, %d GiB)", snapshot.SnapshotID, snapshot.Branch, time.Duration(snapshot.AgeSeconds)*time.Second, snapshot.SizeGiB)
+			continue
+		}
+		s.logger.Info().Msgf("CleanSnapshots: Deleting snapshot %s of branch %s (%s old, %d GiB)...", snapshot.SnapshotID, snapshot.Branch, time.Duration(snapshot.AgeSeconds)*time.Second, snapshot.SizeGiB)
+		if _, err := s.ec2Client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshot.SnapshotID)}); err != nil {
+			s.logger.Warn().Msgf("Warning: Failed to delete snapshot %s: %v", snapshot.SnapshotID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return list, fmt.Errorf("failed to delete %d of %d snapshots", failed, len(list.Expired))
+	}
+	return list, nil
+}
+
+// buildSnapshotList sorts the snapshots from the most recent to the oldest, and sums their size.
+func buildSnapshotList(repository, tagPrefix string, snapshots []types.Snapshot, now time.Time) *SnapshotList {
+	list := &SnapshotList{Repository: repository, Snapshots: []SnapshotStatus{}}
+	for _, snapshot := range snapshots {
+		snapshotStatus := newSnapshotStatus(snapshot, tagPrefix, now)
+		list.Snapshots = append(list.Snapshots, snapshotStatus)
+		list.TotalSizeGiB += int64(snapshotStatus.SizeGiB)
+	}
+	sort.SliceStable(list.Snapshots, func(i, j int) bool {
+		return list.Snapshots[i].StartTime.After(list.Snapshots[j].StartTime)
+	})
+	return list
+}
+
+// expiredSnapshots returns the completed snapshots older than the maximum age, or beyond the maximum count of most
+// recent completed snapshots. Snapshots still in progress are never expired, since they may be waited for.
+func expiredSnapshots(snapshots []SnapshotStatus, options CleanOptions) []SnapshotStatus {
+	expired := []SnapshotStatus{}
+	kept := 0
+	for _, snapshot := range snapshots {
+		if snapshot.State != string(types.SnapshotStateCompleted) {
+			continue
+		}
+		tooOld := options.MaxAge > 0 && time.Duration(snapshot.AgeSeconds)*time.Second > options.MaxAge
+		tooMany := options.MaxCount > 0 && kept >= options.MaxCount
+		if tooOld || tooMany {
+			expired = append(expired, snapshot)
+			continue
+		}
+		kept++
+	}
+	return expired
+}
@@ -0,0 +1,113 @@
+package snapshot
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+// cleanTestSnapshot returns a snapshot of branch main started the given time before now.
+func cleanTestSnapshot(id string, now time.Time, age time.Duration, state types.SnapshotState, sizeGiB int32) types.Snapshot {
+	return types.Snapshot{
+		SnapshotId: aws.String(id),
+		State:      state,
+		StartTime:  aws.Time(now.Add(-age)),
+		VolumeSize: aws.Int32(sizeGiB),
+		Tags: []types.Tag{
+			{Key: aws.String(prefixedTagKey(runsOnConfig.DefaultTagPrefix, tagKeySuffixBranch)), Value: aws.String("main")},
+			{Key: aws.String(prefixedTagKey(runsOnConfig.DefaultTagPrefix, tagKeySuffixVersion)), Value: aws.String("v1")},
+		},
+	}
+}
+
+func TestBuildSnapshotList(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	snapshots := []types.Snapshot{
+		cleanTestSnapshot("snap-2h", now, 2*time.Hour, types.SnapshotStateCompleted, 40),
+		cleanTestSnapshot("snap-1h", now, time.Hour, types.SnapshotStatePending, 20),
+		cleanTestSnapshot("snap-3h", now, 3*time.Hour, types.SnapshotStateCompleted, 100),
+	}
+
+	list := buildSnapshotList("owner/repo", runsOnConfig.DefaultTagPrefix, snapshots, now)
+
+	if got, want := snapshotStatusIDs(list.Snapshots), []string{"snap-1h", "snap-2h", "snap-3h"}; !slices.Equal(got, want) {
+		t.Errorf("snapshots = %v, want %v from the most recent", got, want)
+	}
+	if list.TotalSizeGiB != 160 {
+		t.Errorf("TotalSizeGiB = %d, want 160", list.TotalSizeGiB)
+	}
+	first := list.Snapshots[0]
+	if first.AgeSeconds != 3600 || first.Branch != "main" || first.Version != "v1" || first.State != string(types.SnapshotStatePending) {
+		t.Errorf("snapshot status = %+v, want snap-1h of branch main and version v1, pending for an hour", first)
+	}
+	if empty := buildSnapshotList("owner/repo", runsOnConfig.DefaultTagPrefix, nil, now); empty.Snapshots == nil || len(empty.Snapshots) != 0 {
+		t.Errorf("snapshots of an empty list = %#v, want an empty slice", empty.Snapshots)
+	}
+}
+
+func TestExpiredSnapshots(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	snapshots := buildSnapshotList("owner/repo", runsOnConfig.DefaultTagPrefix, []types.Snapshot{
+		cleanTestSnapshot("snap-1h", now, time.Hour, types.SnapshotStateCompleted, 40),
+		cleanTestSnapshot("snap-2h-pending", now, 2*time.Hour, types.SnapshotStatePending, 40),
+		cleanTestSnapshot("snap-3h", now, 3*time.Hour, types.SnapshotStateCompleted, 40),
+		cleanTestSnapshot("snap-2d", now, 48*time.Hour, types.SnapshotStateCompleted, 40),
+		cleanTestSnapshot("snap-3d-error", now, 72*time.Hour, types.SnapshotStateError, 40),
+	}, now).Snapshots
+	tests := []struct {
+		name    string
+		options CleanOptions
+		want    []string
+	}{
+		{name: "no limit", want: []string{}},
+		{name: "max age", options: CleanOptions{MaxAge: 24 * time.Hour}, want: []string{"snap-2d"}},
+		{name: "max age at the snapshot age", options: CleanOptions{MaxAge: 3 * time.Hour}, want: []string{"snap-2d"}},
+		{name: "max count", options: CleanOptions{MaxCount: 1}, want: []string{"snap-3h", "snap-2d"}},
+		{name: "max count above the number of snapshots", options: CleanOptions{MaxCount: 10}, want: []string{}},
+		{name: "max age and count", options: CleanOptions{MaxAge: 24 * time.Hour, MaxCount: 2}, want: []string{"snap-2d"}},
+		{name: "count stricter than age", options: CleanOptions{MaxAge: 24 * time.Hour, MaxCount: 1}, want: []string{"snap-3h", "snap-2d"}},
+		{name: "age stricter than count", options: CleanOptions{MaxAge: 2 * time.Hour, MaxCount: 2}, want: []string{"snap-3h", "snap-2d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snapshotStatusIDs(expiredSnapshots(snapshots, tt.options)); !slices.Equal(got, tt.want) {
+				t.Errorf("expiredSnapshots() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanSnapshots(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		s, ec2Client, _ := newTestSnapshotter(t, testConfig())
+		addTestSnapshot(s, ec2Client, "snap-new", time.Hour, 40)
+		addTestSnapshot(s, ec2Client, "snap-old", 48*time.Hour, 40)
+
+		list, err := s.CleanSnapshots(context.Background(), CleanOptions{MaxAge: 24 * time.Hour, DryRun: dryRun})
+		if err != nil {
+			t.Fatalf("CleanSnapshots() error = %v", err)
+		}
+		if got := snapshotStatusIDs(list.Expired); !slices.Equal(got, []string{"snap-old"}) {
+			t.Errorf("expired snapshots = %v, want [snap-old]", got)
+		}
+		if _, exists := ec2Client.state.Snapshots["snap-old"]; exists != dryRun {
+			t.Errorf("dry run %t: expired snapshot exists = %t, want %t", dryRun, exists, dryRun)
+		}
+		if _, exists := ec2Client.state.Snapshots["snap-new"]; !exists {
+			t.Errorf("dry run %t: snapshot within the budget was deleted", dryRun)
+		}
+	}
+}
+
+func snapshotStatusIDs(snapshots []SnapshotStatus) []string {
+	ids := []string{}
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.SnapshotID)
+	}
+	return ids
+}
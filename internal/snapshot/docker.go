@@ -0,0 +1,21 @@
+package snapshot
+
+// dockerPruneCommands returns the commands run to shrink the docker data directory before snapshotting. The build
+// cache is always pruned. Unused images are only pruned when 'docker_prune_until' or 'docker_prune_filters' is set.
+func dockerPruneCommands(until string, filters []string) [][]string {
+	untilArgs := []string{}
+	if until != "" {
+		untilArgs = append(untilArgs, "--filter", "until="+until)
+	}
+	// Image filters (label, dangling, etc.) are not supported by 'docker builder prune', so it only gets 'until'
+	imageFilterArgs := append([]string{}, untilArgs...)
+	for _, filter := range filters {
+		imageFilterArgs = append(imageFilterArgs, "--filter", filter)
+	}
+
+	commands := [][]string{append([]string{"docker", "builder", "prune", "-f"}, untilArgs...)}
+	if len(imageFilterArgs) > 0 {
+		commands = append(commands, append([]string{"docker", "image", "prune", "-a", "-f"}, imageFilterArgs...))
+	}
+	return commands
+}
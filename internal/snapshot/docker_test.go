@@ -0,0 +1,45 @@
+package snapshot
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDockerPruneCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		until   string
+		filters []string
+		want    []string
+	}{
+		{name: "defaults", want: []string{"docker builder prune -f"}},
+		{
+			name:  "until",
+			until: "72h",
+			want:  []string{"docker builder prune -f --filter until=72h", "docker image prune -a -f --filter until=72h"},
+		},
+		{
+			name:    "filters are only passed to image prune",
+			filters: []string{"label!=keep"},
+			want:    []string{"docker builder prune -f", "docker image prune -a -f --filter label!=keep"},
+		},
+		{
+			name:    "until and filters",
+			until:   "24h",
+			filters: []string{"label!=keep", "dangling=true"},
+			want:    []string{"docker builder prune -f --filter until=24h", "docker image prune -a -f --filter until=24h --filter label!=keep --filter dangling=true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, command := range dockerPruneCommands(tt.until, tt.filters) {
+				got = append(got, strings.Join(command, " "))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("dockerPruneCommands(%q, %v) = %q, want %q", tt.until, tt.filters, got, tt.want)
+			}
+		})
+	}
+}
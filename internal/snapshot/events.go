@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgeTypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// Source and detail type of the events put on the 'event_bus_name' event bus, to match in EventBridge rules
+const (
+	eventSource                    = "runs-on.snapshot"
+	eventDetailTypeSnapshotCreated = "Snapshot Created"
+)
+
+// eventBridgeAPI is the subset of the EventBridge client used by the snapshotter, so that it can be faked in mock mode.
+type eventBridgeAPI interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
+// SnapshotCreatedDetail is the detail of the event put on the 'event_bus_name' event bus when a snapshot is created.
+type SnapshotCreatedDetail struct {
+	Repository    string `json:"repository"`
+	Branch        string `json:"branch"`
+	Path          string `json:"path"`
+	SnapshotID    string `json:"snapshot_id"`
+	SnapshotName  string `json:"snapshot_name"`
+	VolumeID      string `json:"volume_id"`
+	VolumeSizeGiB int32  `json:"volume_size_gib"`
+	// Completed is false when the snapshot was not waited for, in which case it is still pending
+	Completed bool `json:"completed"`
+}
+
+// putSnapshotCreatedEvent puts a "Snapshot Created" event on the 'event_bus_name' event bus, if any. Failures are
+// logged only, since the snapshot itself succeeded.
+func (s *AWSSnapshotter) putSnapshotCreatedEvent(ctx context.Context, detail *SnapshotCreatedDetail) {
+	if s.config.EventBusName == "" {
+		return
+	}
+	if err := s.putEvent(ctx, eventDetailTypeSnapshotCreated, detail); err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to put event on event bus %s: %v", s.config.EventBusName, err)
+		return
+	}
+	s.logger.Info().Msgf("CreateSnapshot: Put '%s' event for snapshot %s on event bus %s.", eventDetailTypeSnapshotCreated, detail.SnapshotID, s.config.EventBusName)
+}
+
+// putEvent puts a single event with the JSON-encoded detail on the 'event_bus_name' event bus.
+func (s *AWSSnapshotter) putEvent(ctx context.Context, detailType string, detail any) error {
+	detailJSON, err := json.Marshal(detail)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event detail: %w", err)
+	}
+	output, err := s.eventsClient.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []eventbridgeTypes.PutEventsRequestEntry{
+			{
+				EventBusName: aws.String(s.config.EventBusName),
+				Source:       aws.String(eventSource),
+				DetailType:   aws.String(detailType),
+				Detail:       aws.String(string(detailJSON)),
+				Time:         aws.Time(time.Now()),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// PutEvents reports failures per entry, without an error
+	if output.FailedEntryCount > 0 && len(output.Entries) > 0 {
+		return fmt.Errorf("%s: %s", aws.ToString(output.Entries[0].ErrorCode), aws.ToString(output.Entries[0].ErrorMessage))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package snapshot
+
+import (
+	"context"
+	"strings"
+
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+// formatCommand returns the sudo arguments to format the device with the given filesystem, label (if not empty) and
+// additional mkfs options.
+func formatCommand(filesystem string, device string, label string, options []string) []string {
+	var command []string
+	switch filesystem {
+	case runsOnConfig.FilesystemXfs:
+		command = []string{"mkfs.xfs", "-f"}
+	case runsOnConfig.FilesystemBtrfs:
+		command = []string{"mkfs.btrfs", "-f"}
+	default:
+		command = []string{"mkfs.ext4", "-F"} // -F to force if already formatted by mistake or small
+	}
+	if label != "" {
+		command = append(command, "-L", label)
+	}
+	command = append(command, options...)
+	return append(command, device)
+}
+
+// growCommand returns the sudo arguments to grow the mounted filesystem to the size of its device.
+func growCommand(filesystem string, device string, mountPoint string) []string {
+	switch filesystem {
+	case runsOnConfig.FilesystemXfs:
+		return []string{"xfs_growfs", mountPoint}
+	case runsOnConfig.FilesystemBtrfs:
+		return []string{"btrfs", "filesystem", "resize", "max", mountPoint}
+	default:
+		return []string{"resize2fs", device}
+	}
+}
+
+// reformatOnMismatch returns whether a restored volume with the detected filesystem must be reformatted with the
+// configured one, as requested by 'reformat_on_mismatch'. Read-only volumes are never reformatted.
+func (s *AWSSnapshotter) reformatOnMismatch(detected string) bool {
+	return s.config.ReformatOnMismatch && !s.config.ReadOnly && detected != s.config.Filesystem
+}
+
+// dataPartition returns the first partition of the device holding a filesystem, or an empty string if the device is
+// not partitioned (or if its partitions can't be listed), in which case the filesystem is on the whole device.
+func (s *AWSSnapshotter) dataPartition(ctx context.Context, device string) string {
+	output, err := s.runCommand(ctx, "lsblk", "-n", "-r", "-p", "-o", "NAME,TYPE,FSTYPE", device)
+	if err != nil {
+		s.logger.Warn().Msgf("Unable to list the partitions of %s: %v", device, err)
+		return ""
+	}
+	return firstDataPartition(string(output))
+}
+
+// firstDataPartition parses the output of `lsblk -n -r -p -o NAME,TYPE,FSTYPE` and returns the first partition with a
+// filesystem other than swap, or an empty string if there is none.
+func firstDataPartition(lsblkOutput string) string {
+	for _, line := range strings.Split(lsblkOutput, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == "part" && fields[2] != "swap" {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// detectFilesystem returns the filesystem type of the device (e.g. ext4), or an empty string if it can't be determined.
+func (s *AWSSnapshotter) detectFilesystem(ctx context.Context, device string) string {
+	output, err := s.runCommand(ctx, "sudo", "blkid", "-o", "value", "-s", "TYPE", device)
+	if err != nil {
+		s.logger.Warn().Msgf("Unable to detect filesystem of %s: %v", device, err)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// mountCommand returns the sudo arguments to mount the device with the given filesystem on the mount point.
+func (s *AWSSnapshotter) mountCommand(filesystem string, device string, mountPoint string) []string {
+	command := []string{"mount"}
+	if mountOptions := s.mountOptions(filesystem); mountOptions != "" {
+		command = append(command, "-o", mountOptions)
+	}
+	return append(command, device, mountPoint)
+}
+
+// mountOptions returns the options to pass to `mount -o` for the given filesystem,
+// adding compression for btrfs and forcing a read-only mount when requested.
+func (s *AWSSnapshotter) mountOptions(filesystem string) string {
+	options := []string{}
+	if s.config.MountOptions != "" {
+		options = append(options, s.config.MountOptions)
+	}
+	if filesystem == runsOnConfig.FilesystemBtrfs && s.config.BtrfsCompression != "" {
+		options = append(options, "compress="+s.config.BtrfsCompression)
+	}
+	if s.config.ReadOnly {
+		options = append(options, "ro")
+	}
+	return strings.Join(options, ",")
+}
+
+// growFilesystem grows the filesystem of a volume restored from a smaller snapshot to the size of the volume. Failures
+// are logged only, as the volume is still usable with the size of the snapshot.
+func (s *AWSSnapshotter) growFilesystem(ctx context.Context, filesystem string, device string, mountPoint string) {
+	if s.config.ReadOnly {
+		s.logger.Info().Msgf("RestoreSnapshot: Not growing the %s filesystem of %s, as it is mounted read-only.", filesystem, device)
+		return
+	}
+	s.logger.Info().Msgf("RestoreSnapshot: Growing the %s filesystem of %s to the size of the volume...", filesystem, device)
+	if _, err := s.runCommand(ctx, "sudo", growCommand(filesystem, device, mountPoint)...); err != nil {
+		s.logger.Warn().Msgf("Warning: failed to grow the filesystem of %s: %v. Only the size of the snapshot is usable.", device, err)
+		return
+	}
+	s.logger.Info().Msgf("RestoreSnapshot: Filesystem of %s grown.", device)
+}
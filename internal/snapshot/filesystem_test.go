@@ -0,0 +1,117 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+func TestFirstDataPartition(t *testing.T) {
+	tests := []struct {
+		name        string
+		lsblkOutput string
+		want        string
+	}{
+		{name: "unpartitioned", lsblkOutput: "/dev/nvme1n1 disk ext4\n", want: ""},
+		{name: "single partition", lsblkOutput: "/dev/nvme1n1 disk \n/dev/nvme1n1p1 part ext4\n", want: "/dev/nvme1n1p1"},
+		{name: "swap first", lsblkOutput: "/dev/nvme1n1 disk \n/dev/nvme1n1p1 part swap\n/dev/nvme1n1p2 part xfs\n", want: "/dev/nvme1n1p2"},
+		{name: "partition without filesystem", lsblkOutput: "/dev/nvme1n1 disk \n/dev/nvme1n1p1 part \n/dev/nvme1n1p2 part btrfs\n", want: "/dev/nvme1n1p2"},
+		{name: "empty", lsblkOutput: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := firstDataPartition(tt.lsblkOutput); got != tt.want {
+				t.Errorf("firstDataPartition() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMountCommand(t *testing.T) {
+	tests := []struct {
+		name         string
+		mountOptions string
+		want         string
+	}{
+		{name: "no options", want: "mount /dev/nvme1n1 /mnt/cache"},
+		{name: "single option", mountOptions: "noatime", want: "mount -o noatime /dev/nvme1n1 /mnt/cache"},
+		{name: "several options", mountOptions: "noatime,nodiratime", want: "mount -o noatime,nodiratime /dev/nvme1n1 /mnt/cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MountOptions = tt.mountOptions
+			s, _, _ := newTestSnapshotter(t, cfg)
+			if got := strings.Join(s.mountCommand(runsOnConfig.FilesystemExt4, "/dev/nvme1n1", "/mnt/cache"), " "); got != tt.want {
+				t.Errorf("mountCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilesystemCommands(t *testing.T) {
+	tests := []struct {
+		filesystem       string
+		btrfsCompression string
+		wantFormat       string
+		wantGrow         string
+		wantMount        string
+	}{
+		{
+			filesystem: runsOnConfig.FilesystemExt4,
+			wantFormat: "mkfs.ext4 -F -L cache /dev/nvme1n1",
+			wantGrow:   "resize2fs /dev/nvme1n1",
+			wantMount:  "mount /dev/nvme1n1 /mnt/cache",
+		},
+		{
+			filesystem: runsOnConfig.FilesystemXfs,
+			wantFormat: "mkfs.xfs -f -L cache /dev/nvme1n1",
+			wantGrow:   "xfs_growfs /mnt/cache",
+			wantMount:  "mount /dev/nvme1n1 /mnt/cache",
+		},
+		{
+			filesystem:       runsOnConfig.FilesystemBtrfs,
+			btrfsCompression: "zstd:1",
+			wantFormat:       "mkfs.btrfs -f -L cache /dev/nvme1n1",
+			wantGrow:         "btrfs filesystem resize max /mnt/cache",
+			wantMount:        "mount -o compress=zstd:1 /dev/nvme1n1 /mnt/cache",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filesystem, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Filesystem = tt.filesystem
+			cfg.BtrfsCompression = tt.btrfsCompression
+			s, _, _ := newTestSnapshotter(t, cfg)
+			if got := strings.Join(formatCommand(tt.filesystem, "/dev/nvme1n1", "cache", nil), " "); got != tt.wantFormat {
+				t.Errorf("formatCommand() = %q, want %q", got, tt.wantFormat)
+			}
+			if got := strings.Join(growCommand(tt.filesystem, "/dev/nvme1n1", "/mnt/cache"), " "); got != tt.wantGrow {
+				t.Errorf("growCommand() = %q, want %q", got, tt.wantGrow)
+			}
+			if got := strings.Join(s.mountCommand(tt.filesystem, "/dev/nvme1n1", "/mnt/cache"), " "); got != tt.wantMount {
+				t.Errorf("mountCommand() = %q, want %q", got, tt.wantMount)
+			}
+		})
+	}
+}
+
+func TestMountOptionsCompressionOnlyForBtrfs(t *testing.T) {
+	cfg := testConfig()
+	cfg.BtrfsCompression = "zstd"
+	s, _, _ := newTestSnapshotter(t, cfg)
+	if got := s.mountOptions(runsOnConfig.FilesystemExt4); got != "" {
+		t.Errorf("mountOptions(ext4) = %q, want no compression", got)
+	}
+}
+
+func TestMountOptionsReadOnly(t *testing.T) {
+	cfg := testConfig()
+	cfg.MountOptions = "noatime"
+	cfg.ReadOnly = true
+	s, _, _ := newTestSnapshotter(t, cfg)
+	if got, want := s.mountOptions(runsOnConfig.FilesystemExt4), "noatime,ro"; got != want {
+		t.Errorf("mountOptions() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// enableFastSnapshotRestore enables fast snapshot restore on the snapshot in the AZ of the instance, which is where
+// the next runs of the branch are most likely to create their volume. Failures are logged only, since volumes can still
+// be created from the snapshot, just with a lazy initialization.
+func (s *AWSSnapshotter) enableFastSnapshotRestore(ctx context.Context, snapshotID string) {
+	s.logger.Info().Msgf("CreateSnapshot: Enabling fast snapshot restore on snapshot %s in %s...", snapshotID, s.config.Az)
+	output, err := s.ec2Client.EnableFastSnapshotRestores(ctx, &ec2.EnableFastSnapshotRestoresInput{
+		SourceSnapshotIds: []string{snapshotID},
+		AvailabilityZones: []string{s.config.Az},
+	})
+	if err == nil && len(output.Unsuccessful) > 0 {
+		err = fastSnapshotRestoreError(output.Unsuccessful[0].FastSnapshotRestoreStateErrors)
+	}
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to enable fast snapshot restore on snapshot %s in %s: %v", snapshotID, s.config.Az, err)
+		return
+	}
+	s.logger.Info().Msgf("CreateSnapshot: Fast snapshot restore is being enabled on snapshot %s in %s. It may take a while before it is effective.", snapshotID, s.config.Az)
+
+	// Record the AZ on the snapshot (space-separated AZs), so that restores can prefer warm snapshots without describing
+	// their FSR state
+	_, err = s.ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{snapshotID},
+		Tags:      []types.Tag{{Key: aws.String(snapshotTagKeyFsrAzs), Value: aws.String(s.config.Az)}},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to tag snapshot %s with its fast snapshot restore AZ: %v", snapshotID, err)
+	}
+}
+
+// disableFastSnapshotRestore disables fast snapshot restore on a snapshot replaced by a newer one, in the AZ of the
+// instance, so that it stops being billed. Snapshots without fast snapshot restore are ignored.
+func (s *AWSSnapshotter) disableFastSnapshotRestore(ctx context.Context, snapshotID string) {
+	output, err := s.ec2Client.DisableFastSnapshotRestores(ctx, &ec2.DisableFastSnapshotRestoresInput{
+		SourceSnapshotIds: []string{snapshotID},
+		AvailabilityZones: []string{s.config.Az},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to disable fast snapshot restore on previous snapshot %s in %s: %v", snapshotID, s.config.Az, err)
+		return
+	}
+	if len(output.Successful) > 0 {
+		s.logger.Info().Msgf("CreateSnapshot: Disabled fast snapshot restore on previous snapshot %s in %s", snapshotID, s.config.Az)
+		_, err = s.ec2Client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+			Resources: []string{snapshotID},
+			Tags:      []types.Tag{{Key: aws.String(snapshotTagKeyFsrAzs)}},
+		})
+		if err != nil {
+			s.logger.Warn().Msgf("Warning: Failed to remove the %s tag from previous snapshot %s: %v", snapshotTagKeyFsrAzs, snapshotID, err)
+		}
+	}
+}
+
+// isWarm returns whether fast snapshot restore was enabled on the snapshot in the AZ, according to its tag, in which
+// case volumes created from it there are fully initialized right away.
+func isWarm(snapshot types.Snapshot, az string) bool {
+	azs, _ := tagValue(snapshot.Tags, snapshotTagKeyFsrAzs)
+	return slices.Contains(strings.Fields(azs), az)
+}
+
+// fastSnapshotRestoreError returns the first error reported when enabling fast snapshot restore failed.
+func fastSnapshotRestoreError(stateErrors []types.EnableFastSnapshotRestoreStateErrorItem) error {
+	for _, stateError := range stateErrors {
+		if stateError.Error != nil {
+			return fmt.Errorf("%s: %s", aws.ToString(stateError.Error.Code), aws.ToString(stateError.Error.Message))
+		}
+	}
+	return fmt.Errorf("unknown error")
+}
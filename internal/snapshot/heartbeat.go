@@ -0,0 +1,72 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// waitWithHeartbeat calls wait, and logs the elapsed time and the state of the resource every 'heartbeat_interval_seconds'
+// while it blocks, so that long waits don't look like the action hung.
+func (s *AWSSnapshotter) waitWithHeartbeat(ctx context.Context, operation string, state func(ctx context.Context) string, wait func() error) error {
+	if s.config.HeartbeatInterval <= 0 {
+		return wait()
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		start := time.Now()
+		ticker := time.NewTicker(s.config.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.logger.Info().Msgf("%s: Still waiting after %s (%s)", operation, time.Since(start).Round(time.Second), state(ctx))
+			}
+		}
+	}()
+
+	err := wait()
+	close(done)
+	wg.Wait()
+	return err
+}
+
+// volumeState returns a function describing the state and attachments of the volume, for heartbeats.
+func (s *AWSSnapshotter) volumeState(volumeID string) func(ctx context.Context) string {
+	return func(ctx context.Context) string {
+		output, err := s.ec2Client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volumeID}})
+		if err != nil || len(output.Volumes) == 0 {
+			return fmt.Sprintf("volume %s state unknown: %v", volumeID, err)
+		}
+		volume := output.Volumes[0]
+		state := fmt.Sprintf("volume %s is %s", volumeID, volume.State)
+		for _, attachment := range volume.Attachments {
+			state += fmt.Sprintf(", %s to %s", attachment.State, aws.ToString(attachment.InstanceId))
+		}
+		return state
+	}
+}
+
+// snapshotState returns a function describing the state and progress of the snapshot, for heartbeats.
+func (s *AWSSnapshotter) snapshotState(snapshotID string) func(ctx context.Context) string {
+	return func(ctx context.Context) string {
+		output, err := s.ec2Client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapshotID}})
+		if err != nil || len(output.Snapshots) == 0 {
+			return fmt.Sprintf("snapshot %s state unknown: %v", snapshotID, err)
+		}
+		snapshot := output.Snapshots[0]
+		return fmt.Sprintf("snapshot %s is %s, progress %s", snapshotID, snapshot.State, aws.ToString(snapshot.Progress))
+	}
+}
@@ -0,0 +1,86 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// snapshotLeaseTagKey holds the time (in unix nanoseconds) at which a job requested the snapshot lease for its volume.
+	snapshotLeaseTagKey = "runs-on-snapshot-lease"
+	// snapshotLeaseDuration is the time after which a lease is considered stale (e.g. the job holding it was killed).
+	snapshotLeaseDuration = 30 * time.Minute
+)
+
+// leaseNow returns the time at which a lease is requested. It is replaced in tests.
+var leaseNow = time.Now
+
+// ErrSnapshotLocked is returned by CreateSnapshot when 'snapshot_lock' is set and another job is already
+// snapshotting the same branch.
+var ErrSnapshotLocked = errors.New("another job is already snapshotting this branch")
+
+// acquireSnapshotLease is an advisory lock keyed on the selection tags (repository, branch, etc.), implemented with
+// EC2 tags: the volume is tagged with a lease request, then all volumes holding a non-stale request for the same
+// tags are listed, and the oldest request wins (ties are broken by volume ID). It returns false if another job holds
+// the lease, in which case the lease request is withdrawn.
+// Tags listed by DescribeVolumes are eventually consistent, so two jobs requesting the lease within a few seconds may
+// not see each other's request and both acquire it: the lease only avoids most duplicate snapshots.
+func (s *AWSSnapshotter) acquireSnapshotLease(ctx context.Context, volumeID string) (bool, error) {
+	requestedAt := leaseNow().UnixNano()
+	_, err := s.ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{volumeID},
+		Tags:      []types.Tag{{Key: aws.String(snapshotLeaseTagKey), Value: aws.String(strconv.FormatInt(requestedAt, 10))}},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to request snapshot lease on volume %s: %w", volumeID, err)
+	}
+
+	filters := []types.Filter{{Name: aws.String("tag-key"), Values: []string{snapshotLeaseTagKey}}}
+	for _, tag := range s.selectionTags() {
+		filters = append(filters, types.Filter{Name: aws.String(fmt.Sprintf("tag:%s", *tag.Key)), Values: []string{*tag.Value}})
+	}
+	volumesOutput, err := s.describeVolumes(ctx, &ec2.DescribeVolumesInput{Filters: filters})
+	if err != nil {
+		s.releaseSnapshotLease(ctx, volumeID)
+		return false, fmt.Errorf("failed to list snapshot lease holders: %w", err)
+	}
+
+	staleBefore := leaseNow().Add(-snapshotLeaseDuration).UnixNano()
+	for _, volume := range volumesOutput.Volumes {
+		otherVolumeID := aws.ToString(volume.VolumeId)
+		if otherVolumeID == volumeID {
+			continue
+		}
+		value, _ := tagValue(volume.Tags, snapshotLeaseTagKey)
+		otherRequestedAt, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || otherRequestedAt < staleBefore {
+			continue
+		}
+		if otherRequestedAt < requestedAt || (otherRequestedAt == requestedAt && otherVolumeID < volumeID) {
+			s.logger.Info().Msgf("acquireSnapshotLease: Snapshot lease is held by volume %s", otherVolumeID)
+			s.releaseSnapshotLease(ctx, volumeID)
+			return false, nil
+		}
+	}
+
+	s.logger.Info().Msgf("acquireSnapshotLease: Snapshot lease acquired for volume %s", volumeID)
+	return true, nil
+}
+
+// releaseSnapshotLease removes the lease tag from the volume. Failures are logged only, since leases expire anyway.
+func (s *AWSSnapshotter) releaseSnapshotLease(ctx context.Context, volumeID string) {
+	_, err := s.ec2Client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{volumeID},
+		Tags:      []types.Tag{{Key: aws.String(snapshotLeaseTagKey)}},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to release snapshot lease on volume %s: %v", volumeID, err)
+	}
+}
@@ -0,0 +1,69 @@
+package snapshot
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestAcquireSnapshotLease(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// otherLeases maps the IDs of the other volumes of the branch to the age of their lease request
+		otherLeases  map[string]time.Duration
+		wantAcquired bool
+	}{
+		{name: "sole holder", wantAcquired: true},
+		{name: "older request wins", otherLeases: map[string]time.Duration{"vol-other": time.Minute}},
+		{name: "newer request loses", otherLeases: map[string]time.Duration{"vol-other": -time.Minute}, wantAcquired: true},
+		{name: "tie won by the lower volume ID", otherLeases: map[string]time.Duration{"vol-a": 0}},
+		{name: "tie lost by the higher volume ID", otherLeases: map[string]time.Duration{"vol-z": 0}, wantAcquired: true},
+		{name: "stale lease is ignored", otherLeases: map[string]time.Duration{"vol-other": snapshotLeaseDuration + time.Minute}, wantAcquired: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaseNow = func() time.Time { return now }
+			t.Cleanup(func() { leaseNow = time.Now })
+			s, ec2Client, _ := newTestSnapshotter(t, testConfig())
+			addTestVolume(s, ec2Client, "vol-m")
+			for volumeID, age := range tt.otherLeases {
+				addTestVolume(s, ec2Client, volumeID, types.Tag{Key: aws.String(snapshotLeaseTagKey), Value: aws.String(strconv.FormatInt(now.Add(-age).UnixNano(), 10))})
+			}
+
+			acquired, err := s.acquireSnapshotLease(context.Background(), "vol-m")
+			if err != nil {
+				t.Fatalf("acquireSnapshotLease() error = %v", err)
+			}
+			if acquired != tt.wantAcquired {
+				t.Errorf("acquireSnapshotLease() = %t, want %t", acquired, tt.wantAcquired)
+			}
+			// A lost lease request is withdrawn, so that it doesn't block the other jobs
+			if _, requested := tagValue(ec2Client.state.Volumes["vol-m"].Tags, snapshotLeaseTagKey); requested != tt.wantAcquired {
+				t.Errorf("lease tag present = %t, want %t", requested, tt.wantAcquired)
+			}
+		})
+	}
+}
+
+func TestReleaseSnapshotLease(t *testing.T) {
+	s, ec2Client, _ := newTestSnapshotter(t, testConfig())
+	addTestVolume(s, ec2Client, "vol-m")
+	if acquired, err := s.acquireSnapshotLease(context.Background(), "vol-m"); err != nil || !acquired {
+		t.Fatalf("acquireSnapshotLease() = %t, %v, want true", acquired, err)
+	}
+
+	s.releaseSnapshotLease(context.Background(), "vol-m")
+	if _, requested := tagValue(ec2Client.state.Volumes["vol-m"].Tags, snapshotLeaseTagKey); requested {
+		t.Errorf("lease tag still present after release")
+	}
+	// Once released, the lease can be acquired by another job
+	addTestVolume(s, ec2Client, "vol-other")
+	if acquired, err := s.acquireSnapshotLease(context.Background(), "vol-other"); err != nil || !acquired {
+		t.Errorf("acquireSnapshotLease() after release = %t, %v, want true", acquired, err)
+	}
+}
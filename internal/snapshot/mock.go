@@ -0,0 +1,566 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/smithy-go"
+)
+
+// mockEnvVar enables the mock mode, for running the action outside of EC2 during development.
+const mockEnvVar = "RUNS_ON_SNAPSHOT_MOCK"
+
+func isMockMode() bool {
+	return os.Getenv(mockEnvVar) != ""
+}
+
+// Placeholders used in mock mode when not running on a RunsOn instance
+const (
+	mockInstanceID = "i-mock"
+	mockAz         = "mock-az-1a"
+)
+
+// mockStateDir is where the mock mode stores its state (volume info, fake EC2 resources), instead of /runs-on.
+func mockStateDir() string {
+	return filepath.Join(os.TempDir(), "runs-on-snapshot-mock")
+}
+
+// noopExecCommand replaces command execution in mock mode.
+func noopExecCommand(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// fakeEC2State holds the fake EC2 resources. It is persisted between the main and post phases.
+type fakeEC2State struct {
+	Counter   int                       `json:"counter"`
+	Volumes   map[string]types.Volume   `json:"volumes"`
+	Snapshots map[string]types.Snapshot `json:"snapshots"`
+	// FastSnapshotRestores holds the AZs in which fast snapshot restore is enabled, per snapshot ID
+	FastSnapshotRestores map[string][]string `json:"fast_snapshot_restores"`
+}
+
+// fakeEC2Client is an in-memory implementation of ec2API, persisted to a JSON file.
+// Resources transition to their final state immediately.
+type fakeEC2Client struct {
+	mu        sync.Mutex
+	statePath string
+	state     fakeEC2State
+}
+
+func newFakeEC2Client(stateDir string) (*fakeEC2Client, error) {
+	client := &fakeEC2Client{
+		statePath: filepath.Join(stateDir, "ec2.json"),
+		state: fakeEC2State{
+			Volumes:              map[string]types.Volume{},
+			Snapshots:            map[string]types.Snapshot{},
+			FastSnapshotRestores: map[string][]string{},
+		},
+	}
+
+	data, err := os.ReadFile(client.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return client, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mock state: %w", err)
+	}
+	if err := json.Unmarshal(data, &client.state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal mock state: %w", err)
+	}
+	if client.state.FastSnapshotRestores == nil {
+		client.state.FastSnapshotRestores = map[string][]string{}
+	}
+	return client, nil
+}
+
+func (c *fakeEC2Client) persist() error {
+	if err := os.MkdirAll(filepath.Dir(c.statePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for mock state: %w", err)
+	}
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal mock state: %w", err)
+	}
+	return os.WriteFile(c.statePath, data, 0644)
+}
+
+func (c *fakeEC2Client) nextID(prefix string) string {
+	c.state.Counter++
+	return fmt.Sprintf("%s-mock%08d", prefix, c.state.Counter)
+}
+
+func fakeNotFoundError(code string, id string) error {
+	return &smithy.GenericAPIError{Code: code, Message: fmt.Sprintf("%s does not exist", id)}
+}
+
+func fakeDryRunError() error {
+	return &smithy.GenericAPIError{Code: "DryRunOperation", Message: "Request would have succeeded, but DryRun flag is set."}
+}
+
+func fakeInUseError(id string) error {
+	return &smithy.GenericAPIError{Code: "VolumeInUse", Message: fmt.Sprintf("%s is attached", id)}
+}
+
+func tagsFromSpecifications(specs []types.TagSpecification, resourceType types.ResourceType) []types.Tag {
+	tags := []types.Tag{}
+	for _, spec := range specs {
+		if spec.ResourceType == resourceType {
+			tags = append(tags, spec.Tags...)
+		}
+	}
+	return tags
+}
+
+func setTags(existing []types.Tag, tags []types.Tag) []types.Tag {
+	for _, tag := range tags {
+		replaced := false
+		for i := range existing {
+			if *existing[i].Key == *tag.Key {
+				existing[i].Value = tag.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			existing = append(existing, tag)
+		}
+	}
+	return existing
+}
+
+// matchFilters returns whether all filters match, using the given lookup for non-tag filters.
+func matchFilters(filters []types.Filter, tags []types.Tag, lookup func(name string) []string) bool {
+	for _, filter := range filters {
+		name := aws.ToString(filter.Name)
+		var actual []string
+		if name == "tag-key" {
+			for _, tag := range tags {
+				actual = append(actual, aws.ToString(tag.Key))
+			}
+		} else if key, ok := strings.CutPrefix(name, "tag:"); ok {
+			if value, found := tagValue(tags, key); found {
+				actual = []string{value}
+			}
+		} else {
+			actual = lookup(name)
+		}
+		matched := false
+		for _, want := range filter.Values {
+			for _, got := range actual {
+				if want == got {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fakeEC2Client) CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.ToBool(params.DryRun) {
+		return nil, fakeDryRunError()
+	}
+	size := aws.ToInt32(params.Size)
+	if params.SnapshotId != nil {
+		snapshot, ok := c.state.Snapshots[*params.SnapshotId]
+		if !ok {
+			return nil, fakeNotFoundError("InvalidSnapshot.NotFound", *params.SnapshotId)
+		}
+		if size == 0 {
+			size = aws.ToInt32(snapshot.VolumeSize)
+		}
+	}
+
+	volume := types.Volume{
+		VolumeId:           aws.String(c.nextID("vol")),
+		AvailabilityZone:   params.AvailabilityZone,
+		CreateTime:         aws.Time(time.Now()),
+		Size:               aws.Int32(size),
+		SnapshotId:         params.SnapshotId,
+		State:              types.VolumeStateAvailable,
+		VolumeType:         params.VolumeType,
+		Iops:               params.Iops,
+		Throughput:         params.Throughput,
+		MultiAttachEnabled: params.MultiAttachEnabled,
+		Encrypted:          params.Encrypted,
+		KmsKeyId:           params.KmsKeyId,
+		Tags:               tagsFromSpecifications(params.TagSpecifications, types.ResourceTypeVolume),
+	}
+	c.state.Volumes[*volume.VolumeId] = volume
+
+	return &ec2.CreateVolumeOutput{VolumeId: volume.VolumeId, State: volume.State, Size: volume.Size}, c.persist()
+}
+
+func (c *fakeEC2Client) DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.ToBool(params.DryRun) {
+		return nil, fakeDryRunError()
+	}
+	output := &ec2.DescribeVolumesOutput{}
+	for _, id := range params.VolumeIds {
+		if _, ok := c.state.Volumes[id]; !ok {
+			return nil, fakeNotFoundError("InvalidVolume.NotFound", id)
+		}
+	}
+	for id, volume := range c.state.Volumes {
+		if len(params.VolumeIds) > 0 && !slices.Contains(params.VolumeIds, id) {
+			continue
+		}
+		matched := matchFilters(params.Filters, volume.Tags, func(name string) []string {
+			switch name {
+			case "availability-zone":
+				return []string{aws.ToString(volume.AvailabilityZone)}
+			case "status":
+				return []string{string(volume.State)}
+			case "multi-attach-enabled":
+				return []string{fmt.Sprintf("%t", aws.ToBool(volume.MultiAttachEnabled))}
+			case "attachment.status":
+				values := []string{}
+				for _, attachment := range volume.Attachments {
+					values = append(values, string(attachment.State))
+				}
+				return values
+			case "attachment.instance-id":
+				values := []string{}
+				for _, attachment := range volume.Attachments {
+					values = append(values, aws.ToString(attachment.InstanceId))
+				}
+				return values
+			}
+			return nil
+		})
+		if matched {
+			output.Volumes = append(output.Volumes, volume)
+		}
+	}
+	return output, nil
+}
+
+func (c *fakeEC2Client) AttachVolume(ctx context.Context, params *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.ToBool(params.DryRun) {
+		return nil, fakeDryRunError()
+	}
+	volume, ok := c.state.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, fakeNotFoundError("InvalidVolume.NotFound", aws.ToString(params.VolumeId))
+	}
+	if volume.State != types.VolumeStateAvailable && !aws.ToBool(volume.MultiAttachEnabled) {
+		return nil, fakeInUseError(*volume.VolumeId)
+	}
+
+	attachment := types.VolumeAttachment{
+		VolumeId:   volume.VolumeId,
+		InstanceId: params.InstanceId,
+		Device:     params.Device,
+		State:      types.VolumeAttachmentStateAttached,
+		AttachTime: aws.Time(time.Now()),
+	}
+	volume.Attachments = append(volume.Attachments, attachment)
+	volume.State = types.VolumeStateInUse
+	c.state.Volumes[*volume.VolumeId] = volume
+
+	return &ec2.AttachVolumeOutput{
+		VolumeId:   attachment.VolumeId,
+		InstanceId: attachment.InstanceId,
+		Device:     attachment.Device,
+		State:      attachment.State,
+	}, c.persist()
+}
+
+func (c *fakeEC2Client) DetachVolume(ctx context.Context, params *ec2.DetachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DetachVolumeOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.ToBool(params.DryRun) {
+		return nil, fakeDryRunError()
+	}
+	volume, ok := c.state.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, fakeNotFoundError("InvalidVolume.NotFound", aws.ToString(params.VolumeId))
+	}
+
+	attachments := []types.VolumeAttachment{}
+	for _, attachment := range volume.Attachments {
+		if params.InstanceId != nil && aws.ToString(attachment.InstanceId) != *params.InstanceId {
+			attachments = append(attachments, attachment)
+		}
+	}
+	volume.Attachments = attachments
+	if len(attachments) == 0 {
+		volume.State = types.VolumeStateAvailable
+	}
+	c.state.Volumes[*volume.VolumeId] = volume
+
+	return &ec2.DetachVolumeOutput{VolumeId: volume.VolumeId, State: types.VolumeAttachmentStateDetached}, c.persist()
+}
+
+func (c *fakeEC2Client) DeleteVolume(ctx context.Context, params *ec2.DeleteVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.ToBool(params.DryRun) {
+		return nil, fakeDryRunError()
+	}
+	volume, ok := c.state.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, fakeNotFoundError("InvalidVolume.NotFound", aws.ToString(params.VolumeId))
+	}
+	if volume.State != types.VolumeStateAvailable {
+		return nil, fakeInUseError(*volume.VolumeId)
+	}
+	delete(c.state.Volumes, *volume.VolumeId)
+
+	return &ec2.DeleteVolumeOutput{}, c.persist()
+}
+
+func (c *fakeEC2Client) CreateSnapshot(ctx context.Context, params *ec2.CreateSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.CreateSnapshotOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.ToBool(params.DryRun) {
+		return nil, fakeDryRunError()
+	}
+	volume, ok := c.state.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, fakeNotFoundError("InvalidVolume.NotFound", aws.ToString(params.VolumeId))
+	}
+
+	snapshot := types.Snapshot{
+		SnapshotId:  aws.String(c.nextID("snap")),
+		VolumeId:    volume.VolumeId,
+		VolumeSize:  volume.Size,
+		Description: params.Description,
+		StartTime:   aws.Time(time.Now()),
+		State:       types.SnapshotStateCompleted,
+		Progress:    aws.String("100%"),
+		OwnerId:     aws.String("000000000000"),
+		StorageTier: types.StorageTierStandard,
+		Encrypted:   volume.Encrypted,
+		KmsKeyId:    volume.KmsKeyId,
+		Tags:        tagsFromSpecifications(params.TagSpecifications, types.ResourceTypeSnapshot),
+	}
+	c.state.Snapshots[*snapshot.SnapshotId] = snapshot
+
+	return &ec2.CreateSnapshotOutput{
+		SnapshotId: snapshot.SnapshotId,
+		VolumeId:   snapshot.VolumeId,
+		VolumeSize: snapshot.VolumeSize,
+		StartTime:  snapshot.StartTime,
+		State:      snapshot.State,
+		Encrypted:  snapshot.Encrypted,
+		KmsKeyId:   snapshot.KmsKeyId,
+		Tags:       snapshot.Tags,
+	}, c.persist()
+}
+
+func (c *fakeEC2Client) DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.ToBool(params.DryRun) {
+		return nil, fakeDryRunError()
+	}
+	output := &ec2.DescribeSnapshotsOutput{}
+	for _, id := range params.SnapshotIds {
+		if _, ok := c.state.Snapshots[id]; !ok {
+			return nil, fakeNotFoundError("InvalidSnapshot.NotFound", id)
+		}
+	}
+	for id, snapshot := range c.state.Snapshots {
+		if len(params.SnapshotIds) > 0 && !slices.Contains(params.SnapshotIds, id) {
+			continue
+		}
+		matched := matchFilters(params.Filters, snapshot.Tags, func(name string) []string {
+			switch name {
+			case "status":
+				return []string{string(snapshot.State)}
+			case "volume-id":
+				return []string{aws.ToString(snapshot.VolumeId)}
+			case "storage-tier":
+				return []string{string(snapshot.StorageTier)}
+			}
+			return nil
+		})
+		if matched {
+			output.Snapshots = append(output.Snapshots, snapshot)
+		}
+	}
+	return output, nil
+}
+
+func (c *fakeEC2Client) DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.ToBool(params.DryRun) {
+		return nil, fakeDryRunError()
+	}
+	if _, ok := c.state.Snapshots[aws.ToString(params.SnapshotId)]; !ok {
+		return nil, fakeNotFoundError("InvalidSnapshot.NotFound", aws.ToString(params.SnapshotId))
+	}
+	delete(c.state.Snapshots, aws.ToString(params.SnapshotId))
+	// Fast snapshot restore is disabled along with the snapshot
+	delete(c.state.FastSnapshotRestores, aws.ToString(params.SnapshotId))
+
+	return &ec2.DeleteSnapshotOutput{}, c.persist()
+}
+
+func (c *fakeEC2Client) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range params.Resources {
+		if volume, ok := c.state.Volumes[id]; ok {
+			volume.Tags = setTags(volume.Tags, params.Tags)
+			c.state.Volumes[id] = volume
+		} else if snapshot, ok := c.state.Snapshots[id]; ok {
+			snapshot.Tags = setTags(snapshot.Tags, params.Tags)
+			c.state.Snapshots[id] = snapshot
+		} else {
+			return nil, fakeNotFoundError("InvalidID", id)
+		}
+	}
+
+	return &ec2.CreateTagsOutput{}, c.persist()
+}
+
+func (c *fakeEC2Client) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removeTags := func(existing []types.Tag) []types.Tag {
+		kept := []types.Tag{}
+		for _, tag := range existing {
+			if !slices.ContainsFunc(params.Tags, func(t types.Tag) bool { return aws.ToString(t.Key) == aws.ToString(tag.Key) }) {
+				kept = append(kept, tag)
+			}
+		}
+		return kept
+	}
+	for _, id := range params.Resources {
+		if volume, ok := c.state.Volumes[id]; ok {
+			volume.Tags = removeTags(volume.Tags)
+			c.state.Volumes[id] = volume
+		} else if snapshot, ok := c.state.Snapshots[id]; ok {
+			snapshot.Tags = removeTags(snapshot.Tags)
+			c.state.Snapshots[id] = snapshot
+		} else {
+			return nil, fakeNotFoundError("InvalidID", id)
+		}
+	}
+
+	return &ec2.DeleteTagsOutput{}, c.persist()
+}
+
+func (c *fakeEC2Client) EnableFastSnapshotRestores(ctx context.Context, params *ec2.EnableFastSnapshotRestoresInput, optFns ...func(*ec2.Options)) (*ec2.EnableFastSnapshotRestoresOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	output := &ec2.EnableFastSnapshotRestoresOutput{}
+	for _, id := range params.SourceSnapshotIds {
+		if _, ok := c.state.Snapshots[id]; !ok {
+			return nil, fakeNotFoundError("InvalidSnapshot.NotFound", id)
+		}
+		for _, az := range params.AvailabilityZones {
+			if !slices.Contains(c.state.FastSnapshotRestores[id], az) {
+				c.state.FastSnapshotRestores[id] = append(c.state.FastSnapshotRestores[id], az)
+			}
+			output.Successful = append(output.Successful, types.EnableFastSnapshotRestoreSuccessItem{
+				SnapshotId:       aws.String(id),
+				AvailabilityZone: aws.String(az),
+				State:            types.FastSnapshotRestoreStateCodeEnabled,
+			})
+		}
+	}
+
+	return output, c.persist()
+}
+
+func (c *fakeEC2Client) DisableFastSnapshotRestores(ctx context.Context, params *ec2.DisableFastSnapshotRestoresInput, optFns ...func(*ec2.Options)) (*ec2.DisableFastSnapshotRestoresOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	output := &ec2.DisableFastSnapshotRestoresOutput{}
+	for _, id := range params.SourceSnapshotIds {
+		for _, az := range params.AvailabilityZones {
+			if !slices.Contains(c.state.FastSnapshotRestores[id], az) {
+				continue
+			}
+			c.state.FastSnapshotRestores[id] = slices.DeleteFunc(c.state.FastSnapshotRestores[id], func(enabled string) bool { return enabled == az })
+			output.Successful = append(output.Successful, types.DisableFastSnapshotRestoreSuccessItem{
+				SnapshotId:       aws.String(id),
+				AvailabilityZone: aws.String(az),
+				State:            types.FastSnapshotRestoreStateCodeDisabled,
+			})
+		}
+	}
+
+	return output, c.persist()
+}
+
+func (c *fakeEC2Client) ModifySnapshotAttribute(ctx context.Context, params *ec2.ModifySnapshotAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifySnapshotAttributeOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.state.Snapshots[aws.ToString(params.SnapshotId)]; !ok {
+		return nil, fakeNotFoundError("InvalidSnapshot.NotFound", aws.ToString(params.SnapshotId))
+	}
+	return &ec2.ModifySnapshotAttributeOutput{}, nil
+}
+
+func (c *fakeEC2Client) ModifySnapshotTier(ctx context.Context, params *ec2.ModifySnapshotTierInput, optFns ...func(*ec2.Options)) (*ec2.ModifySnapshotTierOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot, ok := c.state.Snapshots[aws.ToString(params.SnapshotId)]
+	if !ok {
+		return nil, fakeNotFoundError("InvalidSnapshot.NotFound", aws.ToString(params.SnapshotId))
+	}
+	snapshot.StorageTier = types.StorageTierArchive
+	c.state.Snapshots[aws.ToString(params.SnapshotId)] = snapshot
+	return &ec2.ModifySnapshotTierOutput{SnapshotId: params.SnapshotId, TieringStartTime: aws.Time(time.Now())}, c.persist()
+}
+
+// RestoreSnapshotTier restores the snapshot to the standard tier right away, instead of within hours.
+func (c *fakeEC2Client) RestoreSnapshotTier(ctx context.Context, params *ec2.RestoreSnapshotTierInput, optFns ...func(*ec2.Options)) (*ec2.RestoreSnapshotTierOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot, ok := c.state.Snapshots[aws.ToString(params.SnapshotId)]
+	if !ok {
+		return nil, fakeNotFoundError("InvalidSnapshot.NotFound", aws.ToString(params.SnapshotId))
+	}
+	snapshot.StorageTier = types.StorageTierStandard
+	snapshot.RestoreExpiryTime = aws.Time(time.Now().Add(time.Duration(aws.ToInt32(params.TemporaryRestoreDays)) * 24 * time.Hour))
+	c.state.Snapshots[aws.ToString(params.SnapshotId)] = snapshot
+	return &ec2.RestoreSnapshotTierOutput{SnapshotId: params.SnapshotId, RestoreStartTime: aws.Time(time.Now())}, c.persist()
+}
+
+// fakeEventBridgeClient accepts all events without sending them anywhere.
+type fakeEventBridgeClient struct{}
+
+func (fakeEventBridgeClient) PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error) {
+	return &eventbridge.PutEventsOutput{}, nil
+}
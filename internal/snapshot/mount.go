@@ -0,0 +1,73 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	procMountsPath = "/proc/mounts"
+	// mountpointExitNotMounted is the exit code of util-linux `mountpoint` when the path is not a mount point.
+	mountpointExitNotMounted = 32
+)
+
+// isMountPoint returns true if mountPoint is currently a mount point. It relies on the exit code of
+// `mountpoint -q`, and falls back to parsing /proc/mounts if the command is unavailable or fails for another reason.
+func (s *AWSSnapshotter) isMountPoint(ctx context.Context, mountPoint string) (bool, error) {
+	_, err := s.execCommand(ctx, "mountpoint", "-q", mountPoint)
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == mountpointExitNotMounted {
+		return false, nil
+	}
+	s.logger.Warn().Msgf("isMountPoint: mountpoint check for %s failed (%v), falling back to %s", mountPoint, err, procMountsPath)
+
+	data, err := os.ReadFile(procMountsPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", procMountsPath, err)
+	}
+	return procMountsContains(data, mountPoint), nil
+}
+
+// procMountsContains returns true if the /proc/mounts content lists mountPoint as a mount target.
+func procMountsContains(data []byte, mountPoint string) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if unescapeMountField(fields[1]) == mountPoint {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMountField decodes the octal escapes (e.g. \040 for a space) used by the kernel in /proc/mounts.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if v, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
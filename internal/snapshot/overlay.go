@@ -0,0 +1,50 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// Directories of the overlayfs within the volume. Only the upper directory holds cached data.
+const (
+	overlayUpperDir = "upper"
+	overlayWorkDir  = "work"
+)
+
+// overlayMountArgs returns the sudo arguments to mount an overlayfs on target, merging the existing content of lower
+// with the writable upper directory.
+func overlayMountArgs(lower, upper, work, target string) []string {
+	return []string{"mount", "-t", "overlay", "overlay", "-o", fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work), target}
+}
+
+// mountOverlay mounts an overlayfs on path in 'overlay' mode: the existing content of path stays visible as the lower
+// layer, and writes go to the volume mounted at mountPoint, so that the snapshot only captures them.
+func (s *AWSSnapshotter) mountOverlay(ctx context.Context, mountPoint string, path string) error {
+	upper := filepath.Join(mountPoint, overlayUpperDir)
+	work := filepath.Join(mountPoint, overlayWorkDir)
+	if _, err := s.runCommand(ctx, "sudo", "mkdir", "-p", upper, work, path); err != nil {
+		return fmt.Errorf("failed to create overlay directories for %s: %w", path, err)
+	}
+	s.logger.Info().Msgf("mountOverlay: Mounting overlay on %s (upper layer in %s)...", path, upper)
+	if _, err := s.runCommand(ctx, "sudo", overlayMountArgs(path, upper, work, path)...); err != nil {
+		return fmt.Errorf("failed to mount overlay on %s: %w", path, err)
+	}
+	return nil
+}
+
+// unmountOverlay unmounts the overlayfs recorded in the volume info, if any, before the volume itself is unmounted.
+func (s *AWSSnapshotter) unmountOverlay(ctx context.Context, volumeInfo *VolumeInfo) error {
+	if volumeInfo.OverlayPath == "" {
+		return nil
+	}
+	s.logger.Info().Msgf("unmountOverlay: Unmounting overlay %s...", volumeInfo.OverlayPath)
+	if _, err := s.runCommand(ctx, "sudo", "umount", volumeInfo.OverlayPath); err != nil {
+		mounted, checkErr := s.isMountPoint(ctx, volumeInfo.OverlayPath)
+		if checkErr != nil || mounted {
+			return fmt.Errorf("failed to unmount overlay %s: %w", volumeInfo.OverlayPath, err)
+		}
+		s.logger.Warn().Msgf("unmountOverlay: Unmount of %s failed but it seems not mounted anymore: %v", volumeInfo.OverlayPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+// Placeholder IDs for the dry-run calls of the permission check: EC2 checks the permissions before the existence of
+// the resources.
+const (
+	placeholderVolumeID   = "vol-00000000000000000"
+	placeholderSnapshotID = "snap-00000000000000000"
+)
+
+// permissionCheck is a dry-run call checking one EC2 permission required by the action.
+type permissionCheck struct {
+	permission string
+	dryRun     func(ctx context.Context, s *AWSSnapshotter) error
+}
+
+// permissionChecks returns the permissions required by the configured mode.
+func (s *AWSSnapshotter) permissionChecks() []permissionCheck {
+	checks := []permissionCheck{
+		{"ec2:DescribeSnapshots", func(ctx context.Context, s *AWSSnapshotter) error {
+			_, err := s.ec2Client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{OwnerIds: []string{"self"}, DryRun: aws.Bool(true)})
+			return err
+		}},
+		{"ec2:DescribeVolumes", func(ctx context.Context, s *AWSSnapshotter) error {
+			_, err := s.ec2Client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{DryRun: aws.Bool(true)})
+			return err
+		}},
+		// Tags are applied on creation, which also requires ec2:CreateTags
+		{"ec2:CreateVolume", func(ctx context.Context, s *AWSSnapshotter) error {
+			_, err := s.ec2Client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+				AvailabilityZone: aws.String(s.config.Az),
+				VolumeType:       s.config.VolumeType,
+				Size:             aws.Int32(s.config.VolumeSize),
+				TagSpecifications: []types.TagSpecification{
+					{ResourceType: types.ResourceTypeVolume, Tags: s.defaultTags()},
+				},
+				DryRun: aws.Bool(true),
+			})
+			return err
+		}},
+		{"ec2:AttachVolume", func(ctx context.Context, s *AWSSnapshotter) error {
+			_, err := s.ec2Client.AttachVolume(ctx, &ec2.AttachVolumeInput{
+				VolumeId:   aws.String(placeholderVolumeID),
+				InstanceId: aws.String(s.config.InstanceID),
+				Device:     aws.String(suggestedDeviceName),
+				DryRun:     aws.Bool(true),
+			})
+			return err
+		}},
+		{"ec2:DetachVolume", func(ctx context.Context, s *AWSSnapshotter) error {
+			_, err := s.ec2Client.DetachVolume(ctx, &ec2.DetachVolumeInput{
+				VolumeId:   aws.String(placeholderVolumeID),
+				InstanceId: aws.String(s.config.InstanceID),
+				DryRun:     aws.Bool(true),
+			})
+			return err
+		}},
+	}
+	if s.config.Mode == runsOnConfig.ModePersistentVolume || !s.config.Save {
+		return checks
+	}
+	return append(checks,
+		permissionCheck{"ec2:CreateSnapshot", func(ctx context.Context, s *AWSSnapshotter) error {
+			_, err := s.ec2Client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+				VolumeId: aws.String(placeholderVolumeID),
+				TagSpecifications: []types.TagSpecification{
+					{ResourceType: types.ResourceTypeSnapshot, Tags: s.defaultTags()},
+				},
+				DryRun: aws.Bool(true),
+			})
+			return err
+		}},
+		permissionCheck{"ec2:DeleteVolume", func(ctx context.Context, s *AWSSnapshotter) error {
+			_, err := s.ec2Client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(placeholderVolumeID), DryRun: aws.Bool(true)})
+			return err
+		}},
+		permissionCheck{"ec2:DeleteSnapshot", func(ctx context.Context, s *AWSSnapshotter) error {
+			_, err := s.ec2Client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(placeholderSnapshotID), DryRun: aws.Bool(true)})
+			return err
+		}},
+	)
+}
+
+// CheckPermissions checks with dry-run calls that the instance is allowed to perform the EC2 operations of the action,
+// so that missing permissions are reported upfront instead of failing halfway through with raw AWS errors. Checks
+// that cannot be concluded (e.g. throttling) are logged and ignored.
+func (s *AWSSnapshotter) CheckPermissions(ctx context.Context) error {
+	s.logger.Info().Msgf("CheckPermissions: Checking EC2 permissions with dry-run calls...")
+	missing := []string{}
+	for _, check := range s.permissionChecks() {
+		granted, err := dryRunGranted(check.dryRun(ctx, s))
+		if err != nil {
+			s.logger.Warn().Msgf("Warning: Unable to check permission %s: %v", check.permission, err)
+		} else if !granted {
+			missing = append(missing, check.permission)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the instance profile is missing the following permissions: %s. Add them to the IAM role of the instance, or set 'check_permissions' to false to skip this check", strings.Join(missing, ", "))
+	}
+	s.logger.Info().Msgf("CheckPermissions: All EC2 permissions are granted.")
+	return nil
+}
+
+// dryRunGranted maps the error of a dry-run call to whether the permission is granted. DryRunOperation means that the
+// call would have succeeded, and UnauthorizedOperation that the permission is missing. Errors about the placeholder
+// resources imply that the permission check passed. Other errors are returned.
+func dryRunGranted(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false, err
+	}
+	switch code := apiErr.ErrorCode(); {
+	case code == "DryRunOperation":
+		return true, nil
+	case code == "UnauthorizedOperation" || code == "AccessDenied" || code == "AccessDeniedException":
+		return false, nil
+	case strings.HasSuffix(code, ".NotFound") || strings.HasSuffix(code, ".Malformed") || code == "IncorrectState" || code == "VolumeInUse":
+		return true, nil
+	default:
+		return false, err
+	}
+}
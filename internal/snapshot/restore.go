@@ -2,99 +2,133 @@ package snapshot
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
 	"github.com/runs-on/snapshot/internal/utils"
 )
 
+// ErrCacheMiss is returned by RestoreSnapshot when no usable snapshot is found and 'fail_on_cache_miss' is set.
+var ErrCacheMiss = errors.New("no usable snapshot found (cache miss)")
+
+// Parameters used to compute the volume initialization rate automatically
+const (
+	autoInitializationMinSnapshotSizeGiB int32 = 100
+	autoInitializationTargetSeconds      int32 = 600
+)
+
+// keepVolumeOnFailureDuration is how long a volume kept for debugging after a failed restore survives before being reaped.
+const keepVolumeOnFailureDuration = 2 * time.Hour
+
+// restoreCleanupTimeout bounds the cleanup of the volume after a failed restore, which must also run when the restore
+// was cancelled.
+const restoreCleanupTimeout = 1 * time.Minute
+
 // RestoreSnapshot finds the latest snapshot for the current git branch,
 // creates a volume from it (or a new volume if no snapshot exists),
 // attaches it to the instance, and mounts it to the specified mountPoint.
-func (s *AWSSnapshotter) RestoreSnapshot(ctx context.Context, mountPoint string) (*RestoreSnapshotOutput, error) {
+// The named error result is inspected by the deferred cleanup, so that any failure after the volume creation is handled.
+func (s *AWSSnapshotter) RestoreSnapshot(ctx context.Context, mountPoint string) (_ *RestoreSnapshotOutput, err error) {
 	gitBranch := s.config.GithubRef
 	s.logger.Info().Msgf("RestoreSnapshot: Using git ref: %s", gitBranch)
 
-	var err error
-
 	var newVolume *types.Volume
+	var actualDeviceName string
 	var volumeIsNewAndUnformatted bool
-	// 1. Find latest snapshot for branch
-	filters := []types.Filter{
-		{Name: aws.String("status"), Values: []string{string(types.SnapshotStateCompleted)}},
-	}
-	for _, tag := range s.defaultTags() {
-		filters = append(filters, types.Filter{Name: aws.String(fmt.Sprintf("tag:%s", *tag.Key)), Values: []string{*tag.Value}})
-	}
-	s.logger.Info().Msgf("RestoreSnapshot: Searching for the latest snapshot for branch: %s and filters: %s", gitBranch, utils.PrettyPrint(filters))
-	snapshotsOutput, err := s.ec2Client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
-		Filters:  filters,
-		OwnerIds: []string{"self"}, // Or specific account ID if needed
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to describe snapshots for branch %s: %w", gitBranch, err)
-	}
-
+	var volumeIsExisting bool
+	var volumeIsKept bool
+	var volumeIsAttaching bool
+	var volumeIsMounted bool
 	var latestSnapshot *types.Snapshot
-	if len(snapshotsOutput.Snapshots) > 0 {
-		// Find most recent snapshot by comparing timestamps
-		latestSnapshot = &snapshotsOutput.Snapshots[0]
-		for _, snap := range snapshotsOutput.Snapshots {
-			if snapTime := snap.StartTime; snapTime.After(*latestSnapshot.StartTime) {
-				latestSnapshot = &snap
-			}
+	if s.config.MultiAttach {
+		// 1a. Reuse the multi-attach volume already shared by other runners, if any
+		newVolume, err = s.findMultiAttachVolume(ctx)
+		if err != nil {
+			return nil, err
 		}
-		s.logger.Info().Msgf("RestoreSnapshot: Found latest snapshot %s for branch %s", *latestSnapshot.SnapshotId, gitBranch)
-	} else if s.config.RunnerConfig.DefaultBranch != "" {
-		// Try finding snapshot from default branch
-		if err := replaceFilterValues(filters, "tag:"+snapshotTagKeyBranch, []string{s.getSnapshotTagValueDefaultBranch()}); err != nil {
-			return nil, fmt.Errorf("failed to find default branch filter: %w", err)
+		volumeIsExisting = newVolume != nil
+	} else if s.config.Mode == runsOnConfig.ModePersistentVolume {
+		// 1a. Reuse the persistent volume of the branch, if any
+		newVolume, err = s.findPersistentVolume(ctx)
+		if err != nil {
+			return nil, err
 		}
-
-		s.logger.Info().Msgf("RestoreSnapshot: No snapshot found for branch %s, trying default branch %s with filters: %s", gitBranch, s.config.RunnerConfig.DefaultBranch, utils.PrettyPrint(filters))
-
-		defaultBranchSnapshotsOutput, err := s.ec2Client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
-			Filters:  filters,
-			OwnerIds: []string{"self"},
-		})
+		volumeIsExisting = newVolume != nil
+	} else if s.config.ReuseVolumes && s.config.SnapshotID == "" && !s.skipKeptVolumes {
+		// 1a. Reuse a volume kept after snapshotting by a previous run of the branch, if any
+		newVolume, err = s.findKeptVolume(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to describe snapshots for default branch %s: %w", s.config.RunnerConfig.DefaultBranch, err)
+			return nil, err
 		}
+		volumeIsExisting = newVolume != nil
+		volumeIsKept = volumeIsExisting
+	}
 
-		if len(defaultBranchSnapshotsOutput.Snapshots) > 0 {
-			latestSnapshot = &defaultBranchSnapshotsOutput.Snapshots[0]
-			for _, snap := range defaultBranchSnapshotsOutput.Snapshots {
-				if snapTime := snap.StartTime; snapTime.After(*latestSnapshot.StartTime) {
-					latestSnapshot = &snap
-				}
-			}
-			s.logger.Info().Msgf("RestoreSnapshot: Found latest snapshot %s from default branch %s", *latestSnapshot.SnapshotId, s.config.RunnerConfig.DefaultBranch)
-		} else {
-			s.logger.Info().Msgf("RestoreSnapshot: No existing snapshot found for branch %s or default branch %s. A new volume will be created.", gitBranch, s.config.RunnerConfig.DefaultBranch)
+	if !volumeIsExisting && s.config.SnapshotID != "" {
+		// 1. Use the pinned snapshot, bypassing the tag-based search
+		latestSnapshot, err = s.findSnapshotByID(ctx, s.config.SnapshotID)
+		if err != nil {
+			return nil, err
+		}
+	} else if !volumeIsExisting {
+		// 1. Find latest snapshot for branch
+		latestSnapshot, err = s.findLatestSnapshot(ctx)
+		if err != nil {
+			return nil, err
 		}
 	}
+	if latestSnapshot != nil {
+		s.logger.Info().Msgf("RestoreSnapshot: Selected snapshot %s (%s) with tags: %s", *latestSnapshot.SnapshotId, s.snapshotMatch(latestSnapshot), utils.PrettyPrint(tagMap(latestSnapshot.Tags)))
+	}
 
 	commonVolumeTags := append(s.defaultTags(), []types.Tag{
 		{Key: aws.String(nameTagKey), Value: aws.String(s.config.VolumeName)},
-		{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(time.Duration(defaultVolumeLifeDurationMinutes)*time.Minute).Unix()))},
 	}...)
+	if s.config.Mode == runsOnConfig.ModePersistentVolume {
+		// Persistent volumes must not be reaped, so no TTL tag
+		commonVolumeTags = append(commonVolumeTags, types.Tag{Key: aws.String(snapshotTagKeyMode), Value: aws.String(runsOnConfig.ModePersistentVolume)})
+	} else {
+		commonVolumeTags = append(commonVolumeTags, types.Tag{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(time.Duration(defaultVolumeLifeDurationMinutes)*time.Minute).Unix()))})
+	}
 
 	s.logger.Info().Msgf("RestoreSnapshot: common volume tags: %s", utils.PrettyPrint(commonVolumeTags))
 
-	// Use snapshot only if its size is at least the default volume size, otherwise create a new volume
-	// TODO: maybe just expand the volume size to snapshot size + 10GB, and resize disk
-	if latestSnapshot != nil && latestSnapshot.VolumeSize != nil && *latestSnapshot.VolumeSize >= s.config.VolumeSize {
+	// Restore snapshots smaller than the requested volume size at that size, growing their filesystem, so that the cache
+	// is kept while guaranteeing the working space. With 'grow_to_snapshot' disabled, create a new volume instead.
+	snapshotIsUsable := latestSnapshot != nil && latestSnapshot.VolumeSize != nil && (*latestSnapshot.VolumeSize >= s.config.VolumeSize || s.config.GrowToSnapshot)
+	if latestSnapshot != nil && !snapshotIsUsable {
+		s.logger.Warn().Msgf("Warning: Snapshot %s (%d GiB) is smaller than the requested volume size (%d GiB), so it is not restored and a blank volume is created instead, since 'grow_to_snapshot' is disabled. Enable it to restore the snapshot and grow its filesystem, or lower 'volume_size' to %d GiB to keep using it.", *latestSnapshot.SnapshotId, aws.ToInt32(latestSnapshot.VolumeSize), s.config.VolumeSize, aws.ToInt32(latestSnapshot.VolumeSize))
+	}
+	// The filesystem of a snapshot smaller than the volume only covers the size of the snapshot
+	growFilesystem := snapshotIsUsable && !volumeIsExisting && aws.ToInt32(latestSnapshot.VolumeSize) < s.config.VolumeSize
+	if !volumeIsExisting && !snapshotIsUsable && s.config.FailOnCacheMiss {
+		// The blank volume is warmed from the S3 fallback below, so a tarball is not a cache miss
+		if !s.s3Enabled() || s.config.ReadOnly || !s.s3ObjectExists(ctx) {
+			return nil, ErrCacheMiss
+		}
+		s.logger.Info().Msgf("RestoreSnapshot: No usable snapshot found, but a tarball exists at %s.", s.s3ObjectURI())
+	}
+
+	if volumeIsExisting {
+		volumeIsNewAndUnformatted = false // Shared volume is already formatted by the runner that created it
+		s.logger.Info().Msgf("RestoreSnapshot: Reusing existing volume %s", *newVolume.VolumeId)
+	} else if snapshotIsUsable {
 		// 2. Create Volume from Snapshot
-		s.logger.Info().Msgf("RestoreSnapshot: Creating volume from snapshot %s", *latestSnapshot.SnapshotId)
+		s.logger.Info().Msgf("RestoreSnapshot: Creating volume from snapshot %s in %s", *latestSnapshot.SnapshotId, s.config.Az)
 		createVolumeInput := &ec2.CreateVolumeInput{
 			SnapshotId:       latestSnapshot.SnapshotId,
 			AvailabilityZone: aws.String(s.config.Az),
 			VolumeType:       s.config.VolumeType,
-			Iops:             aws.Int32(s.config.VolumeIops),
+			Iops:             s.volumeIops(),
 			TagSpecifications: []types.TagSpecification{
 				{ResourceType: types.ResourceTypeVolume, Tags: commonVolumeTags},
 			},
@@ -103,24 +137,33 @@ func (s *AWSSnapshotter) RestoreSnapshot(ctx context.Context, mountPoint string)
 		if s.config.VolumeType == types.VolumeTypeGp3 {
 			createVolumeInput.Throughput = aws.Int32(s.config.VolumeThroughput)
 		}
-		if s.config.VolumeInitializationRate > 0 {
-			createVolumeInput.VolumeInitializationRate = aws.Int32(s.config.VolumeInitializationRate)
+		if s.config.MultiAttach {
+			createVolumeInput.MultiAttachEnabled = aws.Bool(true)
+		}
+		s.applyEncryption(createVolumeInput)
+		if snapshotSize := aws.ToInt32(latestSnapshot.VolumeSize); snapshotSize > s.config.VolumeSize {
+			s.logger.Info().Msgf("RestoreSnapshot: Snapshot %s (%d GiB) is larger than the requested volume size (%d GiB), using the snapshot size", *latestSnapshot.SnapshotId, snapshotSize, s.config.VolumeSize)
 		}
-		createVolumeOutput, err := s.ec2Client.CreateVolume(ctx, createVolumeInput)
+		// A volume cannot be smaller than its snapshot
+		createVolumeInput.Size = aws.Int32(max(aws.ToInt32(latestSnapshot.VolumeSize), s.config.VolumeSize))
+		if rate := s.volumeInitializationRate(latestSnapshot); rate > 0 {
+			createVolumeInput.VolumeInitializationRate = aws.Int32(rate)
+		}
+		createVolumeOutput, err := s.createVolume(ctx, createVolumeInput)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create volume from snapshot %s: %w", *latestSnapshot.SnapshotId, err)
 		}
-		newVolume = &types.Volume{VolumeId: createVolumeOutput.VolumeId}
+		newVolume = &types.Volume{VolumeId: createVolumeOutput.VolumeId, Size: createVolumeOutput.Size}
 		volumeIsNewAndUnformatted = false // Volume from snapshot is already formatted
 		s.logger.Info().Msgf("RestoreSnapshot: Created volume %s from snapshot %s", *newVolume.VolumeId, *latestSnapshot.SnapshotId)
 	} else {
 		// 3. No snapshot found, create a new volume
-		s.logger.Info().Msgf("RestoreSnapshot: Creating a new blank volume")
+		s.logger.Info().Msgf("RestoreSnapshot: Creating a new blank volume in %s", s.config.Az)
 		createVolumeInput := &ec2.CreateVolumeInput{
 			AvailabilityZone: aws.String(s.config.Az),
 			VolumeType:       s.config.VolumeType,
 			Size:             aws.Int32(s.config.VolumeSize),
-			Iops:             aws.Int32(s.config.VolumeIops),
+			Iops:             s.volumeIops(),
 			TagSpecifications: []types.TagSpecification{
 				{ResourceType: types.ResourceTypeVolume, Tags: commonVolumeTags},
 			},
@@ -129,11 +172,15 @@ func (s *AWSSnapshotter) RestoreSnapshot(ctx context.Context, mountPoint string)
 		if s.config.VolumeType == types.VolumeTypeGp3 {
 			createVolumeInput.Throughput = aws.Int32(s.config.VolumeThroughput)
 		}
-		createVolumeOutput, err := s.ec2Client.CreateVolume(ctx, createVolumeInput)
+		if s.config.MultiAttach {
+			createVolumeInput.MultiAttachEnabled = aws.Bool(true)
+		}
+		s.applyEncryption(createVolumeInput)
+		createVolumeOutput, err := s.createVolume(ctx, createVolumeInput)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create new volume: %w", err)
 		}
-		newVolume = &types.Volume{VolumeId: createVolumeOutput.VolumeId}
+		newVolume = &types.Volume{VolumeId: createVolumeOutput.VolumeId, Size: createVolumeOutput.Size}
 		volumeIsNewAndUnformatted = true // New volume needs formatting
 		s.logger.Info().Msgf("RestoreSnapshot: Created new blank volume %s", *newVolume.VolumeId)
 	}
@@ -142,7 +189,35 @@ func (s *AWSSnapshotter) RestoreSnapshot(ctx context.Context, mountPoint string)
 		s.logger.Info().Msgf("RestoreSnapshot: Deferring cleanup of volume %s", *newVolume.VolumeId)
 		if err != nil {
 			s.logger.Error().Msgf("RestoreSnapshot: Error: %v", err)
-			if newVolume != nil {
+			// The restore may have failed because ctx was cancelled, which must not prevent the cleanup
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), restoreCleanupTimeout)
+			defer cancel()
+			if volumeIsExisting {
+				s.logger.Info().Msgf("RestoreSnapshot: Not deleting volume %s since it was not created by this run", *newVolume.VolumeId)
+			} else if s.config.KeepVolumeOnFailure {
+				s.logger.Warn().Msgf("RestoreSnapshot: Keeping volume %s (device: %s) for debugging, as requested by 'keep_volume_on_failure'. It will be deleted after %s.", *newVolume.VolumeId, actualDeviceName, keepVolumeOnFailureDuration)
+				_, err := s.ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+					Resources: []string{*newVolume.VolumeId},
+					Tags: []types.Tag{
+						{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(keepVolumeOnFailureDuration).Unix()))},
+					},
+				})
+				if err != nil {
+					s.logger.Warn().Msgf("RestoreSnapshot: Failed to update TTL tag on volume %s: %v", *newVolume.VolumeId, err)
+				}
+			} else if newVolume != nil {
+				if volumeIsMounted {
+					if _, err := s.runCommand(ctx, "sudo", "umount", mountPoint); err != nil {
+						volumeIsAttaching = false // Never detach a mounted volume
+					}
+				}
+				if volumeIsAttaching {
+					// The attach may have gone through, so the volume must be detached before it can be deleted
+					s.logger.Info().Msgf("RestoreSnapshot: Detaching volume %s", *newVolume.VolumeId)
+					if err := s.detachVolumeAndWait(ctx, &VolumeInfo{VolumeID: *newVolume.VolumeId}, true); err != nil {
+						s.logger.Error().Msgf("RestoreSnapshot: Error detaching volume %s: %v", *newVolume.VolumeId, err)
+					}
+				}
 				s.logger.Info().Msgf("RestoreSnapshot: Deleting volume %s", *newVolume.VolumeId)
 				_, err := s.ec2Client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: newVolume.VolumeId})
 				if err != nil {
@@ -152,83 +227,121 @@ func (s *AWSSnapshotter) RestoreSnapshot(ctx context.Context, mountPoint string)
 		}
 	}()
 
-	// 4. Wait for volume to be 'available'
-	s.logger.Info().Msgf("RestoreSnapshot: Waiting for volume %s to become available...", *newVolume.VolumeId)
-	volumeAvailableWaiter := ec2.NewVolumeAvailableWaiter(s.ec2Client, defaultVolumeAvailableWaiterOptions)
-	if err := volumeAvailableWaiter.Wait(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{*newVolume.VolumeId}}, defaultVolumeAvailableMaxWaitTime); err != nil {
-		return nil, fmt.Errorf("volume %s did not become available in time: %w", *newVolume.VolumeId, err)
+	// 4. Wait for volume to be 'available' (an existing volume is already usable, and may be in-use by other runners)
+	if !volumeIsExisting {
+		s.logger.Info().Msgf("RestoreSnapshot: Waiting for volume %s to become available...", *newVolume.VolumeId)
+		volumeAvailableWaiter := ec2.NewVolumeAvailableWaiter(s.ec2Client, defaultVolumeAvailableWaiterOptions)
+		err := s.waitWithHeartbeat(ctx, "RestoreSnapshot", s.volumeState(*newVolume.VolumeId), func() error {
+			return volumeAvailableWaiter.Wait(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{*newVolume.VolumeId}}, defaultVolumeAvailableMaxWaitTime)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("volume %s did not become available in time: %w", *newVolume.VolumeId, err)
+		}
+		s.logger.Info().Msgf("RestoreSnapshot: Volume %s is available.", *newVolume.VolumeId)
 	}
-	s.logger.Info().Msgf("RestoreSnapshot: Volume %s is available.", *newVolume.VolumeId)
 
 	// 5. Attach Volume
-	s.logger.Info().Msgf("RestoreSnapshot: Attaching volume %s to instance %s as %s", *newVolume.VolumeId, s.config.InstanceID, suggestedDeviceName)
+	deviceName := suggestedDeviceName
+	if s.config.DeviceName != "" {
+		deviceName = s.config.DeviceName
+	}
+	s.logger.Info().Msgf("RestoreSnapshot: Attaching volume %s to instance %s as %s", *newVolume.VolumeId, s.config.InstanceID, deviceName)
+	volumeIsAttaching = true
 	attachOutput, err := s.ec2Client.AttachVolume(ctx, &ec2.AttachVolumeInput{
-		Device:     aws.String(suggestedDeviceName),
+		Device:     aws.String(deviceName),
 		InstanceId: aws.String(s.config.InstanceID),
 		VolumeId:   newVolume.VolumeId,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to attach volume %s to instance %s: %w", *newVolume.VolumeId, s.config.InstanceID, err)
+		device, attached := s.attachedDevice(ctx, *newVolume.VolumeId, err)
+		if !attached && volumeIsKept {
+			// Another runner may have attached the same kept volume in the meantime
+			s.logger.Warn().Msgf("RestoreSnapshot: Failed to attach kept volume %s (%v), restoring from snapshot instead", *newVolume.VolumeId, err)
+			s.skipKeptVolumes = true
+			return s.RestoreSnapshot(ctx, mountPoint)
+		}
+		if !attached {
+			return nil, fmt.Errorf("failed to attach volume %s to instance %s: %w", *newVolume.VolumeId, s.config.InstanceID, err)
+		}
+		s.logger.Warn().Msgf("RestoreSnapshot: Attach of volume %s failed (%v), but it is already attached to this instance as %s. Continuing.", *newVolume.VolumeId, err, device)
+		attachOutput = &ec2.AttachVolumeOutput{Device: aws.String(device)}
 	}
-	actualDeviceName := *attachOutput.Device
+	actualDeviceName = *attachOutput.Device
 	s.logger.Info().Msgf("RestoreSnapshot: Volume %s attach initiated, device hint: %s. Waiting for attachment...", *newVolume.VolumeId, actualDeviceName)
 
 	volumeInUseWaiter := ec2.NewVolumeInUseWaiter(s.ec2Client, defaultVolumeInUseWaiterOptions)
-	err = volumeInUseWaiter.Wait(ctx, &ec2.DescribeVolumesInput{
-		VolumeIds: []string{*newVolume.VolumeId},
-		Filters: []types.Filter{
-			{
-				Name:   aws.String("attachment.status"),
-				Values: []string{"attached"},
+	err = s.waitWithHeartbeat(ctx, "RestoreSnapshot", s.volumeState(*newVolume.VolumeId), func() error {
+		return volumeInUseWaiter.Wait(ctx, &ec2.DescribeVolumesInput{
+			VolumeIds: []string{*newVolume.VolumeId},
+			Filters: []types.Filter{
+				{
+					Name:   aws.String("attachment.status"),
+					Values: []string{"attached"},
+				},
 			},
-		},
-	}, defaultVolumeInUseMaxWaitTime)
+		}, defaultVolumeInUseMaxWaitTime)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("volume %s did not attach successfully and current state unknown: %w", *newVolume.VolumeId, err)
 	}
 	// Fetch volume details again to confirm device name, as the attachOutput.Device might be a suggestion
 	// and the waiter confirms attachment, not necessarily the final device name if it changed.
-	descVolOutput, descErr := s.ec2Client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{*newVolume.VolumeId}})
+	// Multi-attach volumes are also attached to other instances, whose device names may differ.
+	descVolOutput, descErr := s.describeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{*newVolume.VolumeId}})
+	if descErr != nil {
+		return nil, fmt.Errorf("volume %s did not attach successfully and current state unknown: %w", *newVolume.VolumeId, descErr)
+	}
+	if len(descVolOutput.Volumes) == 0 {
+		return nil, fmt.Errorf("volume %s did not attach successfully and current state unknown: volume not found", *newVolume.VolumeId)
+	}
 	s.logger.Info().Msgf("RestoreSnapshot: Volume %s attachments: %v", *newVolume.VolumeId, descVolOutput.Volumes[0].Attachments)
-	if descErr == nil && len(descVolOutput.Volumes) > 0 && len(descVolOutput.Volumes[0].Attachments) > 0 {
-		actualDeviceName = *descVolOutput.Volumes[0].Attachments[0].Device
-	} else {
-		return nil, fmt.Errorf("volume %s did not attach successfully and current state unknown: %w", *newVolume.VolumeId, err)
+	attachment, ok := instanceAttachment(descVolOutput.Volumes[0].Attachments, s.config.InstanceID)
+	if !ok {
+		return nil, fmt.Errorf("volume %s did not attach successfully: no attachment to instance %s", *newVolume.VolumeId, s.config.InstanceID)
 	}
+	actualDeviceName = aws.ToString(attachment.Device)
 	s.logger.Info().Msgf("RestoreSnapshot: Volume %s attached as %s.", *newVolume.VolumeId, actualDeviceName)
-
-	if strings.HasPrefix(mountPoint, "/var/lib/docker") {
-		// 6. Mounting & Docker
-		s.logger.Info().Msgf("RestoreSnapshot: Stopping docker service...")
-		if _, err := s.runCommand(ctx, "sudo", "systemctl", "stop", "docker"); err != nil {
-			s.logger.Warn().Msgf("RestoreSnapshot: failed to stop docker (may not be running or installed): %v", err)
-
-		}
+	if volumeIsKept {
+		s.claimKeptVolume(ctx, *newVolume.VolumeId)
 	}
 
-	s.logger.Info().Msgf("RestoreSnapshot: Attempting to unmount %s (defensive)", mountPoint)
-	if _, err := s.runCommand(ctx, "sudo", "umount", mountPoint); err != nil {
-		s.logger.Warn().Msgf("RestoreSnapshot: Defensive unmount of %s failed (likely not mounted): %v", mountPoint, err)
+	// Safety net in case the selection filters were bypassed (e.g. pinned snapshot, custom tags)
+	if volumeIsExisting {
+		err = s.checkArch(newVolume.Tags, "volume "+*newVolume.VolumeId)
+	} else if snapshotIsUsable {
+		err = s.checkArch(latestSnapshot.Tags, "snapshot "+*latestSnapshot.SnapshotId)
 	}
-
-	// display disk configuration
-	s.logger.Info().Msgf("RestoreSnapshot: Displaying disk configuration...")
-
-	// actual device name is the last entry from `lsblk -d -n -o PATH,MODEL` that has a MODEL = 'Amazon Elastic Block Store'
-	lsblkOutput, err := s.runCommand(ctx, "lsblk", "-d", "-n", "-o", "PATH,MODEL")
 	if err != nil {
-		s.logger.Warn().Msgf("RestoreSnapshot: Failed to display disk configuration: %v", err)
+		return nil, err
 	}
-	for _, line := range strings.Split(strings.TrimSpace(string(lsblkOutput)), "\n") {
-		s.logger.Info().Msgf("RestoreSnapshot: lsblk output: %s", line)
-		fields := strings.SplitN(line, " ", 2)
-		s.logger.Info().Msgf("RestoreSnapshot: fields: %v", fields)
-		// first volume is the root volume, so we need to skip it
-		if len(fields) > 1 && fields[1] == "Amazon Elastic Block Store" {
-			s.logger.Info().Msgf("RestoreSnapshot: Found volume: %s", fields[0])
-			actualDeviceName = fields[0]
+
+	runtime := s.managedRuntime(mountPoint)
+	if runtime != nil && !s.config.ManageRuntime {
+		s.logger.Info().Msgf("RestoreSnapshot: Leaving %s service as is, as requested by 'manage_runtime'.", runtime.service)
+		runtime = nil
+	}
+	if runtime != nil {
+		// 6. Mounting & container runtime
+		if !s.serviceIsActive(ctx, runtime.service) {
+			// Only restart the service after mounting if it was running before
+			s.logger.Info().Msgf("RestoreSnapshot: %s service is not running, it will not be started after mounting.", runtime.service)
+			runtime = nil
+		} else {
+			s.logger.Info().Msgf("RestoreSnapshot: Stopping %s service...", runtime.service)
+			if _, err := s.runCommand(ctx, "sudo", "systemctl", "stop", runtime.service); err != nil {
+				s.logger.Warn().Msgf("RestoreSnapshot: failed to stop %s: %v", runtime.service, err)
+			}
 		}
 	}
+
+	if !s.config.RawDevice {
+		s.logger.Info().Msgf("RestoreSnapshot: Attempting to unmount %s (defensive)", mountPoint)
+		if _, err := s.runCommand(ctx, "sudo", "umount", mountPoint); err != nil {
+			s.logger.Warn().Msgf("RestoreSnapshot: Defensive unmount of %s failed (likely not mounted): %v", mountPoint, err)
+		}
+	}
+
+	actualDeviceName = s.localDeviceName(ctx, *newVolume.VolumeId, actualDeviceName)
 	s.logger.Info().Msgf("RestoreSnapshot: Actual device name: %s", actualDeviceName)
 
 	// Save volume info to JSON file
@@ -237,17 +350,53 @@ func (s *AWSSnapshotter) RestoreSnapshot(ctx context.Context, mountPoint string)
 		DeviceName: actualDeviceName,
 		MountPoint: mountPoint,
 		NewVolume:  volumeIsNewAndUnformatted,
+		RawDevice:  s.config.RawDevice,
 	}
 	if err := s.saveVolumeInfo(volumeInfo); err != nil {
 		s.logger.Warn().Msgf("RestoreSnapshot: Failed to save volume info: %v", err)
 	}
 
+	if s.config.RawDevice {
+		s.logger.Info().Msgf("RestoreSnapshot: Volume %s is available as raw device %s. Not formatting nor mounting it, as requested by 'raw_device'.", *newVolume.VolumeId, actualDeviceName)
+		s.recordWriteSignature(ctx, volumeInfo, volumeIsNewAndUnformatted)
+		return s.restoreSnapshotOutput(newVolume, actualDeviceName, volumeIsNewAndUnformatted, latestSnapshot), nil
+	}
+
+	// Snapshots of partitioned disks hold the filesystem in a partition instead of the whole device
+	fsDevice := actualDeviceName
+	if !volumeIsNewAndUnformatted {
+		if partition := s.dataPartition(ctx, actualDeviceName); partition != "" {
+			s.logger.Info().Msgf("RestoreSnapshot: Device %s is partitioned, using its data partition %s.", actualDeviceName, partition)
+			fsDevice = partition
+			if growFilesystem {
+				s.logger.Warn().Msgf("Warning: Not growing the filesystem of partition %s, as growing partitions is not supported. Only the size of the snapshot is usable.", partition)
+				growFilesystem = false
+			}
+		}
+	}
+
+	filesystem := s.config.Filesystem
 	if volumeIsNewAndUnformatted {
-		s.logger.Info().Msgf("RestoreSnapshot: Formatting new volume %s (%s) with ext4...", *newVolume.VolumeId, actualDeviceName)
-		if _, err := s.runCommand(ctx, "sudo", "mkfs.ext4", "-F", actualDeviceName); err != nil { // -F to force if already formatted by mistake or small
-			return nil, fmt.Errorf("failed to format device %s: %w", actualDeviceName, err)
+		s.logger.Info().Msgf("RestoreSnapshot: Formatting new volume %s (%s) with %s...", *newVolume.VolumeId, fsDevice, filesystem)
+		if _, err := s.runCommand(ctx, "sudo", formatCommand(filesystem, fsDevice, s.config.FilesystemLabel, s.config.MkfsOptions)...); err != nil {
+			return nil, fmt.Errorf("failed to format device %s: %w", fsDevice, err)
+		}
+		s.logger.Info().Msgf("RestoreSnapshot: Device %s formatted.", fsDevice)
+	} else if detected := s.detectFilesystem(ctx, fsDevice); detected != "" {
+		s.logger.Info().Msgf("RestoreSnapshot: Detected %s filesystem on %s.", detected, fsDevice)
+		if s.reformatOnMismatch(detected) {
+			s.logger.Warn().Msgf("Warning: Volume %s has a %s filesystem instead of %s. Reformatting it with %s as requested by 'reformat_on_mismatch': ITS CONTENT IS LOST, and the job starts from a blank volume.", *newVolume.VolumeId, detected, filesystem, filesystem)
+			if _, err := s.runCommand(ctx, "sudo", formatCommand(filesystem, fsDevice, s.config.FilesystemLabel, s.config.MkfsOptions)...); err != nil {
+				return nil, fmt.Errorf("failed to reformat device %s: %w", fsDevice, err)
+			}
+			s.logger.Info().Msgf("RestoreSnapshot: Device %s reformatted.", fsDevice)
+			volumeIsNewAndUnformatted = true
+			growFilesystem = false
+			s.markVolumeReformatted(volumeInfo)
+		} else {
+			// Mount with the options matching the filesystem of the snapshot, which may differ from the configured one
+			filesystem = detected
 		}
-		s.logger.Info().Msgf("RestoreSnapshot: Device %s formatted.", actualDeviceName)
 	}
 
 	s.logger.Info().Msgf("RestoreSnapshot: Creating mount point %s if it doesn't exist...", mountPoint)
@@ -255,32 +404,505 @@ func (s *AWSSnapshotter) RestoreSnapshot(ctx context.Context, mountPoint string)
 		return nil, fmt.Errorf("failed to create mount point %s: %w", mountPoint, err)
 	}
 
-	s.logger.Info().Msgf("RestoreSnapshot: Mounting %s to %s...", actualDeviceName, mountPoint)
-	if _, err := s.runCommand(ctx, "sudo", "mount", actualDeviceName, mountPoint); err != nil {
-		return nil, fmt.Errorf("failed to mount %s to %s: %w", actualDeviceName, mountPoint, err)
+	s.logger.Info().Msgf("RestoreSnapshot: Mounting %s to %s...", fsDevice, mountPoint)
+	if _, err := s.runCommand(ctx, "sudo", s.mountCommand(filesystem, fsDevice, mountPoint)...); err != nil {
+		if volumeIsNewAndUnformatted || !s.config.ForceFormatOnMountFailure || s.config.ReadOnly {
+			return nil, fmt.Errorf("failed to mount %s to %s: %w", fsDevice, mountPoint, err)
+		}
+		s.logger.Warn().Msgf("Warning: Failed to mount %s to %s: %v. Its filesystem may be corrupted: reformatting it with %s as requested by 'force_format_on_mount_failure'. THE CACHE IS DISCARDED, and the job starts from a blank volume.", fsDevice, mountPoint, err, s.config.Filesystem)
+		filesystem = s.config.Filesystem
+		if _, err := s.runCommand(ctx, "sudo", formatCommand(filesystem, fsDevice, s.config.FilesystemLabel, s.config.MkfsOptions)...); err != nil {
+			return nil, fmt.Errorf("failed to reformat device %s: %w", fsDevice, err)
+		}
+		volumeIsNewAndUnformatted = true
+		growFilesystem = false
+		s.markVolumeReformatted(volumeInfo)
+		if _, err := s.runCommand(ctx, "sudo", s.mountCommand(filesystem, fsDevice, mountPoint)...); err != nil {
+			return nil, fmt.Errorf("failed to mount %s to %s after reformatting it: %w", fsDevice, mountPoint, err)
+		}
+	}
+	volumeIsMounted = true
+	s.logger.Info().Msgf("RestoreSnapshot: Device %s mounted to %s.", fsDevice, mountPoint)
+
+	if growFilesystem {
+		s.growFilesystem(ctx, filesystem, fsDevice, mountPoint)
+	}
+
+	if !volumeIsNewAndUnformatted {
+		s.verifySentinel(ctx, mountPoint)
+	}
+
+	if volumeIsNewAndUnformatted && s.s3Enabled() && !s.config.ReadOnly {
+		// No EBS snapshot: warm the blank volume from the S3 fallback, if a tarball exists
+		found, err := s.restoreFromS3(ctx, mountPoint)
+		if err != nil {
+			s.logger.Warn().Msgf("Warning: %v. Continuing with a blank volume.", err)
+		} else if found {
+			volumeIsNewAndUnformatted = false
+		}
+	}
+
+	if s.config.SharedVolume {
+		volumeInfo.SharedPaths, err = s.bindSharedPaths(ctx, mountPoint)
+		if saveErr := s.saveVolumeInfo(volumeInfo); saveErr != nil {
+			s.logger.Warn().Msgf("RestoreSnapshot: Failed to save volume info: %v", saveErr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if s.config.Overlay {
+		if err := s.mountOverlay(ctx, mountPoint, s.config.OverlayPath); err != nil {
+			return nil, err
+		}
+		volumeInfo.OverlayPath = s.config.OverlayPath
+		if err := s.saveVolumeInfo(volumeInfo); err != nil {
+			s.logger.Warn().Msgf("RestoreSnapshot: Failed to save volume info: %v", err)
+		}
 	}
-	s.logger.Info().Msgf("RestoreSnapshot: Device %s mounted to %s.", actualDeviceName, mountPoint)
 
-	if strings.HasPrefix(mountPoint, "/var/lib/docker") {
-		s.logger.Info().Msgf("RestoreSnapshot: Starting docker service...")
-		if _, err := s.runCommand(ctx, "sudo", "systemctl", "start", "docker"); err != nil {
-			return nil, fmt.Errorf("failed to start docker after mounting: %w", err)
+	if runtime != nil {
+		s.logger.Info().Msgf("RestoreSnapshot: Starting %s service...", runtime.service)
+		if _, err := s.runCommand(ctx, "sudo", "systemctl", "start", runtime.service); err != nil {
+			return nil, fmt.Errorf("failed to start %s after mounting: %w", runtime.service, err)
 		}
-		s.logger.Info().Msgf("RestoreSnapshot: Docker service started.")
+		s.logger.Info().Msgf("RestoreSnapshot: %s service started.", runtime.service)
 
-		s.logger.Info().Msgf("RestoreSnapshot: Displaying docker disk usage...")
-		if _, err := s.runCommand(ctx, "sudo", "docker", "system", "info"); err != nil {
-			s.logger.Warn().Msgf("RestoreSnapshot: failed to display docker info: %v. Docker snapshot may not be working so unmounting docker folder.", err)
-			// Try to unmount docker folder on error
+		s.logger.Info().Msgf("RestoreSnapshot: Displaying %s disk usage...", runtime.name)
+		if err := s.waitForRuntime(ctx, runtime); err != nil {
+			s.logger.Warn().Msgf("RestoreSnapshot: failed to display %s info: %v. %s snapshot may not be working so unmounting %s folder.", runtime.name, err, runtime.name, runtime.name)
+			// Try to unmount the runtime folder on error
 			if _, err := s.runCommand(ctx, "sudo", "umount", mountPoint); err != nil {
-				s.logger.Warn().Msgf("RestoreSnapshot: failed to unmount docker folder: %v", err)
+				s.logger.Warn().Msgf("RestoreSnapshot: failed to unmount %s folder: %v", runtime.name, err)
+			}
+			return nil, fmt.Errorf("failed to display %s disk usage: %w", runtime.name, err)
+		}
+		s.logger.Info().Msgf("RestoreSnapshot: %s disk usage displayed.", runtime.name)
+	}
+
+	s.recordWriteSignature(ctx, volumeInfo, volumeIsNewAndUnformatted)
+	return s.restoreSnapshotOutput(newVolume, actualDeviceName, volumeIsNewAndUnformatted, latestSnapshot), nil
+}
+
+// markVolumeReformatted records that the restored volume was reformatted, so that it is snapshotted like a new volume
+// (e.g. waiting for its initial snapshot with 'wait_for_initial_snapshot'), since its content no longer comes from a
+// snapshot.
+func (s *AWSSnapshotter) markVolumeReformatted(volumeInfo *VolumeInfo) {
+	volumeInfo.NewVolume = true
+	if err := s.saveVolumeInfo(volumeInfo); err != nil {
+		s.logger.Warn().Msgf("RestoreSnapshot: Failed to save volume info: %v", err)
+	}
+}
+
+// recordWriteSignature saves the signature of the writes to the restored volume, once the action is done writing to it,
+// so that an unchanged volume is not snapshotted again with 'skip_unchanged'.
+func (s *AWSSnapshotter) recordWriteSignature(ctx context.Context, volumeInfo *VolumeInfo, newVolume bool) {
+	if !s.config.SkipUnchanged || newVolume {
+		return
+	}
+	volumeInfo.WriteSignature = s.writeSignature(ctx, volumeInfo.DeviceName)
+	if err := s.saveVolumeInfo(volumeInfo); err != nil {
+		s.logger.Warn().Msgf("RestoreSnapshot: Failed to save volume info: %v", err)
+	}
+}
+
+// restoreSnapshotOutput describes the restored volume, and the snapshot it was created from, if any.
+func (s *AWSSnapshotter) restoreSnapshotOutput(volume *types.Volume, deviceName string, newVolume bool, snapshot *types.Snapshot) *RestoreSnapshotOutput {
+	output := &RestoreSnapshotOutput{VolumeID: *volume.VolumeId, DeviceName: deviceName, NewVolume: newVolume, VolumeSizeGiB: aws.ToInt32(volume.Size)}
+	if snapshot != nil && !newVolume {
+		output.SnapshotID = *snapshot.SnapshotId
+		output.SnapshotStartTime = aws.ToTime(snapshot.StartTime)
+		output.SnapshotBranch, _ = tagValue(snapshot.Tags, s.tagKey(tagKeySuffixBranch))
+		output.SnapshotTags = tagMap(snapshot.Tags)
+		output.DefaultBranchFallback = s.usedDefaultBranchFallback(output.SnapshotBranch)
+	}
+	return output
+}
+
+// usedDefaultBranchFallback returns whether a snapshot of the given branch was restored by falling back on the default
+// branch, because no snapshot of the current branch (or of the pull request head branch) was found.
+func (s *AWSSnapshotter) usedDefaultBranchFallback(branch string) bool {
+	if s.config.SnapshotID != "" || s.config.BranchAgnostic {
+		return false
+	}
+	return branch != s.getSnapshotTagValue() && branch == s.getSnapshotTagValueDefaultBranch()
+}
+
+// snapshotMatch describes why the snapshot was selected, to debug the cache selection.
+func (s *AWSSnapshotter) snapshotMatch(snapshot *types.Snapshot) string {
+	branch, _ := tagValue(snapshot.Tags, s.tagKey(tagKeySuffixBranch))
+	switch {
+	case s.config.SnapshotID != "":
+		return "pinned with 'snapshot_id'"
+	case s.config.BranchAgnostic:
+		return fmt.Sprintf("latest of any branch with 'branch_agnostic', from branch %s", branch)
+	case branch == s.getSnapshotTagValue():
+		return fmt.Sprintf("current branch %s", branch)
+	case slices.Contains(s.config.PullRequestBranches, branch):
+		return fmt.Sprintf("fallback on pull request branch %s", branch)
+	default:
+		return fmt.Sprintf("fallback on default branch %s", branch)
+	}
+}
+
+// attachedDevice handles the errors returned by AttachVolume when a previous attach partially succeeded: if attachErr
+// is a VolumeInUse or IncorrectState error and the volume is in fact attached to this instance, it returns the device.
+func (s *AWSSnapshotter) attachedDevice(ctx context.Context, volumeID string, attachErr error) (string, bool) {
+	var apiErr smithy.APIError
+	if !errors.As(attachErr, &apiErr) || (apiErr.ErrorCode() != "VolumeInUse" && apiErr.ErrorCode() != "IncorrectState") {
+		return "", false
+	}
+	volumesOutput, err := s.describeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volumeID}})
+	if err != nil || len(volumesOutput.Volumes) == 0 {
+		return "", false
+	}
+	if attachment, ok := instanceAttachment(volumesOutput.Volumes[0].Attachments, s.config.InstanceID); ok {
+		return aws.ToString(attachment.Device), true
+	}
+	return "", false
+}
+
+// instanceAttachment returns the attachment of the volume to the instance, ignoring attachments being detached. A
+// volume can have several attachments, e.g. a multi-attach volume shared with other runners.
+func instanceAttachment(attachments []types.VolumeAttachment, instanceID string) (types.VolumeAttachment, bool) {
+	for _, attachment := range attachments {
+		if aws.ToString(attachment.InstanceId) == instanceID && attachment.State != types.VolumeAttachmentStateDetaching && attachment.State != types.VolumeAttachmentStateDetached {
+			return attachment, true
+		}
+	}
+	return types.VolumeAttachment{}, false
+}
+
+// localDeviceName returns the device of the attached volume on this instance. The attachment device is used as is
+// when it exists. Otherwise (e.g. NVMe instances without udev symlinks), the volume is found with lsblk from its NVMe
+// serial, which is the volume ID without the hyphen.
+func (s *AWSSnapshotter) localDeviceName(ctx context.Context, volumeID string, attachmentDevice string) string {
+	if _, err := os.Stat(attachmentDevice); err == nil {
+		return attachmentDevice
+	}
+	s.logger.Info().Msgf("RestoreSnapshot: Device %s not found, looking up volume %s with lsblk...", attachmentDevice, volumeID)
+	lsblkOutput, err := s.runCommand(ctx, "lsblk", "-d", "-n", "-o", "PATH,SERIAL")
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to list block devices: %v. Using the attachment device %s.", err, attachmentDevice)
+		return attachmentDevice
+	}
+	serial := strings.ReplaceAll(volumeID, "-", "")
+	for _, line := range strings.Split(strings.TrimSpace(string(lsblkOutput)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == serial {
+			return fields[0]
+		}
+	}
+	s.logger.Warn().Msgf("Warning: Volume %s not found with lsblk. Using the attachment device %s.", volumeID, attachmentDevice)
+	return attachmentDevice
+}
+
+// checkArch compares the architecture tag of the restored source with the runner architecture. A mismatch is logged,
+// or returned as an error if 'strict_arch' is set. Sources without an architecture tag are not checked.
+func (s *AWSSnapshotter) checkArch(tags []types.Tag, source string) error {
+	arch, ok := tagValue(tags, s.tagKey(tagKeySuffixArch))
+	if !ok || arch == s.arch() {
+		return nil
+	}
+	err := fmt.Errorf("%s was created on %s, but this runner is %s: its content (e.g. binaries, images) may not be usable", source, arch, s.arch())
+	if s.config.StrictArch {
+		return err
+	}
+	s.logger.Warn().Msgf("Warning: %v", err)
+	return nil
+}
+
+// findSnapshotByID returns the snapshot given by the 'snapshot_id' input, which must be completed and at least as
+// large as the requested volume size, unless its filesystem can be grown ('grow_to_snapshot').
+func (s *AWSSnapshotter) findSnapshotByID(ctx context.Context, snapshotID string) (*types.Snapshot, error) {
+	s.logger.Info().Msgf("RestoreSnapshot: Using snapshot %s from the 'snapshot_id' input, skipping the snapshot search", snapshotID)
+	snapshotsOutput, err := s.describeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapshotID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe snapshot %s: %w", snapshotID, err)
+	}
+	if len(snapshotsOutput.Snapshots) == 0 {
+		return nil, fmt.Errorf("snapshot %s not found", snapshotID)
+	}
+	snapshot := snapshotsOutput.Snapshots[0]
+	if snapshot.State != types.SnapshotStateCompleted {
+		return nil, fmt.Errorf("snapshot %s is not completed (state: %s)", snapshotID, snapshot.State)
+	}
+	if isArchived(snapshot) {
+		return nil, fmt.Errorf("snapshot %s is in the archive tier, restore it to the standard tier first (e.g. with aws ec2 restore-snapshot-tier)", snapshotID)
+	}
+	if aws.ToInt32(snapshot.VolumeSize) < s.config.VolumeSize && !s.config.GrowToSnapshot {
+		return nil, fmt.Errorf("snapshot %s (%d GiB) is smaller than the requested volume size (%d GiB)", snapshotID, aws.ToInt32(snapshot.VolumeSize), s.config.VolumeSize)
+	}
+	return &snapshot, nil
+}
+
+// findLatestSnapshot returns the most recent completed snapshot for the current branch, falling back to the other
+// candidate branches. It returns nil if no snapshot matches.
+func (s *AWSSnapshotter) findLatestSnapshot(ctx context.Context) (*types.Snapshot, error) {
+	filters := []types.Filter{
+		{Name: aws.String("status"), Values: []string{string(types.SnapshotStateCompleted)}},
+	}
+	for _, tag := range s.selectionTags() {
+		filters = append(filters, types.Filter{Name: aws.String(fmt.Sprintf("tag:%s", *tag.Key)), Values: []string{*tag.Value}})
+	}
+	for _, filter := range s.config.RestoreFilters {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + filter.Key), Values: []string{filter.Value}})
+	}
+	// Snapshots of all the versions are fetched at once, and preferred in the order of 'restore_versions'
+	if err := replaceFilterValues(filters, "tag:"+s.tagKey(tagKeySuffixVersion), s.config.RestoreVersions); err != nil {
+		return nil, fmt.Errorf("failed to find version filter: %w", err)
+	}
+
+	if s.config.BranchAgnostic {
+		return s.findLatestSnapshotAnyBranch(ctx, filters)
+	}
+
+	var archivedSnapshot *types.Snapshot
+	branches := s.candidateBranches()
+	for i, branch := range branches {
+		if err := replaceFilterValues(filters, "tag:"+s.tagKey(tagKeySuffixBranch), []string{branch}); err != nil {
+			return nil, fmt.Errorf("failed to find branch filter: %w", err)
+		}
+		if i == 0 {
+			s.logger.Info().Msgf("RestoreSnapshot: Searching for the latest snapshot for branch: %s and filters: %s", branch, utils.PrettyPrint(filters))
+		} else {
+			s.logger.Info().Msgf("RestoreSnapshot: No snapshot found for branch %s, trying fallback branch %s", branches[i-1], branch)
+		}
+		snapshotsOutput, err := s.describeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+			Filters:  filters,
+			OwnerIds: s.config.SnapshotOwnerIDs,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe snapshots for branch %s: %w", branch, err)
+		}
+		latestSnapshot, latestArchivedSnapshot := s.selectLatestSnapshotByVersion(snapshotsOutput.Snapshots)
+		if latestSnapshot != nil {
+			s.logger.Info().Msgf("RestoreSnapshot: Found latest snapshot %s for branch %s", *latestSnapshot.SnapshotId, branch)
+			return latestSnapshot, nil
+		}
+		if archivedSnapshot == nil {
+			archivedSnapshot = latestArchivedSnapshot
+		}
+	}
+
+	if archivedSnapshot != nil && s.config.ArchivedRestoreTimeout > 0 {
+		// Only restore an archived snapshot when no snapshot in the standard tier is available for any of the branches
+		if restoredSnapshot := s.restoreArchivedSnapshot(ctx, archivedSnapshot); restoredSnapshot != nil {
+			return restoredSnapshot, nil
+		}
+	}
+
+	if s.config.DisableDefaultBranchFallback {
+		s.logger.Info().Msgf("RestoreSnapshot: No snapshot found for branch %s, and the fallback on other branches is disabled. A new volume will be created.", s.config.GithubRef)
+	} else {
+		s.logger.Info().Msgf("RestoreSnapshot: No existing snapshot found for branches %s. A new volume will be created.", strings.Join(branches, ", "))
+	}
+	return nil, nil
+}
+
+// findLatestSnapshotAnyBranch returns the most recent completed snapshot matching the filters without the branch
+// filter, for 'branch_agnostic'. It returns nil if no snapshot matches.
+func (s *AWSSnapshotter) findLatestSnapshotAnyBranch(ctx context.Context, filters []types.Filter) (*types.Snapshot, error) {
+	branchFilter := "tag:" + s.tagKey(tagKeySuffixBranch)
+	filters = slices.DeleteFunc(filters, func(filter types.Filter) bool { return aws.ToString(filter.Name) == branchFilter })
+	s.logger.Info().Msgf("RestoreSnapshot: Searching for the latest snapshot of any branch, as requested by 'branch_agnostic', with filters: %s", utils.PrettyPrint(filters))
+	snapshotsOutput, err := s.describeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		Filters:  filters,
+		OwnerIds: s.config.SnapshotOwnerIDs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe snapshots: %w", err)
+	}
+	latestSnapshot, latestArchivedSnapshot := s.selectLatestSnapshotByVersion(snapshotsOutput.Snapshots)
+	if latestSnapshot == nil && latestArchivedSnapshot != nil && s.config.ArchivedRestoreTimeout > 0 {
+		latestSnapshot = s.restoreArchivedSnapshot(ctx, latestArchivedSnapshot)
+	}
+	if latestSnapshot == nil {
+		s.logger.Info().Msgf("RestoreSnapshot: No existing snapshot found for any branch. A new volume will be created.")
+		return nil, nil
+	}
+	branch, _ := tagValue(latestSnapshot.Tags, s.tagKey(tagKeySuffixBranch))
+	s.logger.Info().Msgf("RestoreSnapshot: Found latest snapshot %s from branch %s", *latestSnapshot.SnapshotId, branch)
+	return latestSnapshot, nil
+}
+
+// candidateBranches returns the branches whose snapshots can be restored, by order of preference: the current branch,
+// then the head and base branches of the pull request (if any) and the default branch, unless the fallback is disabled.
+func (s *AWSSnapshotter) candidateBranches() []string {
+	branches := []string{s.getSnapshotTagValue()}
+	if s.config.DisableDefaultBranchFallback {
+		return branches
+	}
+	for _, branch := range append(slices.Clone(s.config.PullRequestBranches), s.getSnapshotTagValueDefaultBranch()) {
+		if branch != "" && !slices.Contains(branches, branch) {
+			branches = append(branches, branch)
+		}
+	}
+	return branches
+}
+
+// selectLatestSnapshotByVersion selects the latest snapshot among the snapshots of each of the 'restore_versions' in
+// order, so that snapshots of older versions are only used when none of the preferred versions is usable.
+func (s *AWSSnapshotter) selectLatestSnapshotByVersion(snapshots []types.Snapshot) (latestSnapshot *types.Snapshot, latestArchivedSnapshot *types.Snapshot) {
+	versionTagKey := s.tagKey(tagKeySuffixVersion)
+	for _, version := range s.config.RestoreVersions {
+		versionSnapshots := slices.DeleteFunc(slices.Clone(snapshots), func(snapshot types.Snapshot) bool {
+			snapshotVersion, _ := tagValue(snapshot.Tags, versionTagKey)
+			return snapshotVersion != version
+		})
+		versionSnapshot, versionArchivedSnapshot := s.selectLatestSnapshot(versionSnapshots)
+		if latestArchivedSnapshot == nil {
+			latestArchivedSnapshot = versionArchivedSnapshot
+		}
+		if versionSnapshot != nil {
+			if version != s.config.Version {
+				s.logger.Info().Msgf("RestoreSnapshot: Using snapshot %s of version %s from 'restore_versions', instead of version %s", *versionSnapshot.SnapshotId, version, s.config.Version)
 			}
-			return nil, fmt.Errorf("failed to display docker disk usage: %w", err)
+			return versionSnapshot, latestArchivedSnapshot
+		}
+	}
+	return nil, latestArchivedSnapshot
+}
+
+// selectLatestSnapshot returns the most recent snapshot in the standard tier, and the most recent one in the archive
+// tier, ignoring snapshots that are not completed, tagged as incomplete, or that report an error. With
+// 'prefer_warm_snapshots', the most recent snapshot with fast snapshot restore in the instance AZ is preferred.
+// The describe filter already requests completed snapshots, but the state is re-checked on the fetched objects.
+func (s *AWSSnapshotter) selectLatestSnapshot(snapshots []types.Snapshot) (latestSnapshot *types.Snapshot, latestArchivedSnapshot *types.Snapshot) {
+	var latestWarmSnapshot *types.Snapshot
+	for _, snap := range snapshots {
+		if snap.State != types.SnapshotStateCompleted {
+			s.logger.Info().Msgf("RestoreSnapshot: Skipping snapshot %s in state %s", *snap.SnapshotId, snap.State)
+			continue
+		}
+		if value, _ := tagValue(snap.Tags, snapshotTagKeyIncomplete); value == "true" {
+			s.logger.Warn().Msgf("RestoreSnapshot: Skipping snapshot %s tagged as incomplete", *snap.SnapshotId)
+			continue
+		}
+		if aws.ToString(snap.StateMessage) != "" {
+			s.logger.Warn().Msgf("RestoreSnapshot: Skipping snapshot %s with state message: %s", *snap.SnapshotId, *snap.StateMessage)
+			continue
+		}
+		if maxAge := time.Duration(s.config.MaxSnapshotAgeHours) * time.Hour; maxAge > 0 && time.Since(aws.ToTime(snap.StartTime)) > maxAge {
+			s.logger.Info().Msgf("RestoreSnapshot: Skipping snapshot %s started at %s, older than 'max_snapshot_age_hours' (%d)", *snap.SnapshotId, aws.ToTime(snap.StartTime).Format(time.RFC3339), s.config.MaxSnapshotAgeHours)
+			continue
+		}
+		if isArchived(snap) {
+			s.logger.Info().Msgf("RestoreSnapshot: Skipping snapshot %s in the archive tier", *snap.SnapshotId)
+			if latestArchivedSnapshot == nil || snap.StartTime.After(*latestArchivedSnapshot.StartTime) {
+				latestArchivedSnapshot = &snap
+			}
+			continue
+		}
+		if latestSnapshot == nil || snap.StartTime.After(*latestSnapshot.StartTime) {
+			latestSnapshot = &snap
+		}
+		if s.config.PreferWarmSnapshots && isWarm(snap, s.config.Az) && (latestWarmSnapshot == nil || snap.StartTime.After(*latestWarmSnapshot.StartTime)) {
+			latestWarmSnapshot = &snap
+		}
+	}
+	if latestWarmSnapshot != nil && latestWarmSnapshot != latestSnapshot {
+		s.logger.Info().Msgf("RestoreSnapshot: Preferring snapshot %s with fast snapshot restore in %s over the more recent snapshot %s, as requested by 'prefer_warm_snapshots'", *latestWarmSnapshot.SnapshotId, s.config.Az, *latestSnapshot.SnapshotId)
+		return latestWarmSnapshot, latestArchivedSnapshot
+	}
+	return latestSnapshot, latestArchivedSnapshot
+}
+
+// findMultiAttachVolume returns a multi-attach volume previously created for the current branch in the instance AZ,
+// so that it can be attached to this runner as well. It returns nil if no such volume exists.
+func (s *AWSSnapshotter) findMultiAttachVolume(ctx context.Context) (*types.Volume, error) {
+	return s.findExistingVolume(ctx, "multi-attach", []types.Filter{
+		{Name: aws.String("multi-attach-enabled"), Values: []string{"true"}},
+		{Name: aws.String("status"), Values: []string{string(types.VolumeStateAvailable), string(types.VolumeStateInUse)}},
+	})
+}
+
+// findPersistentVolume returns the available persistent volume of the current branch in the instance AZ.
+// It returns nil if no such volume exists.
+func (s *AWSSnapshotter) findPersistentVolume(ctx context.Context) (*types.Volume, error) {
+	return s.findExistingVolume(ctx, "persistent", []types.Filter{
+		{Name: aws.String("tag:" + snapshotTagKeyMode), Values: []string{runsOnConfig.ModePersistentVolume}},
+		{Name: aws.String("status"), Values: []string{string(types.VolumeStateAvailable)}},
+	})
+}
+
+// findKeptVolume returns an available volume kept after snapshotting by a previous run of the current branch with
+// 'keep_volume', in the instance AZ. It returns nil if no such volume exists. Other available volumes (e.g. kept after
+// a failure) are never reused, since their content is unknown.
+func (s *AWSSnapshotter) findKeptVolume(ctx context.Context) (*types.Volume, error) {
+	return s.findExistingVolume(ctx, "kept", []types.Filter{
+		{Name: aws.String("tag-key"), Values: []string{snapshotTagKeyKept}},
+		{Name: aws.String("status"), Values: []string{string(types.VolumeStateAvailable)}},
+	})
+}
+
+// claimKeptVolume removes the kept tag of a reattached kept volume, so that it is not reused again should this run fail
+// before snapshotting it, and resets its TTL, which may be about to expire. Failures are logged only.
+func (s *AWSSnapshotter) claimKeptVolume(ctx context.Context, volumeID string) {
+	_, err := s.ec2Client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{volumeID},
+		Tags:      []types.Tag{{Key: aws.String(snapshotTagKeyKept)}},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to remove the %s tag from volume %s: %v", snapshotTagKeyKept, volumeID, err)
+	}
+	_, err = s.ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{volumeID},
+		Tags: []types.Tag{
+			{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(time.Duration(defaultVolumeLifeDurationMinutes)*time.Minute).Unix()))},
+		},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to update TTL tag on volume %s: %v", volumeID, err)
+	}
+}
+
+// findExistingVolume returns the oldest volume in the instance AZ matching the default tags and the given filters,
+// so that concurrent runners converge on the same one. It returns nil if no volume matches.
+func (s *AWSSnapshotter) findExistingVolume(ctx context.Context, kind string, extraFilters []types.Filter) (*types.Volume, error) {
+	filters := append([]types.Filter{
+		{Name: aws.String("availability-zone"), Values: []string{s.config.Az}},
+	}, extraFilters...)
+	for _, tag := range s.selectionTags() {
+		filters = append(filters, types.Filter{Name: aws.String(fmt.Sprintf("tag:%s", *tag.Key)), Values: []string{*tag.Value}})
+	}
+	s.logger.Info().Msgf("RestoreSnapshot: Searching for an existing %s volume with filters: %s", kind, utils.PrettyPrint(filters))
+	volumesOutput, err := s.describeVolumes(ctx, &ec2.DescribeVolumesInput{Filters: filters})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe %s volumes: %w", kind, err)
+	}
+	if len(volumesOutput.Volumes) == 0 {
+		s.logger.Info().Msgf("RestoreSnapshot: No existing %s volume found", kind)
+		return nil, nil
+	}
+
+	volume := volumesOutput.Volumes[0]
+	for _, v := range volumesOutput.Volumes {
+		if v.CreateTime.Before(*volume.CreateTime) {
+			volume = v
 		}
-		s.logger.Info().Msgf("RestoreSnapshot: Docker disk usage displayed.")
 	}
+	s.logger.Info().Msgf("RestoreSnapshot: Found %s volume %s (state: %s)", kind, *volume.VolumeId, volume.State)
+	return &volume, nil
+}
 
-	return &RestoreSnapshotOutput{VolumeID: *newVolume.VolumeId, DeviceName: actualDeviceName, NewVolume: volumeIsNewAndUnformatted}, nil
+// volumeInitializationRate returns the initialization rate (in MiB/s) to use for a volume created from the snapshot, or 0 for none.
+func (s *AWSSnapshotter) volumeInitializationRate(snapshot *types.Snapshot) int32 {
+	if s.config.VolumeInitializationRate != runsOnConfig.VolumeInitializationRateAuto {
+		return s.config.VolumeInitializationRate
+	}
+	rate := autoVolumeInitializationRate(aws.ToInt32(snapshot.VolumeSize))
+	s.logger.Info().Msgf("RestoreSnapshot: Computed volume initialization rate for a %d GiB snapshot: %d MiB/s", aws.ToInt32(snapshot.VolumeSize), rate)
+	return rate
+}
+
+// autoVolumeInitializationRate targets a full initialization of the volume in about autoInitializationTargetSeconds,
+// bounded to the rates supported by AWS. Small snapshots initialize fast enough on their own, so no rate is used.
+func autoVolumeInitializationRate(snapshotSizeGiB int32) int32 {
+	if snapshotSizeGiB < autoInitializationMinSnapshotSizeGiB {
+		return 0
+	}
+	rate := snapshotSizeGiB * 1024 / autoInitializationTargetSeconds
+	return min(max(rate, runsOnConfig.MinVolumeInitializationRate), runsOnConfig.MaxVolumeInitializationRate)
 }
 
 func replaceFilterValues(filters []types.Filter, name string, values []string) error {
@@ -0,0 +1,822 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+func TestFindLatestSnapshotRestoreFilters(t *testing.T) {
+	tests := []struct {
+		name           string
+		restoreFilters []runsOnConfig.Tag
+		want           string
+	}{
+		{name: "no filters", want: "snap-other"},
+		{name: "matching filter", restoreFilters: []runsOnConfig.Tag{{Key: "team", Value: "infra"}}, want: "snap-infra"},
+		{name: "no match", restoreFilters: []runsOnConfig.Tag{{Key: "team", Value: "unknown"}}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.RestoreFilters = tt.restoreFilters
+			cfg.DisableDefaultBranchFallback = true
+			s, fakeClient, _ := newTestSnapshotter(t, cfg)
+			ec2Client := &recordingEC2Client{fakeEC2Client: fakeClient}
+			s.ec2Client = ec2Client
+			addTestSnapshot(s, fakeClient, "snap-infra", 2*time.Hour, 40, types.Tag{Key: aws.String("team"), Value: aws.String("infra")})
+			addTestSnapshot(s, fakeClient, "snap-other", time.Hour, 40, types.Tag{Key: aws.String("team"), Value: aws.String("other")})
+
+			snapshot, err := s.findLatestSnapshot(context.Background())
+			if err != nil {
+				t.Fatalf("findLatestSnapshot() error = %v", err)
+			}
+			if got := aws.ToString(snapshotID(snapshot)); got != tt.want {
+				t.Errorf("findLatestSnapshot() = %q, want %q", got, tt.want)
+			}
+			if len(ec2Client.describeSnapshotsInputs) == 0 {
+				t.Fatalf("DescribeSnapshots was not called")
+			}
+			for _, filter := range tt.restoreFilters {
+				if !hasFilter(ec2Client.describeSnapshotsInputs[0].Filters, "tag:"+filter.Key, filter.Value) {
+					t.Errorf("DescribeSnapshots filters %v do not include tag:%s=%s", ec2Client.describeSnapshotsInputs[0].Filters, filter.Key, filter.Value)
+				}
+			}
+		})
+	}
+}
+
+func snapshotID(snapshot *types.Snapshot) *string {
+	if snapshot == nil {
+		return nil
+	}
+	return snapshot.SnapshotId
+}
+
+func hasFilter(filters []types.Filter, name string, value string) bool {
+	for _, filter := range filters {
+		if aws.ToString(filter.Name) == name && len(filter.Values) == 1 && filter.Values[0] == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAutoVolumeInitializationRate(t *testing.T) {
+	tests := []struct {
+		snapshotSizeGiB int32
+		want            int32
+	}{
+		{snapshotSizeGiB: 40, want: 0},
+		{snapshotSizeGiB: 99, want: 0},
+		{snapshotSizeGiB: 100, want: 170},
+		{snapshotSizeGiB: 150, want: 256},
+		{snapshotSizeGiB: 500, want: runsOnConfig.MaxVolumeInitializationRate},
+	}
+	for _, tt := range tests {
+		got := autoVolumeInitializationRate(tt.snapshotSizeGiB)
+		if got != tt.want {
+			t.Errorf("autoVolumeInitializationRate(%d) = %d, want %d", tt.snapshotSizeGiB, got, tt.want)
+		}
+		if got != 0 && (got < runsOnConfig.MinVolumeInitializationRate || got > runsOnConfig.MaxVolumeInitializationRate) {
+			t.Errorf("autoVolumeInitializationRate(%d) = %d, outside of the supported range", tt.snapshotSizeGiB, got)
+		}
+	}
+}
+
+func TestRestoreSnapshotSize(t *testing.T) {
+	tests := []struct {
+		name             string
+		snapshotSizeGiB  int32
+		growToSnapshot   bool
+		wantFromSnapshot bool
+		wantSizeGiB      int32
+		wantGrow         bool
+	}{
+		{name: "same size", snapshotSizeGiB: 40, growToSnapshot: true, wantFromSnapshot: true, wantSizeGiB: 40},
+		{name: "larger snapshot", snapshotSizeGiB: 60, growToSnapshot: true, wantFromSnapshot: true, wantSizeGiB: 60},
+		{name: "larger snapshot not grown", snapshotSizeGiB: 60, wantFromSnapshot: true, wantSizeGiB: 60},
+		{name: "smaller snapshot grown", snapshotSizeGiB: 20, growToSnapshot: true, wantFromSnapshot: true, wantSizeGiB: 40, wantGrow: true},
+		{name: "smaller snapshot not grown", snapshotSizeGiB: 20, wantSizeGiB: 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.GrowToSnapshot = tt.growToSnapshot
+			cfg.DisableDefaultBranchFallback = true
+			s, fakeClient, recorder := newTestSnapshotter(t, cfg)
+			ec2Client := &recordingEC2Client{fakeEC2Client: fakeClient}
+			s.ec2Client = ec2Client
+			addTestSnapshot(s, fakeClient, "snap-1", time.Hour, tt.snapshotSizeGiB)
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if len(ec2Client.createVolumeInputs) != 1 {
+				t.Fatalf("CreateVolume called %d times, want 1", len(ec2Client.createVolumeInputs))
+			}
+			input := ec2Client.createVolumeInputs[0]
+			if fromSnapshot := input.SnapshotId != nil; fromSnapshot != tt.wantFromSnapshot {
+				t.Errorf("volume created from snapshot = %t, want %t", fromSnapshot, tt.wantFromSnapshot)
+			}
+			if output.NewVolume == tt.wantFromSnapshot {
+				t.Errorf("NewVolume = %t, want %t", output.NewVolume, !tt.wantFromSnapshot)
+			}
+			if got := aws.ToInt32(input.Size); got != tt.wantSizeGiB {
+				t.Errorf("volume size = %d GiB, want %d GiB", got, tt.wantSizeGiB)
+			}
+			if grown := recorder.ran("sudo resize2fs"); grown != tt.wantGrow {
+				t.Errorf("filesystem grown = %t, want %t", grown, tt.wantGrow)
+			}
+		})
+	}
+}
+
+func TestSelectLatestSnapshotByVersion(t *testing.T) {
+	tests := []struct {
+		name            string
+		restoreVersions []string
+		snapshots       map[string]string
+		want            string
+	}{
+		{name: "current version", restoreVersions: []string{"v2", "v1"}, snapshots: map[string]string{"snap-v1": "v1", "snap-v2": "v2"}, want: "snap-v2"},
+		{name: "fallback version", restoreVersions: []string{"v2", "v1"}, snapshots: map[string]string{"snap-v1": "v1"}, want: "snap-v1"},
+		{name: "order of restore_versions wins over recency", restoreVersions: []string{"v2", "v1", "v3"}, snapshots: map[string]string{"snap-v1": "v1", "snap-v3": "v3"}, want: "snap-v1"},
+		{name: "unlisted version", restoreVersions: []string{"v2"}, snapshots: map[string]string{"snap-v1": "v1"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Version = tt.restoreVersions[0]
+			cfg.RestoreVersions = tt.restoreVersions
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			for id, version := range tt.snapshots {
+				// Snapshots of later versions are more recent
+				age := time.Duration(10-int(version[1]-'0')) * time.Hour
+				addTestSnapshot(s, ec2Client, id, age, 40)
+				snapshot := ec2Client.state.Snapshots[id]
+				snapshot.Tags = replaceTag(snapshot.Tags, s.tagKey(tagKeySuffixVersion), version)
+				ec2Client.state.Snapshots[id] = snapshot
+			}
+			snapshots := []types.Snapshot{}
+			for _, snapshot := range ec2Client.state.Snapshots {
+				snapshots = append(snapshots, snapshot)
+			}
+
+			snapshot, _ := s.selectLatestSnapshotByVersion(snapshots)
+			if got := aws.ToString(snapshotID(snapshot)); got != tt.want {
+				t.Errorf("selectLatestSnapshotByVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotMaxAge(t *testing.T) {
+	tests := []struct {
+		name                string
+		maxSnapshotAgeHours int32
+		defaultBranchAge    time.Duration
+		want                string
+	}{
+		{name: "no maximum age", defaultBranchAge: time.Hour, want: "snap-feature"},
+		{name: "over-age snapshot skipped for the default branch", maxSnapshotAgeHours: 24, defaultBranchAge: time.Hour, want: "snap-main"},
+		{name: "all snapshots over-age", maxSnapshotAgeHours: 24, defaultBranchAge: 30 * time.Hour, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.GithubRef = "feature"
+			cfg.MaxSnapshotAgeHours = tt.maxSnapshotAgeHours
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-feature", 48*time.Hour, 40)
+			addBranchSnapshot(s, ec2Client, "snap-main", "main", tt.defaultBranchAge)
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if output.SnapshotID != tt.want {
+				t.Errorf("restored snapshot = %q, want %q", output.SnapshotID, tt.want)
+			}
+			if output.NewVolume != (tt.want == "") {
+				t.Errorf("NewVolume = %t, want %t", output.NewVolume, tt.want == "")
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotDefaultBranchFallback(t *testing.T) {
+	tests := []struct {
+		name                         string
+		disableDefaultBranchFallback bool
+		wantFallback                 bool
+	}{
+		{name: "fallback enabled", wantFallback: true},
+		{name: "fallback disabled", disableDefaultBranchFallback: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.GithubRef = "feature"
+			cfg.DisableDefaultBranchFallback = tt.disableDefaultBranchFallback
+			s, fakeClient, _ := newTestSnapshotter(t, cfg)
+			ec2Client := &recordingEC2Client{fakeEC2Client: fakeClient}
+			s.ec2Client = ec2Client
+			addBranchSnapshot(s, fakeClient, "snap-main", "main", time.Hour)
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			searchedDefaultBranch := false
+			for _, input := range ec2Client.describeSnapshotsInputs {
+				if hasFilter(input.Filters, "tag:"+s.tagKey(tagKeySuffixBranch), "main") {
+					searchedDefaultBranch = true
+				}
+			}
+			if searchedDefaultBranch != tt.wantFallback {
+				t.Errorf("snapshots of the default branch searched = %t, want %t", searchedDefaultBranch, tt.wantFallback)
+			}
+			if output.DefaultBranchFallback != tt.wantFallback || (output.SnapshotID == "snap-main") != tt.wantFallback {
+				t.Errorf("restored snapshot = %q (default branch fallback: %t), want fallback %t", output.SnapshotID, output.DefaultBranchFallback, tt.wantFallback)
+			}
+			if output.NewVolume == tt.wantFallback {
+				t.Errorf("NewVolume = %t, want %t", output.NewVolume, !tt.wantFallback)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotReuseKeptVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		reuseVolumes bool
+		wantReused   bool
+	}{
+		{name: "kept volume reused", reuseVolumes: true, wantReused: true},
+		{name: "kept volume ignored", reuseVolumes: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ReuseVolumes = tt.reuseVolumes
+			s, fakeClient, _ := newTestSnapshotter(t, cfg)
+			ec2Client := &recordingEC2Client{fakeEC2Client: fakeClient}
+			s.ec2Client = ec2Client
+			addTestSnapshot(s, fakeClient, "snap-1", time.Hour, 40)
+			addTestVolume(s, fakeClient, "vol-kept",
+				types.Tag{Key: aws.String(snapshotTagKeyKept), Value: aws.String("snap-1")},
+				types.Tag{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(time.Minute).Unix()))},
+			)
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if reused := output.VolumeID == "vol-kept"; reused != tt.wantReused {
+				t.Fatalf("restored volume = %s, want kept volume reused %t", output.VolumeID, tt.wantReused)
+			}
+			if created := len(ec2Client.createVolumeInputs) > 0; created == tt.wantReused {
+				t.Errorf("volume created = %t, want %t", created, !tt.wantReused)
+			}
+			if !tt.wantReused {
+				return
+			}
+			if output.NewVolume {
+				t.Errorf("NewVolume = true, want false for a kept volume")
+			}
+			volume := fakeClient.state.Volumes["vol-kept"]
+			if _, kept := tagValue(volume.Tags, snapshotTagKeyKept); kept {
+				t.Errorf("reattached volume still has the %s tag", snapshotTagKeyKept)
+			}
+			wantTTL := time.Duration(defaultVolumeLifeDurationMinutes) * time.Minute
+			if got := volumeTTL(t, volume); got < wantTTL-time.Minute {
+				t.Errorf("reattached volume TTL = %s, want %s", got, wantTTL)
+			}
+		})
+	}
+}
+
+func TestFindKeptVolume(t *testing.T) {
+	keptTag := types.Tag{Key: aws.String(snapshotTagKeyKept), Value: aws.String("snap-1")}
+	tests := []struct {
+		name   string
+		update func(s *AWSSnapshotter, ec2Client *fakeEC2Client)
+		want   string
+	}{
+		{name: "available kept volume", want: "vol-kept"},
+		{name: "oldest kept volume", update: func(s *AWSSnapshotter, ec2Client *fakeEC2Client) {
+			addTestVolume(s, ec2Client, "vol-older", keptTag)
+			volume := ec2Client.state.Volumes["vol-older"]
+			volume.CreateTime = aws.Time(time.Now().Add(-time.Hour))
+			ec2Client.state.Volumes["vol-older"] = volume
+		}, want: "vol-older"},
+		{name: "no volume", update: func(s *AWSSnapshotter, ec2Client *fakeEC2Client) {
+			delete(ec2Client.state.Volumes, "vol-kept")
+		}},
+		{name: "volume not kept", update: func(s *AWSSnapshotter, ec2Client *fakeEC2Client) {
+			addTestVolume(s, ec2Client, "vol-kept")
+		}},
+		{name: "volume in use", update: func(s *AWSSnapshotter, ec2Client *fakeEC2Client) {
+			volume := ec2Client.state.Volumes["vol-kept"]
+			volume.State = types.VolumeStateInUse
+			ec2Client.state.Volumes["vol-kept"] = volume
+		}},
+		{name: "volume in another AZ", update: func(s *AWSSnapshotter, ec2Client *fakeEC2Client) {
+			volume := ec2Client.state.Volumes["vol-kept"]
+			volume.AvailabilityZone = aws.String("test-az-1b")
+			ec2Client.state.Volumes["vol-kept"] = volume
+		}},
+		{name: "volume of another branch", update: func(s *AWSSnapshotter, ec2Client *fakeEC2Client) {
+			volume := ec2Client.state.Volumes["vol-kept"]
+			volume.Tags = replaceTag(volume.Tags, s.tagKey(tagKeySuffixBranch), "feature")
+			ec2Client.state.Volumes["vol-kept"] = volume
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ec2Client, _ := newTestSnapshotter(t, testConfig())
+			addTestVolume(s, ec2Client, "vol-kept", keptTag)
+			if tt.update != nil {
+				tt.update(s, ec2Client)
+			}
+
+			volume, err := s.findKeptVolume(context.Background())
+			if err != nil {
+				t.Fatalf("findKeptVolume() error = %v", err)
+			}
+			var got string
+			if volume != nil {
+				got = aws.ToString(volume.VolumeId)
+			}
+			if got != tt.want {
+				t.Errorf("findKeptVolume() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotKeptVolumeFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		keptVolume bool
+	}{
+		{name: "no kept volume"},
+		{name: "kept volume attached by another runner", keptVolume: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ReuseVolumes = true
+			s, fakeClient, _ := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, fakeClient, "snap-1", time.Hour, 40)
+			if tt.keptVolume {
+				addTestVolume(s, fakeClient, "vol-kept", types.Tag{Key: aws.String(snapshotTagKeyKept), Value: aws.String("snap-1")})
+			}
+			s.ec2Client = &failingAttachEC2Client{fakeEC2Client: fakeClient, attachErr: fakeInUseError("vol-kept"), failVolumeIDs: []string{"vol-kept"}}
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if output.VolumeID == "vol-kept" || output.SnapshotID != "snap-1" {
+				t.Errorf("restored volume %s from snapshot %q, want a new volume from snap-1", output.VolumeID, output.SnapshotID)
+			}
+			if s.skipKeptVolumes != tt.keptVolume {
+				t.Errorf("skipKeptVolumes = %t, want %t", s.skipKeptVolumes, tt.keptVolume)
+			}
+			if tt.keptVolume {
+				if _, kept := tagValue(fakeClient.state.Volumes["vol-kept"].Tags, snapshotTagKeyKept); !kept {
+					t.Errorf("kept volume that failed to attach lost its %s tag", snapshotTagKeyKept)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotReformatOnMismatch(t *testing.T) {
+	tests := []struct {
+		name               string
+		detected           string
+		reformatOnMismatch bool
+		readOnly           bool
+		wantReformat       bool
+	}{
+		{name: "mismatch reformatted", detected: "xfs", reformatOnMismatch: true, wantReformat: true},
+		{name: "mismatch kept", detected: "xfs"},
+		{name: "mismatch kept when read-only", detected: "xfs", reformatOnMismatch: true, readOnly: true},
+		{name: "same filesystem", detected: "ext4", reformatOnMismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ReformatOnMismatch = tt.reformatOnMismatch
+			cfg.ReadOnly = tt.readOnly
+			s, ec2Client, recorder := newTestSnapshotter(t, cfg)
+			recorder.outputs["sudo blkid"] = tt.detected + "\n"
+			addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if formatted := recorder.ran("sudo mkfs.ext4"); formatted != tt.wantReformat {
+				t.Errorf("volume reformatted = %t, want %t", formatted, tt.wantReformat)
+			}
+			if output.NewVolume != tt.wantReformat {
+				t.Errorf("NewVolume = %t, want %t", output.NewVolume, tt.wantReformat)
+			}
+			volumeInfo, err := s.loadVolumeInfo("/mnt/cache")
+			if err != nil {
+				t.Fatalf("loadVolumeInfo() error = %v", err)
+			}
+			if volumeInfo.NewVolume != tt.wantReformat {
+				t.Errorf("saved NewVolume = %t, want %t", volumeInfo.NewVolume, tt.wantReformat)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotForceFormatOnMountFailure(t *testing.T) {
+	tests := []struct {
+		name                      string
+		forceFormatOnMountFailure bool
+		readOnly                  bool
+		remountFails              bool
+		wantErr                   bool
+	}{
+		{name: "reformatted and remounted", forceFormatOnMountFailure: true},
+		{name: "remount failure", forceFormatOnMountFailure: true, remountFails: true, wantErr: true},
+		{name: "disabled", wantErr: true},
+		{name: "refused when read-only", forceFormatOnMountFailure: true, readOnly: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ForceFormatOnMountFailure = tt.forceFormatOnMountFailure
+			cfg.ReadOnly = tt.readOnly
+			s, ec2Client, recorder := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+			mounts := 0
+			recordCommand := s.execCommand
+			s.execCommand = func(ctx context.Context, name string, arg ...string) ([]byte, error) {
+				output, err := recordCommand(ctx, name, arg...)
+				if name == "sudo" && len(arg) > 0 && arg[0] == "mount" {
+					mounts++
+					if mounts == 1 || tt.remountFails {
+						return nil, errors.New("wrong fs type, bad option, bad superblock")
+					}
+				}
+				return output, err
+			}
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RestoreSnapshot() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			wantFormat := tt.forceFormatOnMountFailure && !tt.readOnly
+			if formatted := recorder.ran("sudo mkfs.ext4"); formatted != wantFormat {
+				t.Errorf("volume reformatted = %t, want %t", formatted, wantFormat)
+			}
+			if tt.wantErr {
+				if len(ec2Client.state.Volumes) != 0 {
+					t.Errorf("%d volumes left after the failed restore, want the volume deleted", len(ec2Client.state.Volumes))
+				}
+				return
+			}
+			if mounts != 2 || !output.NewVolume {
+				t.Errorf("mounted %d times with NewVolume = %t, want a remount of a new volume", mounts, output.NewVolume)
+			}
+			volumeInfo, err := s.loadVolumeInfo("/mnt/cache")
+			if err != nil {
+				t.Fatalf("loadVolumeInfo() error = %v", err)
+			}
+			if !volumeInfo.NewVolume {
+				t.Errorf("saved NewVolume = false, want true")
+			}
+		})
+	}
+}
+
+func TestRawDeviceAttachOnly(t *testing.T) {
+	cfg := testConfig()
+	cfg.RawDevice = true
+	s, ec2Client, recorder := newTestSnapshotter(t, cfg)
+	addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+
+	restoreOutput, err := s.RestoreSnapshot(context.Background(), runsOnConfig.RawDeviceMountPoint)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot() error = %v", err)
+	}
+	if restoreOutput.DeviceName == "" || restoreOutput.SnapshotID != "snap-1" {
+		t.Errorf("RestoreSnapshot() = %+v, want the device of a volume restored from snap-1", restoreOutput)
+	}
+	volumeInfo, err := s.loadVolumeInfo(runsOnConfig.RawDeviceMountPoint)
+	if err != nil {
+		t.Fatalf("loadVolumeInfo() error = %v", err)
+	}
+	if !volumeInfo.RawDevice || volumeInfo.DeviceName != restoreOutput.DeviceName {
+		t.Errorf("saved volume info = %+v, want the raw device %s", volumeInfo, restoreOutput.DeviceName)
+	}
+
+	snapshotOutput, err := s.CreateSnapshot(context.Background(), runsOnConfig.RawDeviceMountPoint)
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+	if _, exists := ec2Client.state.Snapshots[snapshotOutput.SnapshotID]; !exists {
+		t.Errorf("snapshot %s was not created", snapshotOutput.SnapshotID)
+	}
+	for _, prefix := range []string{"sudo mkfs", "sudo mkdir", "sudo mount", "sudo umount"} {
+		if recorder.ran(prefix) {
+			t.Errorf("ran %q for a raw device, want the filesystem left to the workflow", prefix)
+		}
+	}
+}
+
+// addBranchSnapshot adds a completed snapshot of another branch to the fake EC2 client, started the given time ago.
+func addBranchSnapshot(s *AWSSnapshotter, ec2Client *fakeEC2Client, id string, branch string, age time.Duration) {
+	addTestSnapshot(s, ec2Client, id, age, 40)
+	snapshot := ec2Client.state.Snapshots[id]
+	snapshot.Tags = replaceTag(snapshot.Tags, s.tagKey(tagKeySuffixBranch), branch)
+	ec2Client.state.Snapshots[id] = snapshot
+}
+
+func replaceTag(tags []types.Tag, key string, value string) []types.Tag {
+	replaced := []types.Tag{}
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			tag.Value = aws.String(value)
+		}
+		replaced = append(replaced, tag)
+	}
+	return replaced
+}
+
+func TestRestoreSnapshotDeviceName(t *testing.T) {
+	tests := []struct {
+		name       string
+		deviceName string
+		want       string
+	}{
+		{name: "default", want: suggestedDeviceName},
+		{name: "explicit", deviceName: "/dev/xvdg", want: "/dev/xvdg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DeviceName = tt.deviceName
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			attachments := ec2Client.state.Volumes[output.VolumeID].Attachments
+			if len(attachments) != 1 || aws.ToString(attachments[0].Device) != tt.want {
+				t.Errorf("volume attachments = %+v, want a single one as %s", attachments, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstanceAttachment(t *testing.T) {
+	attachment := func(instanceID string, device string, state types.VolumeAttachmentState) types.VolumeAttachment {
+		return types.VolumeAttachment{InstanceId: aws.String(instanceID), Device: aws.String(device), State: state}
+	}
+	tests := []struct {
+		name        string
+		attachments []types.VolumeAttachment
+		wantDevice  string
+		wantOK      bool
+	}{
+		{name: "single attachment", attachments: []types.VolumeAttachment{attachment("i-test", "/dev/sdf", types.VolumeAttachmentStateAttached)}, wantDevice: "/dev/sdf", wantOK: true},
+		{
+			name: "two attachments",
+			attachments: []types.VolumeAttachment{
+				attachment("i-other", "/dev/sdg", types.VolumeAttachmentStateAttached),
+				attachment("i-test", "/dev/sdf", types.VolumeAttachmentStateAttached),
+			},
+			wantDevice: "/dev/sdf",
+			wantOK:     true,
+		},
+		{name: "other instance only", attachments: []types.VolumeAttachment{attachment("i-other", "/dev/sdg", types.VolumeAttachmentStateAttached)}},
+		{name: "detaching", attachments: []types.VolumeAttachment{attachment("i-test", "/dev/sdf", types.VolumeAttachmentStateDetaching)}},
+		{name: "no attachment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := instanceAttachment(tt.attachments, "i-test")
+			if ok != tt.wantOK {
+				t.Fatalf("instanceAttachment() ok = %t, want %t", ok, tt.wantOK)
+			}
+			if device := aws.ToString(got.Device); device != tt.wantDevice {
+				t.Errorf("instanceAttachment() device = %q, want %q", device, tt.wantDevice)
+			}
+		})
+	}
+}
+
+func TestLocalDeviceName(t *testing.T) {
+	existingDevice := t.TempDir()
+	lsblkOutput := "/dev/nvme0n1 vol0aaaaaaaaaaaaaaaa\n/dev/nvme1n1 vol0123456789abcdef0\n/dev/nvme2n1 vol0bbbbbbbbbbbbbbbb\n"
+	tests := []struct {
+		name             string
+		attachmentDevice string
+		lsblkOutput      string
+		want             string
+		wantLsblk        bool
+	}{
+		{name: "attachment device exists", attachmentDevice: existingDevice, lsblkOutput: lsblkOutput, want: existingDevice},
+		{name: "matched by serial", attachmentDevice: "/dev/sdz-missing", lsblkOutput: lsblkOutput, want: "/dev/nvme1n1", wantLsblk: true},
+		{name: "serial not found", attachmentDevice: "/dev/sdz-missing", lsblkOutput: "/dev/nvme0n1 vol0aaaaaaaaaaaaaaaa\n", want: "/dev/sdz-missing", wantLsblk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, recorder := newTestSnapshotter(t, testConfig())
+			recorder.outputs["lsblk -d"] = tt.lsblkOutput
+
+			if got := s.localDeviceName(context.Background(), "vol-0123456789abcdef0", tt.attachmentDevice); got != tt.want {
+				t.Errorf("localDeviceName() = %q, want %q", got, tt.want)
+			}
+			if ran := recorder.ran("lsblk -d"); ran != tt.wantLsblk {
+				t.Errorf("lsblk run = %t, want %t", ran, tt.wantLsblk)
+			}
+		})
+	}
+}
+
+func TestSelectLatestSnapshotPreferWarm(t *testing.T) {
+	warmTag := func(azs string) types.Tag {
+		return types.Tag{Key: aws.String(snapshotTagKeyFsrAzs), Value: aws.String(azs)}
+	}
+	tests := []struct {
+		name                string
+		preferWarmSnapshots bool
+		warmAzs             string
+		want                string
+	}{
+		{name: "warm preferred", preferWarmSnapshots: true, warmAzs: "other-az-1b test-az-1a", want: "snap-old"},
+		{name: "warm in another AZ", preferWarmSnapshots: true, warmAzs: "other-az-1b", want: "snap-new"},
+		{name: "preference disabled", warmAzs: "test-az-1a", want: "snap-new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.PreferWarmSnapshots = tt.preferWarmSnapshots
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-old", 2*time.Hour, 40, warmTag(tt.warmAzs))
+			addTestSnapshot(s, ec2Client, "snap-new", time.Hour, 40)
+			snapshots := []types.Snapshot{ec2Client.state.Snapshots["snap-old"], ec2Client.state.Snapshots["snap-new"]}
+
+			snapshot, _ := s.selectLatestSnapshot(snapshots)
+			if got := aws.ToString(snapshotID(snapshot)); got != tt.want {
+				t.Errorf("selectLatestSnapshot() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectLatestSnapshotArchived(t *testing.T) {
+	tests := []struct {
+		name         string
+		archived     []string
+		want         string
+		wantArchived string
+	}{
+		{name: "none archived", want: "snap-new"},
+		{name: "latest archived", archived: []string{"snap-new"}, want: "snap-old", wantArchived: "snap-new"},
+		{name: "all archived", archived: []string{"snap-old", "snap-new"}, wantArchived: "snap-new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ec2Client, _ := newTestSnapshotter(t, testConfig())
+			addTestSnapshot(s, ec2Client, "snap-old", 2*time.Hour, 40)
+			addTestSnapshot(s, ec2Client, "snap-new", time.Hour, 40)
+			for _, id := range tt.archived {
+				archiveTestSnapshot(ec2Client, id)
+			}
+			snapshots := []types.Snapshot{ec2Client.state.Snapshots["snap-old"], ec2Client.state.Snapshots["snap-new"]}
+
+			snapshot, archived := s.selectLatestSnapshot(snapshots)
+			if got := aws.ToString(snapshotID(snapshot)); got != tt.want {
+				t.Errorf("selectLatestSnapshot() = %q, want %q", got, tt.want)
+			}
+			if got := aws.ToString(snapshotID(archived)); got != tt.wantArchived {
+				t.Errorf("selectLatestSnapshot() archived = %q, want %q", got, tt.wantArchived)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotArchived(t *testing.T) {
+	tests := []struct {
+		name                   string
+		archivedRestoreTimeout time.Duration
+		wantNewVolume          bool
+	}{
+		{name: "restore disabled", wantNewVolume: true},
+		{name: "restored", archivedRestoreTimeout: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ArchivedRestoreTimeout = tt.archivedRestoreTimeout
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+			archiveTestSnapshot(ec2Client, "snap-1")
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if output.NewVolume != tt.wantNewVolume {
+				t.Errorf("NewVolume = %t, want %t", output.NewVolume, tt.wantNewVolume)
+			}
+			wantTier := types.StorageTierArchive
+			if !tt.wantNewVolume {
+				wantTier = types.StorageTierStandard
+			}
+			if got := ec2Client.state.Snapshots["snap-1"].StorageTier; got != wantTier {
+				t.Errorf("StorageTier = %s, want %s", got, wantTier)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotFailOnCacheMiss(t *testing.T) {
+	tests := []struct {
+		name            string
+		fallbackBackend string
+		tarballExists   bool
+		wantCacheMiss   bool
+	}{
+		{name: "no fallback", wantCacheMiss: true},
+		{name: "S3 fallback without tarball", fallbackBackend: runsOnConfig.FallbackBackendS3, wantCacheMiss: true},
+		{name: "S3 fallback with tarball", fallbackBackend: runsOnConfig.FallbackBackendS3, tarballExists: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.FailOnCacheMiss = true
+			cfg.FallbackBackend = tt.fallbackBackend
+			cfg.FallbackS3Bucket = "bucket"
+			cfg.DisableDefaultBranchFallback = true
+			s, _, recorder := newTestSnapshotter(t, cfg)
+			if !tt.tarballExists {
+				recorder.failures = append(recorder.failures, "aws s3 ls")
+			}
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if gotCacheMiss := errors.Is(err, ErrCacheMiss); gotCacheMiss != tt.wantCacheMiss {
+				t.Fatalf("RestoreSnapshot() error = %v, want cache miss %t", err, tt.wantCacheMiss)
+			}
+			if tt.wantCacheMiss {
+				return
+			}
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if output.NewVolume {
+				t.Errorf("NewVolume = true, want false after restoring the tarball")
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotAttachError(t *testing.T) {
+	tests := []struct {
+		name                string
+		attachErr           error
+		attachBeforeFailing bool
+		wantErr             bool
+	}{
+		{name: "VolumeInUse when attached to this instance", attachErr: &smithy.GenericAPIError{Code: "VolumeInUse"}, attachBeforeFailing: true},
+		{name: "IncorrectState when attached to this instance", attachErr: &smithy.GenericAPIError{Code: "IncorrectState"}, attachBeforeFailing: true},
+		{name: "VolumeInUse when not attached to this instance", attachErr: &smithy.GenericAPIError{Code: "VolumeInUse"}, wantErr: true},
+		{name: "other error", attachErr: &smithy.GenericAPIError{Code: "InvalidParameterValue"}, attachBeforeFailing: true, wantErr: true},
+		{name: "non-API error", attachErr: errors.New("connection reset"), attachBeforeFailing: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, fakeClient, _ := newTestSnapshotter(t, testConfig())
+			addTestSnapshot(s, fakeClient, "snap-1", time.Hour, 40)
+			// Volume IDs are allocated sequentially by the fake client
+			s.ec2Client = &failingAttachEC2Client{fakeEC2Client: fakeClient, attachErr: tt.attachErr, failVolumeIDs: []string{"vol-mock00000001"}, attachBeforeFailing: tt.attachBeforeFailing}
+
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RestoreSnapshot() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && output.VolumeID != "vol-mock00000001" {
+				t.Errorf("RestoreSnapshot() volume = %s, want vol-mock00000001", output.VolumeID)
+			}
+		})
+	}
+}
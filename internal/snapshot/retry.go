@@ -0,0 +1,97 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go"
+)
+
+// Bounds of the action-level retries on throttling, on top of the SDK retries
+const throttleMaxAttempts = 5
+
+// Delays between the retries on throttling. They are shortened in tests.
+var (
+	throttleInitialDelay = 1 * time.Second
+	throttleMaxDelay     = 16 * time.Second
+)
+
+// Bounds of the retries of volume creations when EC2 lacks capacity for the volume type in the AZ. Volumes can only be
+// attached to instances in the same AZ, so they are retried in the same AZ.
+const capacityMaxAttempts = 5
+
+// Delays between the retries on insufficient capacity. They are shortened in tests.
+var (
+	capacityInitialDelay = 5 * time.Second
+	capacityMaxDelay     = 40 * time.Second
+)
+
+// throttlingErrorCodes are the API error codes returned by EC2 when requests are throttled.
+var throttlingErrorCodes = []string{"RequestLimitExceeded", "Throttling", "ThrottlingException", "RequestThrottled", "TooManyRequestsException"}
+
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && slices.Contains(throttlingErrorCodes, apiErr.ErrorCode())
+}
+
+// retryOnThrottling calls fn until it succeeds, returns an error other than throttling, or the attempts are exhausted.
+// The delay between attempts doubles each time.
+func retryOnThrottling[T any](ctx context.Context, s *AWSSnapshotter, operation string, fn func() (T, error)) (T, error) {
+	delay := throttleInitialDelay
+	for attempt := 1; ; attempt++ {
+		output, err := fn()
+		if err == nil || !isThrottlingError(err) || attempt == throttleMaxAttempts {
+			return output, err
+		}
+		s.logger.Warn().Msgf("%s throttled (attempt %d/%d), retrying in %s: %v", operation, attempt, throttleMaxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return output, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, throttleMaxDelay)
+	}
+}
+
+// describeVolumes is DescribeVolumes with retries on throttling.
+func (s *AWSSnapshotter) describeVolumes(ctx context.Context, input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+	return retryOnThrottling(ctx, s, "DescribeVolumes", func() (*ec2.DescribeVolumesOutput, error) {
+		return s.ec2Client.DescribeVolumes(ctx, input)
+	})
+}
+
+// describeSnapshots is DescribeSnapshots with retries on throttling.
+func (s *AWSSnapshotter) describeSnapshots(ctx context.Context, input *ec2.DescribeSnapshotsInput) (*ec2.DescribeSnapshotsOutput, error) {
+	return retryOnThrottling(ctx, s, "DescribeSnapshots", func() (*ec2.DescribeSnapshotsOutput, error) {
+		return s.ec2Client.DescribeSnapshots(ctx, input)
+	})
+}
+
+// createVolume is CreateVolume with retries on throttling, and on insufficient capacity, which is usually transient.
+func (s *AWSSnapshotter) createVolume(ctx context.Context, input *ec2.CreateVolumeInput) (*ec2.CreateVolumeOutput, error) {
+	delay := capacityInitialDelay
+	for attempt := 1; ; attempt++ {
+		output, err := retryOnThrottling(ctx, s, "CreateVolume", func() (*ec2.CreateVolumeOutput, error) {
+			return s.ec2Client.CreateVolume(ctx, input)
+		})
+		var apiErr smithy.APIError
+		if err == nil || !errors.As(err, &apiErr) || apiErr.ErrorCode() != "InsufficientVolumeCapacity" {
+			return output, err
+		}
+		if attempt == capacityMaxAttempts {
+			return nil, fmt.Errorf("insufficient capacity for %s volumes in %s after %d attempts, try again later or use another 'volume_type': %w", input.VolumeType, aws.ToString(input.AvailabilityZone), attempt, err)
+		}
+		s.logger.Warn().Msgf("Insufficient capacity for %s volumes in %s (attempt %d/%d), retrying in %s: %v", input.VolumeType, aws.ToString(input.AvailabilityZone), attempt, capacityMaxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, capacityMaxDelay)
+	}
+}
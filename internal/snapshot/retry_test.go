@@ -0,0 +1,177 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+// setRetryDelays shortens the delays between retries for the duration of the test.
+func setRetryDelays(t *testing.T, delay time.Duration) {
+	t.Helper()
+	delays := []*time.Duration{&throttleInitialDelay, &throttleMaxDelay, &capacityInitialDelay, &capacityMaxDelay}
+	saved := make([]time.Duration, len(delays))
+	for i, d := range delays {
+		saved[i] = *d
+		*d = delay
+	}
+	t.Cleanup(func() {
+		for i, d := range delays {
+			*d = saved[i]
+		}
+	})
+}
+
+func TestRetryOnThrottling(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "RequestLimitExceeded"}
+	tests := []struct {
+		name         string
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{name: "success", wantAttempts: 1},
+		{name: "throttled then success", errs: []error{throttled, throttled}, wantAttempts: 3},
+		{name: "other API error", errs: []error{&smithy.GenericAPIError{Code: "InvalidParameterValue"}}, wantErr: &smithy.GenericAPIError{Code: "InvalidParameterValue"}, wantAttempts: 1},
+		{name: "non-API error", errs: []error{errors.New("connection reset")}, wantErr: errors.New("connection reset"), wantAttempts: 1},
+		{name: "attempts exhausted", errs: []error{throttled, throttled, throttled, throttled, throttled, throttled}, wantErr: throttled, wantAttempts: throttleMaxAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRetryDelays(t, time.Millisecond)
+			s, _, _ := newTestSnapshotter(t, testConfig())
+			attempts := 0
+			output, err := retryOnThrottling(context.Background(), s, "Test", func() (int, error) {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return 0, tt.errs[attempts-1]
+				}
+				return 42, nil
+			})
+			if attempts != tt.wantAttempts {
+				t.Errorf("fn called %d times, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.wantErr != nil {
+				if err == nil || err.Error() != tt.wantErr.Error() {
+					t.Errorf("retryOnThrottling() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || output != 42 {
+				t.Errorf("retryOnThrottling() = %d, %v, want 42, nil", output, err)
+			}
+		})
+	}
+}
+
+func TestRetryOnThrottlingCancelled(t *testing.T) {
+	setRetryDelays(t, time.Hour)
+	s, _, _ := newTestSnapshotter(t, testConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	_, err := retryOnThrottling(ctx, s, "Test", func() (int, error) {
+		attempts++
+		// Cancelled while waiting for the next attempt
+		cancel()
+		return 0, &smithy.GenericAPIError{Code: "Throttling"}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("retryOnThrottling() error = %v, want %v", err, context.Canceled)
+	}
+	if attempts != 1 {
+		t.Errorf("fn called %d times, want 1", attempts)
+	}
+}
+
+// flakyCreateVolumeEC2Client fails the first CreateVolume calls with the given errors.
+type flakyCreateVolumeEC2Client struct {
+	*fakeEC2Client
+	errs  []error
+	calls int
+}
+
+func (c *flakyCreateVolumeEC2Client) CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error) {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return nil, c.errs[c.calls-1]
+	}
+	return c.fakeEC2Client.CreateVolume(ctx, params, optFns...)
+}
+
+func TestCreateVolumeInsufficientCapacity(t *testing.T) {
+	noCapacity := &smithy.GenericAPIError{Code: "InsufficientVolumeCapacity"}
+	throttled := &smithy.GenericAPIError{Code: "RequestLimitExceeded"}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "capacity available", wantCalls: 1},
+		{name: "capacity available after retries", errs: []error{noCapacity, noCapacity}, wantCalls: 3},
+		{name: "throttled then no capacity", errs: []error{throttled, noCapacity, throttled}, wantCalls: 4},
+		{name: "no capacity", errs: slices.Repeat([]error{noCapacity}, capacityMaxAttempts), wantCalls: capacityMaxAttempts, wantErr: true},
+		{name: "other error", errs: []error{&smithy.GenericAPIError{Code: "InvalidParameterValue"}}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRetryDelays(t, time.Millisecond)
+			s, fakeClient, _ := newTestSnapshotter(t, testConfig())
+			ec2Client := &flakyCreateVolumeEC2Client{fakeEC2Client: fakeClient, errs: tt.errs}
+			s.ec2Client = ec2Client
+
+			output, err := s.createVolume(context.Background(), &ec2.CreateVolumeInput{
+				AvailabilityZone: aws.String("test-az-1a"),
+				VolumeType:       types.VolumeTypeGp3,
+				Size:             aws.Int32(40),
+			})
+			if ec2Client.calls != tt.wantCalls {
+				t.Errorf("CreateVolume called %d times, want %d", ec2Client.calls, tt.wantCalls)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("createVolume() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && aws.ToString(output.VolumeId) == "" {
+				t.Errorf("createVolume() returned no volume")
+			}
+		})
+	}
+}
+
+func TestCreateVolumeInsufficientCapacityError(t *testing.T) {
+	setRetryDelays(t, time.Millisecond)
+	s, fakeClient, _ := newTestSnapshotter(t, testConfig())
+	noCapacity := &smithy.GenericAPIError{Code: "InsufficientVolumeCapacity"}
+	s.ec2Client = &flakyCreateVolumeEC2Client{fakeEC2Client: fakeClient, errs: slices.Repeat([]error{noCapacity}, capacityMaxAttempts)}
+
+	_, err := s.createVolume(context.Background(), &ec2.CreateVolumeInput{AvailabilityZone: aws.String("test-az-1a"), VolumeType: types.VolumeTypeIo2})
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "InsufficientVolumeCapacity" {
+		t.Fatalf("createVolume() error = %v, want a wrapped InsufficientVolumeCapacity error", err)
+	}
+	for _, want := range []string{"io2", "test-az-1a", "after 5 attempts", "volume_type"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("createVolume() error = %q, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestCreateVolumeCancelled(t *testing.T) {
+	setRetryDelays(t, time.Hour)
+	s, fakeClient, _ := newTestSnapshotter(t, testConfig())
+	s.ec2Client = &flakyCreateVolumeEC2Client{fakeEC2Client: fakeClient, errs: []error{&smithy.GenericAPIError{Code: "InsufficientVolumeCapacity"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.createVolume(ctx, &ec2.CreateVolumeInput{AvailabilityZone: aws.String("test-az-1a")}); !errors.Is(err, context.Canceled) {
+		t.Errorf("createVolume() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,80 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+// containerRuntime describes a container runtime whose data directory can be snapshotted. Its service must be stopped
+// while the data directory is (un)mounted.
+type containerRuntime struct {
+	name    string
+	service string
+	dataDir string
+	// infoCommand displays the disk usage once the service is restarted, and fails if the runtime is not working
+	infoCommand []string
+}
+
+// runtimeReadyInterval is the delay between checks of the runtime once its service is started.
+const runtimeReadyInterval = 2 * time.Second
+
+var containerRuntimes = map[string]containerRuntime{
+	runsOnConfig.RuntimeDocker: {
+		name:        runsOnConfig.RuntimeDocker,
+		service:     "docker",
+		dataDir:     "/var/lib/docker",
+		infoCommand: []string{"docker", "system", "info"},
+	},
+	runsOnConfig.RuntimeContainerd: {
+		name:        runsOnConfig.RuntimeContainerd,
+		service:     "containerd",
+		dataDir:     "/var/lib/containerd",
+		infoCommand: []string{"ctr", "images", "list"},
+	},
+}
+
+// managedRuntime returns the container runtime selected with the 'runtime' input if mountPoint (or one of the shared
+// paths) is within its data directory, or nil if no runtime needs to be managed.
+func (s *AWSSnapshotter) managedRuntime(mountPoint string) *containerRuntime {
+	runtime, ok := containerRuntimes[s.config.Runtime]
+	if !ok {
+		return nil
+	}
+	for _, path := range s.userPaths(mountPoint) {
+		if strings.HasPrefix(path, runtime.dataDir) {
+			return &runtime
+		}
+	}
+	return nil
+}
+
+// serviceIsActive returns whether the systemd service is running.
+func (s *AWSSnapshotter) serviceIsActive(ctx context.Context, service string) bool {
+	_, err := s.runCommand(ctx, "systemctl", "is-active", "--quiet", service)
+	return err == nil
+}
+
+// waitForRuntime runs the info command of the runtime until it succeeds, as the service may take some time to be ready
+// after being started on slow instances, or until 'runtime_ready_timeout_seconds' elapses.
+func (s *AWSSnapshotter) waitForRuntime(ctx context.Context, runtime *containerRuntime) error {
+	deadline := time.Now().Add(s.config.RuntimeReadyTimeout)
+	for attempt := 1; ; attempt++ {
+		_, err := s.runCommand(ctx, "sudo", runtime.infoCommand...)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(runtimeReadyInterval).After(deadline) {
+			return fmt.Errorf("%s is not ready after %d attempts: %w", runtime.name, attempt, err)
+		}
+		s.logger.Info().Msgf("waitForRuntime: %s is not ready yet (attempt %d), retrying in %s...", runtime.name, attempt, runtimeReadyInterval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(runtimeReadyInterval):
+		}
+	}
+}
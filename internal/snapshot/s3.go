@@ -0,0 +1,87 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+// backendS3 marks volume info for paths restored from the S3 fallback directly on the root disk, without a volume.
+const backendS3 = "s3"
+
+// s3ObjectURI returns the location of the tarball for the current repository, branch, version, platform and arch.
+func (s *AWSSnapshotter) s3ObjectURI() string {
+	key := path.Join(s.config.FallbackS3Prefix, s.config.GithubRepository, s.config.Version, fmt.Sprintf("%s-%s", s.platform(), s.arch()), s.getSnapshotTagValue()+".tar.zst")
+	return fmt.Sprintf("s3://%s/%s", s.config.FallbackS3Bucket, key)
+}
+
+// s3Enabled returns whether the S3 fallback backend is configured.
+func (s *AWSSnapshotter) s3Enabled() bool {
+	return s.config.FallbackBackend == runsOnConfig.FallbackBackendS3
+}
+
+// s3ObjectExists returns whether the tarball of the branch exists in the S3 fallback.
+func (s *AWSSnapshotter) s3ObjectExists(ctx context.Context) bool {
+	_, err := s.runCommand(ctx, "aws", "s3", "ls", s.s3ObjectURI())
+	return err == nil
+}
+
+// restoreFromS3 downloads and extracts the tarball of the branch into dir, if it exists.
+func (s *AWSSnapshotter) restoreFromS3(ctx context.Context, dir string) (bool, error) {
+	uri := s.s3ObjectURI()
+	if !s.s3ObjectExists(ctx) {
+		s.logger.Info().Msgf("restoreFromS3: No tarball found at %s", uri)
+		return false, nil
+	}
+	s.logger.Info().Msgf("restoreFromS3: Extracting %s into %s...", uri, dir)
+	// Arguments are passed as positional parameters, so that they are never interpreted by the shell
+	if _, err := s.runCommand(ctx, "bash", "-o", "pipefail", "-c", `aws s3 cp "$1" - | sudo tar --zstd -xf - -C "$2"`, "bash", uri, dir); err != nil {
+		return false, fmt.Errorf("failed to restore %s from %s: %w", dir, uri, err)
+	}
+	return true, nil
+}
+
+// saveToS3 archives dir as a zstd-compressed tarball, and uploads it to S3.
+func (s *AWSSnapshotter) saveToS3(ctx context.Context, dir string) (string, error) {
+	uri := s.s3ObjectURI()
+	s.logger.Info().Msgf("saveToS3: Uploading %s to %s...", dir, uri)
+	if _, err := s.runCommand(ctx, "bash", "-o", "pipefail", "-c", `sudo tar --zstd -cf - -C "$1" . | aws s3 cp - "$2"`, "bash", dir, uri); err != nil {
+		return "", fmt.Errorf("failed to save %s to %s: %w", dir, uri, err)
+	}
+	return uri, nil
+}
+
+// RestoreFromS3 restores the path from the S3 fallback directly on the root disk, when no volume could be restored.
+func (s *AWSSnapshotter) RestoreFromS3(ctx context.Context, mountPoint string) (*RestoreSnapshotOutput, error) {
+	if _, err := s.runCommand(ctx, "sudo", "mkdir", "-p", mountPoint); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", mountPoint, err)
+	}
+	found, err := s.restoreFromS3(ctx, mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.saveVolumeInfo(&VolumeInfo{MountPoint: mountPoint, Backend: backendS3}); err != nil {
+		return nil, fmt.Errorf("failed to save volume info: %w", err)
+	}
+	return &RestoreSnapshotOutput{NewVolume: !found}, nil
+}
+
+// canCreateSnapshot checks with a dry-run whether the snapshot of the volume is allowed, so that the S3 fallback can
+// be used while the volume is still mounted.
+func (s *AWSSnapshotter) canCreateSnapshot(ctx context.Context, volumeID string) error {
+	_, err := s.ec2Client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{VolumeId: aws.String(volumeID), DryRun: aws.Bool(true)})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
+		return nil
+	}
+	if err == nil {
+		return errors.New("unexpected success of a dry-run snapshot")
+	}
+	return err
+}
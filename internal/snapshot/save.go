@@ -2,19 +2,37 @@ package snapshot
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
 )
 
 const (
 	defaultVolumeLifeDurationMinutes int32 = 20
+	// keptVolumeDuration is how long a volume kept with 'keep_volume' stays available for reuse before being reaped
+	keptVolumeDuration = 2 * time.Hour
+	// pendingSnapshotVolumeDuration is how long the source volume of a snapshot survives after its detachment, extended
+	// by pendingSnapshotGiBPerMinute when the snapshot is not waited for, so that it outlives the snapshot creation.
+	// The rate is conservative, since the first snapshot of a volume copies all its blocks.
+	pendingSnapshotVolumeDuration       = 10 * time.Minute
+	pendingSnapshotGiBPerMinute   int32 = 2
+	// retainedVolumeDuration is how long the source volume of a snapshot stays available with 'delete_source_volume'
+	// set to false before being reaped
+	retainedVolumeDuration = 2 * time.Hour
 )
 
+// ErrVolumeNotFound is returned by CreateSnapshot when the restored volume no longer exists, e.g. because it was
+// deleted by a reaper or a previous partial run. There is nothing to snapshot, and the local state is cleaned up.
+var ErrVolumeNotFound = errors.New("the restored volume no longer exists")
+
 func (s *AWSSnapshotter) CreateSnapshot(ctx context.Context, mountPoint string) (*CreateSnapshotOutput, error) {
 	gitBranch := s.config.GithubRef
 	s.logger.Info().Msgf("CreateSnapshot: Using git ref: %s, Instance ID: %s, MountPoint: %s", gitBranch, s.config.InstanceID, mountPoint)
@@ -25,56 +43,96 @@ func (s *AWSSnapshotter) CreateSnapshot(ctx context.Context, mountPoint string)
 		return nil, fmt.Errorf("failed to load volume info: %w", err)
 	}
 
+	if volumeInfo.Backend == backendS3 {
+		uri, err := s.saveToS3(ctx, mountPoint)
+		if err != nil {
+			return nil, err
+		}
+		return &CreateSnapshotOutput{S3URI: uri}, nil
+	}
+
+	if s.volumeNotFound(ctx, volumeInfo.VolumeID) {
+		s.logger.Warn().Msgf("Warning: Volume %s no longer exists, cleaning up the mount point %s without snapshotting it.", volumeInfo.VolumeID, mountPoint)
+		if err := s.unmountVolume(ctx, mountPoint, volumeInfo); err != nil {
+			s.logger.Warn().Msgf("Warning: %v", err)
+		}
+		if err := s.removeVolumeInfo(mountPoint); err != nil {
+			s.logger.Warn().Msgf("Warning: %v", err)
+		}
+		return nil, fmt.Errorf("volume %s: %w", volumeInfo.VolumeID, ErrVolumeNotFound)
+	}
+
+	if s.s3Enabled() {
+		if err := s.canCreateSnapshot(ctx, volumeInfo.VolumeID); err != nil {
+			s.logger.Warn().Msgf("Warning: EBS snapshots are not available (%v), using the S3 fallback instead", err)
+			uri, err := s.saveToS3(ctx, mountPoint)
+			s.discardVolume(ctx, mountPoint, volumeInfo)
+			if err != nil {
+				return nil, err
+			}
+			return &CreateSnapshotOutput{S3URI: uri}, nil
+		}
+	}
+
+	// Checked before pruning, whose writes would otherwise always make the volume look changed
+	if s.config.SkipUnchanged && s.volumeUnchanged(ctx, volumeInfo) {
+		s.discardVolume(ctx, mountPoint, volumeInfo)
+		return nil, ErrSnapshotUnchanged
+	}
+
+	volumeDeleted := false
+	if s.config.SnapshotLock {
+		acquired, err := s.acquireSnapshotLease(ctx, volumeInfo.VolumeID)
+		if err != nil {
+			s.logger.Warn().Msgf("Warning: %v. Snapshotting without lock.", err)
+		} else if !acquired {
+			s.discardVolume(ctx, mountPoint, volumeInfo)
+			return nil, ErrSnapshotLocked
+		} else {
+			// The lease disappears along with the volume once it is deleted
+			defer func() {
+				if !volumeDeleted {
+					s.releaseSnapshotLease(ctx, volumeInfo.VolumeID)
+				}
+			}()
+		}
+	}
+
 	// 2. Operations on jobVolumeID
-	if strings.HasPrefix(mountPoint, "/var/lib/docker") {
+	if runtime := s.managedRuntime(mountPoint); runtime != nil && runtime.name == runsOnConfig.RuntimeDocker {
 		s.logger.Info().Msgf("CreateSnapshot: Cleaning up useless files...")
-		if _, err := s.runCommand(ctx, "sudo", "docker", "builder", "prune", "-f"); err != nil {
-			s.logger.Warn().Msgf("Warning: failed to prune docker builder: %v", err)
+		for _, command := range dockerPruneCommands(s.config.DockerPruneUntil, s.config.DockerPruneFilters) {
+			if _, err := s.runCommand(ctx, "sudo", command...); err != nil {
+				s.logger.Warn().Msgf("Warning: failed to run %s: %v", strings.Join(command[:3], " "), err)
+			}
 		}
+	}
 
-		s.logger.Info().Msgf("CreateSnapshot: Stopping docker service...")
-		if _, err := s.runCommand(ctx, "sudo", "systemctl", "stop", "docker"); err != nil {
-			s.logger.Warn().Msgf("Warning: failed to stop docker (may not be running or installed): %v", err)
+	// The content of a raw device is managed by the workflow
+	if !volumeInfo.RawDevice {
+		if err := s.writeSentinel(ctx, mountPoint); err != nil {
+			s.logger.Warn().Msgf("Warning: %v. The next restore will report it as missing.", err)
 		}
 	}
 
-	s.logger.Info().Msgf("CreateSnapshot: Unmounting %s (from device %s, volume %s)...", mountPoint, volumeInfo.DeviceName, volumeInfo.VolumeID)
-	if _, err := s.runCommand(ctx, "sudo", "umount", mountPoint); err != nil {
-		dfOutput, checkErr := s.runCommand(ctx, "df", mountPoint)
-		if checkErr == nil && strings.Contains(string(dfOutput), mountPoint) { // If still mounted, then error
-			return nil, fmt.Errorf("failed to unmount %s: %w. Output: %s", mountPoint, err, string(dfOutput))
-		}
-		s.logger.Warn().Msgf("CreateSnapshot: Unmount of %s failed but it seems not mounted anymore: %v", mountPoint, err)
-	} else {
-		s.logger.Info().Msgf("CreateSnapshot: Successfully unmounted %s.", mountPoint)
+	if err := s.unmountVolume(ctx, mountPoint, volumeInfo); err != nil {
+		return nil, err
 	}
 
 	// Update TTL tag on volume to extend until 10min from now
 	_, err = s.ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
 		Resources: []string{volumeInfo.VolumeID},
 		Tags: []types.Tag{
-			{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix()))},
+			{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(pendingSnapshotVolumeDuration).Unix()))},
 		},
 	})
 	if err != nil {
 		s.logger.Warn().Msgf("Failed to update TTL tag on volume %s: %v", volumeInfo.VolumeID, err)
 	}
 
-	s.logger.Info().Msgf("CreateSnapshot: Detaching volume %s...", volumeInfo.VolumeID)
-	_, err = s.ec2Client.DetachVolume(ctx, &ec2.DetachVolumeInput{
-		VolumeId:   aws.String(volumeInfo.VolumeID),
-		InstanceId: aws.String(s.config.InstanceID),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to initiate detach for volume %s: %w", volumeInfo.VolumeID, err)
-	}
-
-	volumeDetachedWaiter := ec2.NewVolumeAvailableWaiter(s.ec2Client, defaultVolumeAvailableWaiterOptions) // Available state implies detached
-	s.logger.Info().Msgf("CreateSnapshot: Waiting for volume %s to become available (detached)...", volumeInfo.VolumeID)
-	if err := volumeDetachedWaiter.Wait(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volumeInfo.VolumeID}}, defaultVolumeAvailableMaxWaitTime); err != nil {
-		return nil, fmt.Errorf("volume %s did not become available (detach) in time: %w", volumeInfo.VolumeID, err)
+	if err := s.detachVolume(ctx, volumeInfo); err != nil {
+		return nil, err
 	}
-	s.logger.Info().Msgf("CreateSnapshot: Volume %s is detached.", volumeInfo.VolumeID)
 
 	// 3. Create new snapshot
 	currentTime := time.Now()
@@ -82,6 +140,17 @@ func (s *AWSSnapshotter) CreateSnapshot(ctx context.Context, mountPoint string)
 	snapshotTags := append(s.defaultTags(), []types.Tag{
 		{Key: aws.String(nameTagKey), Value: aws.String(s.config.SnapshotName)},
 	}...)
+	// Snapshots that will be verified are quarantined until they complete, so that an interrupted run never leaves
+	// an unverified snapshot eligible for restore. Snapshots that are not waited for only become eligible once
+	// completed, since restores only consider completed snapshots.
+	// The first snapshot of a volume has no baseline and takes the longest. Waiting for it avoids that the next runs
+	// start from a blank volume again while it is still pending.
+	waitForInitialSnapshot := volumeInfo.NewVolume && s.config.WaitForInitialSnapshot
+	archive := s.config.StorageTier == runsOnConfig.StorageTierArchive
+	waitForCompletion := waitForInitialSnapshot || s.config.WaitForCompletion || s.config.ReplacePrevious || s.config.FastSnapshotRestore || len(s.config.ShareWithAccounts) > 0 || archive
+	if waitForCompletion {
+		snapshotTags = append(snapshotTags, types.Tag{Key: aws.String(snapshotTagKeyIncomplete), Value: aws.String("true")})
+	}
 	createSnapshotOutput, err := s.ec2Client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
 		VolumeId: aws.String(volumeInfo.VolumeID),
 		TagSpecifications: []types.TagSpecification{
@@ -97,31 +166,462 @@ func (s *AWSSnapshotter) CreateSnapshot(ctx context.Context, mountPoint string)
 	}
 	newSnapshotID := *createSnapshotOutput.SnapshotId
 	s.logger.Info().Msgf("CreateSnapshot: Snapshot %s creation initiated.", newSnapshotID)
+	snapshotEvent := &SnapshotCreatedDetail{
+		Repository:    s.config.GithubRepository,
+		Branch:        s.config.GithubRef,
+		Path:          s.config.Path,
+		SnapshotID:    newSnapshotID,
+		SnapshotName:  s.config.SnapshotName,
+		VolumeID:      volumeInfo.VolumeID,
+		VolumeSizeGiB: aws.ToInt32(createSnapshotOutput.VolumeSize),
+	}
 
-	if volumeInfo.NewVolume {
+	if waitForInitialSnapshot {
 		s.logger.Info().Msgf("CreateSnapshot: creating from a new volume, so waiting for initial snapshot completion. This may take a few minutes.")
 	} else if s.config.WaitForCompletion {
 		s.logger.Info().Msgf("CreateSnapshot: waiting for snapshot completion before returning.")
+	} else if s.config.ReplacePrevious {
+		s.logger.Info().Msgf("CreateSnapshot: waiting for snapshot completion before replacing previous snapshots.")
+	} else if s.config.FastSnapshotRestore {
+		s.logger.Info().Msgf("CreateSnapshot: waiting for snapshot completion before enabling fast snapshot restore.")
+	} else if len(s.config.ShareWithAccounts) > 0 {
+		s.logger.Info().Msgf("CreateSnapshot: waiting for snapshot completion before sharing it.")
+	} else if archive {
+		s.logger.Info().Msgf("CreateSnapshot: waiting for snapshot completion before archiving it.")
 	} else {
 		s.logger.Info().Msgf("CreateSnapshot: not waiting for snapshot completion, returning immediately.")
+		s.putSnapshotCreatedEvent(ctx, snapshotEvent)
+		if s.config.KeepVolume {
+			s.keepVolume(ctx, volumeInfo.VolumeID, newSnapshotID)
+		} else if !s.config.DeleteSourceVolume {
+			s.logger.Info().Msgf("CreateSnapshot: Keeping volume %s, as requested by 'delete_source_volume'", volumeInfo.VolumeID)
+			s.extendVolumeTTL(ctx, volumeInfo.VolumeID, max(retainedVolumeDuration, pendingSnapshotVolumeTTL(aws.ToInt32(createSnapshotOutput.VolumeSize))))
+		} else {
+			s.logger.Info().Msgf("CreateSnapshot: Keeping volume %s until its snapshot completes", volumeInfo.VolumeID)
+			s.extendVolumeTTL(ctx, volumeInfo.VolumeID, pendingSnapshotVolumeTTL(aws.ToInt32(createSnapshotOutput.VolumeSize)))
+		}
 		return &CreateSnapshotOutput{SnapshotID: newSnapshotID}, nil
 	}
 
 	s.logger.Info().Msgf("CreateSnapshot: Waiting for snapshot %s completion...", newSnapshotID)
 	snapshotCompletedWaiter := ec2.NewSnapshotCompletedWaiter(s.ec2Client, defaultSnapshotCompletedWaiterOptions)
-	if err := snapshotCompletedWaiter.Wait(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{newSnapshotID}}, defaultSnapshotCompletedMaxWaitTime); err != nil {
+	err = s.waitWithHeartbeat(ctx, "CreateSnapshot", s.snapshotState(newSnapshotID), func() error {
+		return snapshotCompletedWaiter.Wait(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{newSnapshotID}}, defaultSnapshotCompletedMaxWaitTime)
+	})
+	if err != nil {
+		s.handleIncompleteSnapshot(ctx, newSnapshotID)
 		return nil, fmt.Errorf("snapshot %s did not complete in time: %w", newSnapshotID, err)
 	}
 	s.logger.Info().Msgf("CreateSnapshot: Snapshot %s completed.", newSnapshotID)
 
+	_, err = s.ec2Client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{newSnapshotID},
+		Tags:      []types.Tag{{Key: aws.String(snapshotTagKeyIncomplete)}},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to remove the %s tag from snapshot %s: %v. It will not be used for restores.", snapshotTagKeyIncomplete, newSnapshotID, err)
+	}
+
+	if s.config.FastSnapshotRestore {
+		s.enableFastSnapshotRestore(ctx, newSnapshotID)
+	}
+
+	if len(s.config.ShareWithAccounts) > 0 {
+		s.shareSnapshot(ctx, newSnapshotID, aws.ToBool(createSnapshotOutput.Encrypted))
+	}
+
+	if archive {
+		s.archiveSnapshot(ctx, newSnapshotID)
+	}
+
+	snapshotEvent.Completed = true
+	s.putSnapshotCreatedEvent(ctx, snapshotEvent)
+
+	if s.config.ReplacePrevious {
+		s.deletePreviousSnapshots(ctx, newSnapshotID, aws.ToTime(createSnapshotOutput.StartTime))
+	} else if s.config.FastSnapshotRestore {
+		// Deleted snapshots stop being billed for fast snapshot restore anyway
+		for _, previousSnapshotID := range s.previousSnapshots(ctx, newSnapshotID, aws.ToTime(createSnapshotOutput.StartTime)) {
+			s.disableFastSnapshotRestore(ctx, previousSnapshotID)
+		}
+	}
+
+	if s.config.KeepVolume {
+		s.keepVolume(ctx, volumeInfo.VolumeID, newSnapshotID)
+		return &CreateSnapshotOutput{SnapshotID: newSnapshotID}, nil
+	}
+
+	if !s.config.DeleteSourceVolume {
+		s.logger.Info().Msgf("CreateSnapshot: Keeping volume %s, from which snapshot %s was created, as requested by 'delete_source_volume'", volumeInfo.VolumeID, newSnapshotID)
+		s.extendVolumeTTL(ctx, volumeInfo.VolumeID, retainedVolumeDuration)
+		return &CreateSnapshotOutput{SnapshotID: newSnapshotID}, nil
+	}
+
 	// 5. Delete the jobVolumeID (the volume that was just snapshotted)
 	s.logger.Info().Msgf("CreateSnapshot: Deleting original volume %s as its state is now in snapshot %s...", volumeInfo.VolumeID, newSnapshotID)
 	_, err = s.ec2Client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(volumeInfo.VolumeID)})
 	if err != nil {
 		s.logger.Warn().Msgf("Warning: Failed to delete volume %s: %v. Manual cleanup may be required.", volumeInfo.VolumeID, err)
 	} else {
+		volumeDeleted = true
 		s.logger.Info().Msgf("CreateSnapshot: Volume %s successfully deleted.", volumeInfo.VolumeID)
 	}
 
 	return &CreateSnapshotOutput{SnapshotID: newSnapshotID}, nil
 }
+
+// keepVolume tags the snapshotted volume so that the next restore of the branch reuses it instead of creating a volume
+// from the snapshot, and extends its TTL. Failures are logged only, since the volume is then simply reaped.
+func (s *AWSSnapshotter) keepVolume(ctx context.Context, volumeID string, snapshotID string) {
+	s.logger.Info().Msgf("CreateSnapshot: Keeping volume %s for reuse for %s, as requested by 'keep_volume'", volumeID, keptVolumeDuration)
+	_, err := s.ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{volumeID},
+		Tags: []types.Tag{
+			{Key: aws.String(snapshotTagKeyKept), Value: aws.String(snapshotID)},
+			{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(keptVolumeDuration).Unix()))},
+		},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to tag volume %s for reuse: %v", volumeID, err)
+	}
+}
+
+// pendingSnapshotVolumeTTL returns how long to keep the source volume of a snapshot that is not waited for, scaled by
+// the size of the volume so that large volumes are not reaped before their snapshot completes.
+func pendingSnapshotVolumeTTL(volumeSizeGiB int32) time.Duration {
+	return pendingSnapshotVolumeDuration + time.Duration(volumeSizeGiB/pendingSnapshotGiBPerMinute)*time.Minute
+}
+
+// extendVolumeTTL updates the TTL tag of the volume to expire after ttl. Failures are logged only, since the volume is
+// then simply reaped earlier.
+func (s *AWSSnapshotter) extendVolumeTTL(ctx context.Context, volumeID string, ttl time.Duration) {
+	s.logger.Info().Msgf("CreateSnapshot: Volume %s will be reaped in %s", volumeID, ttl)
+	_, err := s.ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{volumeID},
+		Tags: []types.Tag{
+			{Key: aws.String(ttlTagKey), Value: aws.String(fmt.Sprintf("%d", time.Now().Add(ttl).Unix()))},
+		},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to update TTL tag on volume %s: %v", volumeID, err)
+	}
+}
+
+// discardVolume unmounts, detaches and deletes the volume without snapshotting it. Failures are logged only, since
+// the volume expires with its TTL tag anyway.
+func (s *AWSSnapshotter) discardVolume(ctx context.Context, mountPoint string, volumeInfo *VolumeInfo) {
+	s.logger.Info().Msgf("discardVolume: Discarding volume %s without snapshotting it...", volumeInfo.VolumeID)
+	if err := s.unmountVolume(ctx, mountPoint, volumeInfo); err != nil {
+		s.logger.Warn().Msgf("Warning: %v. Volume %s will be cleaned up once its TTL expires.", err, volumeInfo.VolumeID)
+		return
+	}
+	if err := s.detachVolume(ctx, volumeInfo); err != nil {
+		s.logger.Warn().Msgf("Warning: %v. Volume %s will be cleaned up once its TTL expires.", err, volumeInfo.VolumeID)
+		return
+	}
+	if _, err := s.ec2Client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(volumeInfo.VolumeID)}); err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to delete volume %s: %v. Manual cleanup may be required.", volumeInfo.VolumeID, err)
+		return
+	}
+	s.logger.Info().Msgf("discardVolume: Volume %s successfully deleted.", volumeInfo.VolumeID)
+}
+
+// volumeNotFound returns whether EC2 reports that the volume does not exist. Other errors are logged only, and the
+// volume is then assumed to exist, so that actual failures are reported by the next operations.
+func (s *AWSSnapshotter) volumeNotFound(ctx context.Context, volumeID string) bool {
+	output, err := s.describeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volumeID}})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidVolume.NotFound" {
+		return true
+	}
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Unable to check whether volume %s exists: %v", volumeID, err)
+		return false
+	}
+	return len(output.Volumes) == 0
+}
+
+// previousSnapshots returns the IDs of the completed snapshots with the same selection tags (repository, branch, arch,
+// platform, version and custom tags) that were started before the given snapshot. Failures are logged only.
+func (s *AWSSnapshotter) previousSnapshots(ctx context.Context, snapshotID string, startTime time.Time) []string {
+	filters := []types.Filter{
+		{Name: aws.String("status"), Values: []string{string(types.SnapshotStateCompleted)}},
+	}
+	for _, tag := range s.selectionTags() {
+		filters = append(filters, types.Filter{Name: aws.String(fmt.Sprintf("tag:%s", *tag.Key)), Values: []string{*tag.Value}})
+	}
+	snapshotsOutput, err := s.describeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		Filters:  filters,
+		OwnerIds: []string{"self"},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to list previous snapshots for branch %s: %v", s.config.GithubRef, err)
+		return nil
+	}
+
+	previousSnapshotIDs := []string{}
+	for _, snapshot := range snapshotsOutput.Snapshots {
+		previousSnapshotID := aws.ToString(snapshot.SnapshotId)
+		if previousSnapshotID == snapshotID || snapshot.StartTime == nil || !snapshot.StartTime.Before(startTime) {
+			continue
+		}
+		previousSnapshotIDs = append(previousSnapshotIDs, previousSnapshotID)
+	}
+	return previousSnapshotIDs
+}
+
+// deletePreviousSnapshots deletes the previous snapshots replaced by the given snapshot. Failures are logged only.
+func (s *AWSSnapshotter) deletePreviousSnapshots(ctx context.Context, snapshotID string, startTime time.Time) {
+	for _, previousSnapshotID := range s.previousSnapshots(ctx, snapshotID, startTime) {
+		s.logger.Info().Msgf("CreateSnapshot: Deleting previous snapshot %s replaced by %s...", previousSnapshotID, snapshotID)
+		if _, err := s.ec2Client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(previousSnapshotID)}); err != nil {
+			s.logger.Warn().Msgf("Warning: Failed to delete previous snapshot %s: %v", previousSnapshotID, err)
+		}
+	}
+}
+
+// handleIncompleteSnapshot applies the 'incomplete_snapshot_policy' to a snapshot that did not complete in time,
+// so that it never gets selected for a restore later on. Failures are logged only.
+func (s *AWSSnapshotter) handleIncompleteSnapshot(ctx context.Context, snapshotID string) {
+	switch s.config.IncompleteSnapshotPolicy {
+	case runsOnConfig.IncompleteSnapshotPolicyDelete:
+		s.logger.Warn().Msgf("CreateSnapshot: Deleting incomplete snapshot %s...", snapshotID)
+		if _, err := s.ec2Client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotID)}); err != nil {
+			s.logger.Warn().Msgf("Warning: Failed to delete incomplete snapshot %s: %v. It stays quarantined with the %s tag, but manual cleanup may be required.", snapshotID, err, snapshotTagKeyIncomplete)
+		}
+	case runsOnConfig.IncompleteSnapshotPolicyTag:
+		s.logger.Warn().Msgf("CreateSnapshot: Keeping incomplete snapshot %s quarantined with the %s tag", snapshotID, snapshotTagKeyIncomplete)
+	default:
+		s.logger.Warn().Msgf("CreateSnapshot: Keeping incomplete snapshot %s and removing the %s tag, as requested", snapshotID, snapshotTagKeyIncomplete)
+		_, err := s.ec2Client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+			Resources: []string{snapshotID},
+			Tags:      []types.Tag{{Key: aws.String(snapshotTagKeyIncomplete)}},
+		})
+		if err != nil {
+			s.logger.Warn().Msgf("Warning: Failed to remove the %s tag from snapshot %s: %v", snapshotTagKeyIncomplete, snapshotID, err)
+		}
+	}
+}
+
+// ReleaseVolume unmounts and detaches the volume mounted at mountPoint, without snapshotting it. It is used in
+// persistent_volume mode, where the same volume is re-attached by the next run, for multi-attach volumes, which other
+// runners may still use, and for read-only volumes, which have nothing to save and are deleted.
+func (s *AWSSnapshotter) ReleaseVolume(ctx context.Context, mountPoint string) error {
+	s.logger.Info().Msgf("ReleaseVolume: Instance ID: %s, MountPoint: %s", s.config.InstanceID, mountPoint)
+
+	volumeInfo, err := s.loadVolumeInfo(mountPoint)
+	if err != nil {
+		return fmt.Errorf("failed to load volume info: %w", err)
+	}
+	if volumeInfo.Backend == backendS3 {
+		s.logger.Info().Msgf("ReleaseVolume: %s was restored from the S3 fallback, nothing to release", mountPoint)
+		return s.removeVolumeInfo(mountPoint)
+	}
+
+	if err := s.unmountVolume(ctx, mountPoint, volumeInfo); err != nil {
+		return err
+	}
+	if s.config.MultiAttach {
+		// Other runners may still use the volume, so only the attachment to this instance is released
+		err = s.detachFromInstance(ctx, volumeInfo)
+	} else {
+		err = s.detachVolume(ctx, volumeInfo)
+	}
+	if err != nil {
+		return err
+	}
+	if s.config.Mode != runsOnConfig.ModePersistentVolume && !s.config.MultiAttach {
+		// The volume was only created for this job, so it is deleted instead of waiting for its TTL to expire
+		if _, err := s.ec2Client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(volumeInfo.VolumeID)}); err != nil {
+			s.logger.Warn().Msgf("Warning: Failed to delete volume %s: %v. It will be cleaned up once its TTL expires.", volumeInfo.VolumeID, err)
+		} else {
+			s.logger.Info().Msgf("ReleaseVolume: Volume %s successfully deleted.", volumeInfo.VolumeID)
+		}
+	}
+
+	return s.removeVolumeInfo(mountPoint)
+}
+
+// detachFromInstance detaches the multi-attach volume from this instance, and waits until its attachment to the
+// instance is gone. Attachments to other instances are left untouched.
+func (s *AWSSnapshotter) detachFromInstance(ctx context.Context, volumeInfo *VolumeInfo) error {
+	s.logger.Info().Msgf("detachVolume: Detaching volume %s from instance %s...", volumeInfo.VolumeID, s.config.InstanceID)
+	_, err := s.ec2Client.DetachVolume(ctx, &ec2.DetachVolumeInput{
+		VolumeId:   aws.String(volumeInfo.VolumeID),
+		InstanceId: aws.String(s.config.InstanceID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initiate detach for volume %s: %w", volumeInfo.VolumeID, err)
+	}
+
+	deadline := time.Now().Add(defaultVolumeAvailableMaxWaitTime)
+	for {
+		output, err := s.describeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volumeInfo.VolumeID}})
+		if err != nil {
+			return fmt.Errorf("failed to describe volume %s to verify detach: %w", volumeInfo.VolumeID, err)
+		}
+		if len(output.Volumes) == 0 || !slices.ContainsFunc(output.Volumes[0].Attachments, func(attachment types.VolumeAttachment) bool {
+			return aws.ToString(attachment.InstanceId) == s.config.InstanceID && attachment.State != types.VolumeAttachmentStateDetached
+		}) {
+			s.logger.Info().Msgf("detachVolume: Volume %s is detached from instance %s.", volumeInfo.VolumeID, s.config.InstanceID)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("volume %s is still attached to instance %s after %s", volumeInfo.VolumeID, s.config.InstanceID, defaultVolumeAvailableMaxWaitTime)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(defaultDetachVerifyInterval):
+		}
+	}
+}
+
+// Cleanup is a best-effort unmount and detach of the volume recorded for mountPoint, used when the job is cancelled.
+// It does not wait for the detach to complete, so that it fits within the short grace period given on cancellation.
+func (s *AWSSnapshotter) Cleanup(ctx context.Context, mountPoint string) error {
+	s.logger.Info().Msgf("Cleanup: Instance ID: %s, MountPoint: %s", s.config.InstanceID, mountPoint)
+
+	volumeInfo, err := s.loadVolumeInfo(mountPoint)
+	if err != nil {
+		return fmt.Errorf("failed to load volume info: %w", err)
+	}
+	if volumeInfo.Backend == backendS3 {
+		s.logger.Info().Msgf("Cleanup: %s was restored from the S3 fallback, nothing to clean up", mountPoint)
+		return nil
+	}
+
+	if err := s.unmountVolume(ctx, mountPoint, volumeInfo); err != nil {
+		s.logger.Warn().Msgf("Cleanup: %v. Detaching anyway.", err)
+	}
+
+	s.logger.Info().Msgf("Cleanup: Detaching volume %s...", volumeInfo.VolumeID)
+	_, err = s.ec2Client.DetachVolume(ctx, &ec2.DetachVolumeInput{
+		VolumeId:   aws.String(volumeInfo.VolumeID),
+		InstanceId: aws.String(s.config.InstanceID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initiate detach for volume %s: %w", volumeInfo.VolumeID, err)
+	}
+	s.logger.Info().Msgf("Cleanup: Detach of volume %s initiated.", volumeInfo.VolumeID)
+
+	return nil
+}
+
+// unmountVolume stops services using the mount point (if any), and unmounts it.
+func (s *AWSSnapshotter) unmountVolume(ctx context.Context, mountPoint string, volumeInfo *VolumeInfo) error {
+	if runtime := s.managedRuntime(mountPoint); runtime != nil && s.config.ManageRuntime {
+		s.logger.Info().Msgf("unmountVolume: Stopping %s service...", runtime.service)
+		if _, err := s.runCommand(ctx, "sudo", "systemctl", "stop", runtime.service); err != nil {
+			s.logger.Warn().Msgf("Warning: failed to stop %s (may not be running or installed): %v", runtime.service, err)
+		}
+	}
+
+	// Flush any pending writes, so that the snapshot captures a consistent filesystem state
+	if _, err := s.runCommand(ctx, "sudo", "sync"); err != nil {
+		s.logger.Warn().Msgf("Warning: failed to sync filesystems: %v", err)
+	}
+	if volumeInfo.RawDevice {
+		// Whatever uses the raw device must have released it already
+		s.logger.Info().Msgf("unmountVolume: Raw device %s (volume %s) is not mounted by the action, nothing to unmount.", volumeInfo.DeviceName, volumeInfo.VolumeID)
+		return nil
+	}
+	if s.config.DropCaches {
+		// Make sure nothing is served from the page cache anymore, at the cost of a colder cache for other processes
+		if _, err := s.runCommand(ctx, "sudo", "sysctl", "-w", "vm.drop_caches=3"); err != nil {
+			s.logger.Warn().Msgf("Warning: failed to drop caches: %v", err)
+		}
+	}
+
+	if err := s.unbindSharedPaths(ctx, volumeInfo); err != nil {
+		return err
+	}
+	if err := s.unmountOverlay(ctx, volumeInfo); err != nil {
+		return err
+	}
+
+	s.logger.Info().Msgf("unmountVolume: Unmounting %s (from device %s, volume %s)...", mountPoint, volumeInfo.DeviceName, volumeInfo.VolumeID)
+	if _, err := s.runCommand(ctx, "sudo", "umount", mountPoint); err != nil {
+		mounted, checkErr := s.isMountPoint(ctx, mountPoint)
+		if checkErr != nil {
+			return fmt.Errorf("failed to unmount %s: %w, and could not verify whether it is still mounted: %v", mountPoint, err, checkErr)
+		}
+		if mounted {
+			return fmt.Errorf("failed to unmount %s: %w", mountPoint, err)
+		}
+		s.logger.Warn().Msgf("unmountVolume: Unmount of %s failed but it seems not mounted anymore: %v", mountPoint, err)
+	} else {
+		s.logger.Info().Msgf("unmountVolume: Successfully unmounted %s.", mountPoint)
+	}
+
+	return nil
+}
+
+// detachVolume detaches the volume from the instance, and waits until it is available again. If the detach does not
+// complete in time and 'force_detach' is set, it retries once with a forced detach.
+func (s *AWSSnapshotter) detachVolume(ctx context.Context, volumeInfo *VolumeInfo) error {
+	err := s.detachVolumeAndWait(ctx, volumeInfo, false)
+	if err == nil || !s.config.ForceDetach {
+		return err
+	}
+
+	s.logger.Warn().Msgf("detachVolume: %v", err)
+	s.logger.Warn().Msgf("Warning: FORCE-DETACHING volume %s as 'force_detach' is set. Data not flushed to the volume may be lost, and the snapshot may be inconsistent!", volumeInfo.VolumeID)
+	return s.detachVolumeAndWait(ctx, volumeInfo, true)
+}
+
+// detachVolumeAndWait initiates a (possibly forced) detach of the volume, and waits until it has no attachment left.
+func (s *AWSSnapshotter) detachVolumeAndWait(ctx context.Context, volumeInfo *VolumeInfo, force bool) error {
+	s.logger.Info().Msgf("detachVolume: Detaching volume %s (force: %t)...", volumeInfo.VolumeID, force)
+	_, err := s.ec2Client.DetachVolume(ctx, &ec2.DetachVolumeInput{
+		VolumeId:   aws.String(volumeInfo.VolumeID),
+		InstanceId: aws.String(s.config.InstanceID),
+		Force:      aws.Bool(force),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initiate detach for volume %s: %w", volumeInfo.VolumeID, err)
+	}
+
+	volumeDetachedWaiter := ec2.NewVolumeAvailableWaiter(s.ec2Client, defaultVolumeAvailableWaiterOptions) // Available state implies detached
+	s.logger.Info().Msgf("detachVolume: Waiting for volume %s to become available (detached)...", volumeInfo.VolumeID)
+	err = s.waitWithHeartbeat(ctx, "detachVolume", s.volumeState(volumeInfo.VolumeID), func() error {
+		return volumeDetachedWaiter.Wait(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volumeInfo.VolumeID}}, defaultVolumeAvailableMaxWaitTime)
+	})
+	if err != nil {
+		return fmt.Errorf("volume %s did not become available (detach) in time, it may still be in use on the instance: %w", volumeInfo.VolumeID, err)
+	}
+	if err := s.waitForNoAttachments(ctx, volumeInfo.VolumeID); err != nil {
+		return err
+	}
+	s.logger.Info().Msgf("detachVolume: Volume %s is detached.", volumeInfo.VolumeID)
+
+	return nil
+}
+
+// waitForNoAttachments polls the volume until its attachment list is empty, so that a snapshot is never taken from
+// a volume that is still detaching.
+func (s *AWSSnapshotter) waitForNoAttachments(ctx context.Context, volumeID string) error {
+	deadline := time.Now().Add(defaultDetachVerifyMaxWaitTime)
+	for {
+		output, err := s.describeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volumeID}})
+		if err != nil {
+			return fmt.Errorf("failed to describe volume %s to verify detach: %w", volumeID, err)
+		}
+		if len(output.Volumes) == 0 {
+			return fmt.Errorf("volume %s not found while verifying detach", volumeID)
+		}
+		attachments := output.Volumes[0].Attachments
+		if len(attachments) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("volume %s is still attached to %s (state: %s) after %s", volumeID, aws.ToString(attachments[0].InstanceId), attachments[0].State, defaultDetachVerifyMaxWaitTime)
+		}
+		s.logger.Info().Msgf("waitForNoAttachments: Volume %s still has an attachment in state %s, waiting...", volumeID, attachments[0].State)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(defaultDetachVerifyInterval):
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package snapshot
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+func TestHandleIncompleteSnapshot(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         string
+		wantDeleted    bool
+		wantIncomplete bool
+	}{
+		{name: "delete", policy: runsOnConfig.IncompleteSnapshotPolicyDelete, wantDeleted: true},
+		{name: "tag", policy: runsOnConfig.IncompleteSnapshotPolicyTag, wantIncomplete: true},
+		{name: "keep", policy: runsOnConfig.IncompleteSnapshotPolicyKeep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.IncompleteSnapshotPolicy = tt.policy
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			ec2Client.state.Snapshots["snap-1"] = types.Snapshot{
+				SnapshotId: aws.String("snap-1"),
+				State:      types.SnapshotStatePending,
+				Tags:       []types.Tag{{Key: aws.String(snapshotTagKeyIncomplete), Value: aws.String("true")}},
+			}
+
+			s.handleIncompleteSnapshot(context.Background(), "snap-1")
+
+			snapshot, ok := ec2Client.state.Snapshots["snap-1"]
+			if ok == tt.wantDeleted {
+				t.Fatalf("snapshot exists = %t, want %t", ok, !tt.wantDeleted)
+			}
+			if tt.wantDeleted {
+				return
+			}
+			if _, incomplete := tagValue(snapshot.Tags, snapshotTagKeyIncomplete); incomplete != tt.wantIncomplete {
+				t.Errorf("snapshot tagged as incomplete = %t, want %t", incomplete, tt.wantIncomplete)
+			}
+		})
+	}
+}
+
+func TestPendingSnapshotVolumeTTL(t *testing.T) {
+	tests := []struct {
+		volumeSizeGiB int32
+		want          time.Duration
+	}{
+		{volumeSizeGiB: 1, want: 10 * time.Minute},
+		{volumeSizeGiB: 40, want: 30 * time.Minute},
+		{volumeSizeGiB: 1000, want: 510 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := pendingSnapshotVolumeTTL(tt.volumeSizeGiB); got != tt.want {
+			t.Errorf("pendingSnapshotVolumeTTL(%d) = %s, want %s", tt.volumeSizeGiB, got, tt.want)
+		}
+	}
+}
+
+func TestReleaseVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		readOnly    bool
+		multiAttach bool
+		mode        string
+		wantDeleted bool
+	}{
+		{name: "read-only", readOnly: true, mode: runsOnConfig.ModeSnapshot, wantDeleted: true},
+		{name: "multi-attach", readOnly: true, multiAttach: true, mode: runsOnConfig.ModeSnapshot},
+		{name: "persistent", mode: runsOnConfig.ModePersistentVolume},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ReadOnly = tt.readOnly
+			cfg.MultiAttach = tt.multiAttach
+			cfg.Mode = tt.mode
+			if tt.multiAttach {
+				cfg.VolumeType = types.VolumeTypeIo2
+			}
+			s, ec2Client, recorder := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+			output, err := s.RestoreSnapshot(context.Background(), "/mnt/cache")
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+
+			if err := s.ReleaseVolume(context.Background(), "/mnt/cache"); err != nil {
+				t.Fatalf("ReleaseVolume() error = %v", err)
+			}
+			if !recorder.ran("sudo umount /mnt/cache") {
+				t.Errorf("volume was not unmounted")
+			}
+			volume, exists := ec2Client.state.Volumes[output.VolumeID]
+			if exists == tt.wantDeleted {
+				t.Fatalf("volume exists = %t, want %t", exists, !tt.wantDeleted)
+			}
+			if exists && len(volume.Attachments) > 0 {
+				t.Errorf("volume is still attached: %v", volume.Attachments)
+			}
+			if len(ec2Client.state.Snapshots) != 1 {
+				t.Errorf("%d snapshots, want only the restored one", len(ec2Client.state.Snapshots))
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotReplacePrevious(t *testing.T) {
+	tests := []struct {
+		name            string
+		replacePrevious bool
+		wantOldDeleted  bool
+	}{
+		{name: "previous snapshots kept by default"},
+		{name: "previous snapshots replaced", replacePrevious: true, wantOldDeleted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ReplacePrevious = tt.replacePrevious
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-old", time.Hour, 40)
+			addTestSnapshot(s, ec2Client, "snap-older", 2*time.Hour, 40)
+			addBranchSnapshot(s, ec2Client, "snap-other-branch", "feature", time.Hour)
+
+			output := restoreAndSnapshot(t, s)
+
+			for _, id := range []string{"snap-old", "snap-older"} {
+				if _, exists := ec2Client.state.Snapshots[id]; exists == tt.wantOldDeleted {
+					t.Errorf("snapshot %s exists = %t, want %t", id, exists, !tt.wantOldDeleted)
+				}
+			}
+			for _, id := range []string{"snap-other-branch", output.SnapshotID} {
+				if _, exists := ec2Client.state.Snapshots[id]; !exists {
+					t.Errorf("snapshot %s was deleted", id)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotSourceVolume(t *testing.T) {
+	tests := []struct {
+		name               string
+		keepVolume         bool
+		deleteSourceVolume bool
+		waitForCompletion  bool
+		wantDeleted        bool
+		wantKept           bool
+		wantTTL            time.Duration
+	}{
+		{name: "deleted once the snapshot completes", deleteSourceVolume: true, waitForCompletion: true, wantDeleted: true},
+		{name: "left until the pending snapshot completes", deleteSourceVolume: true, wantTTL: pendingSnapshotVolumeTTL(40)},
+		{name: "retained with delete_source_volume disabled", waitForCompletion: true, wantTTL: retainedVolumeDuration},
+		{name: "kept for reuse", keepVolume: true, deleteSourceVolume: true, waitForCompletion: true, wantKept: true, wantTTL: keptVolumeDuration},
+		{name: "kept for reuse without waiting", keepVolume: true, deleteSourceVolume: true, wantKept: true, wantTTL: keptVolumeDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.KeepVolume = tt.keepVolume
+			cfg.DeleteSourceVolume = tt.deleteSourceVolume
+			cfg.WaitForCompletion = tt.waitForCompletion
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+
+			output := restoreAndSnapshot(t, s)
+
+			volumes := slices.Collect(maps.Values(ec2Client.state.Volumes))
+			if tt.wantDeleted {
+				if len(volumes) != 0 {
+					t.Errorf("%d volumes left, want the source volume deleted", len(volumes))
+				}
+				return
+			}
+			if len(volumes) != 1 {
+				t.Fatalf("%d volumes left, want the source volume only", len(volumes))
+			}
+			keptSnapshotID, kept := tagValue(volumes[0].Tags, snapshotTagKeyKept)
+			if kept != tt.wantKept || (kept && keptSnapshotID != output.SnapshotID) {
+				t.Errorf("volume kept tag = %q (%t), want %t for snapshot %s", keptSnapshotID, kept, tt.wantKept, output.SnapshotID)
+			}
+			if got := volumeTTL(t, volumes[0]); got < tt.wantTTL-time.Minute || got > tt.wantTTL {
+				t.Errorf("volume TTL = %s, want %s", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotWaitForInitialSnapshot(t *testing.T) {
+	tests := []struct {
+		name                   string
+		waitForInitialSnapshot bool
+		fromSnapshot           bool
+		wantWait               bool
+	}{
+		{name: "initial snapshot waited for", waitForInitialSnapshot: true, wantWait: true},
+		{name: "initial snapshot not waited for", waitForInitialSnapshot: false},
+		{name: "snapshot of a restored volume not waited for", waitForInitialSnapshot: true, fromSnapshot: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.WaitForInitialSnapshot = tt.waitForInitialSnapshot
+			cfg.DeleteSourceVolume = true
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			if tt.fromSnapshot {
+				addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+			}
+
+			restoreAndSnapshot(t, s)
+
+			// The source volume is deleted once the snapshot completes, or left for the TTL reaper when not waiting for it
+			volumes := slices.Collect(maps.Values(ec2Client.state.Volumes))
+			if deleted := len(volumes) == 0; deleted != tt.wantWait {
+				t.Fatalf("source volume deleted = %t, want %t", deleted, tt.wantWait)
+			}
+			if !tt.wantWait {
+				if got, want := volumeTTL(t, volumes[0]), pendingSnapshotVolumeTTL(40); got < want-time.Minute || got > want {
+					t.Errorf("source volume TTL = %s, want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+// volumeTTL returns the time left before the volume is reaped, according to its TTL tag.
+func volumeTTL(t *testing.T, volume types.Volume) time.Duration {
+	t.Helper()
+	value, ok := tagValue(volume.Tags, ttlTagKey)
+	if !ok {
+		t.Fatalf("volume %s has no %s tag", aws.ToString(volume.VolumeId), ttlTagKey)
+	}
+	deleteAfter, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		t.Fatalf("invalid %s tag %q: %v", ttlTagKey, value, err)
+	}
+	return time.Until(time.Unix(deleteAfter, 0))
+}
+
+// restoreAndSnapshot restores the volume of the branch at /mnt/cache, and snapshots it.
+func restoreAndSnapshot(t *testing.T, s *AWSSnapshotter) *CreateSnapshotOutput {
+	t.Helper()
+	if _, err := s.RestoreSnapshot(context.Background(), "/mnt/cache"); err != nil {
+		t.Fatalf("RestoreSnapshot() error = %v", err)
+	}
+	output, err := s.CreateSnapshot(context.Background(), "/mnt/cache")
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+	return output
+}
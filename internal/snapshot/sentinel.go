@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// sentinelFileName is written at the root of the volume right before it is snapshotted, so that restores can detect
+// snapshots taken from a volume that was not cleanly saved.
+const sentinelFileName = ".runs-on-snapshot-ok"
+
+// sentinel is the content of the sentinel file.
+type sentinel struct {
+	Repository string    `json:"repository"`
+	Branch     string    `json:"branch"`
+	Sha        string    `json:"sha"`
+	Version    string    `json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+	Checksum   string    `json:"checksum"`
+}
+
+// checksum returns the SHA-256 of the metadata of the sentinel.
+func (m *sentinel) checksum() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s", m.Repository, m.Branch, m.Sha, m.Version, m.CreatedAt.UTC().Format(time.RFC3339))))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeSentinel writes the sentinel file at the root of the volume mounted at mountPoint.
+func (s *AWSSnapshotter) writeSentinel(ctx context.Context, mountPoint string) error {
+	m := &sentinel{
+		Repository: s.config.GithubRepository,
+		Branch:     s.config.GithubRef,
+		Sha:        s.config.GithubSha,
+		Version:    s.config.Version,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	m.Checksum = m.checksum()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sentinel: %w", err)
+	}
+	path := filepath.Join(mountPoint, sentinelFileName)
+	// Arguments are passed as positional parameters, so that they are never interpreted by the shell
+	if _, err := s.runCommand(ctx, "sudo", "bash", "-c", `printf '%s\n' "$1" > "$2"`, "bash", string(data), path); err != nil {
+		return fmt.Errorf("failed to write sentinel %s: %w", path, err)
+	}
+	return nil
+}
+
+// verifySentinel checks the sentinel file of a restored volume, and logs a warning if it is missing or invalid. It then
+// removes it (unless the volume is read-only), so that a stale sentinel is never snapshotted again.
+func (s *AWSSnapshotter) verifySentinel(ctx context.Context, mountPoint string) {
+	path := filepath.Join(mountPoint, sentinelFileName)
+	output, err := s.runCommand(ctx, "sudo", "cat", path)
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: sentinel %s is missing: the snapshot may have been taken from a volume that was not cleanly saved (or by an older version of the action)", path)
+		return
+	}
+	var m sentinel
+	if err := json.Unmarshal(output, &m); err != nil || m.Checksum != m.checksum() {
+		s.logger.Warn().Msgf("Warning: sentinel %s is invalid: the snapshot may be incomplete or corrupted", path)
+	} else {
+		s.logger.Info().Msgf("RestoreSnapshot: Sentinel found, saved from %s@%s at %s", m.Branch, m.Sha, m.CreatedAt.Format(time.RFC3339))
+	}
+	if s.config.ReadOnly {
+		return
+	}
+	if _, err := s.runCommand(ctx, "sudo", "rm", "-f", path); err != nil {
+		s.logger.Warn().Msgf("Warning: failed to remove sentinel %s: %v", path, err)
+	}
+}
@@ -0,0 +1,54 @@
+package snapshot
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// awsManagedEBSKeyAlias is the alias of the AWS managed key used to encrypt volumes when no key is given. Its key
+// policy cannot be changed, so snapshots encrypted with it cannot be used by other accounts.
+const awsManagedEBSKeyAlias = "alias/aws/ebs"
+
+// isAWSManagedKey returns whether the 'kms_key_id' designates the AWS managed key, which is also the case when it is
+// empty (unless the account uses a customer managed key for EBS encryption by default).
+func isAWSManagedKey(kmsKeyID string) bool {
+	return kmsKeyID == "" || kmsKeyID == awsManagedEBSKeyAlias || strings.HasSuffix(kmsKeyID, ":"+awsManagedEBSKeyAlias)
+}
+
+// applyEncryption encrypts the volume with the 'kms_key_id', if any. Otherwise the encryption by default settings of
+// the account apply.
+func (s *AWSSnapshotter) applyEncryption(input *ec2.CreateVolumeInput) {
+	if s.config.KmsKeyID == "" {
+		return
+	}
+	input.Encrypted = aws.Bool(true)
+	input.KmsKeyId = aws.String(s.config.KmsKeyID)
+}
+
+// shareSnapshot grants the create volume permission on the completed snapshot to the 'share_with_accounts'. Failures
+// are logged only, since the snapshot is still usable by the account itself.
+func (s *AWSSnapshotter) shareSnapshot(ctx context.Context, snapshotID string, encrypted bool) {
+	if encrypted && isAWSManagedKey(s.config.KmsKeyID) {
+		s.logger.Warn().Msgf("Warning: Snapshot %s is encrypted, but 'kms_key_id' is not set to a customer managed key. Snapshots encrypted with the AWS managed key (%s) cannot be used by other accounts, even once shared: set 'kms_key_id' to a customer managed key whose key policy grants access to accounts %s.", snapshotID, awsManagedEBSKeyAlias, strings.Join(s.config.ShareWithAccounts, ","))
+	} else if encrypted {
+		s.logger.Info().Msgf("CreateSnapshot: Snapshot %s is encrypted with %s: make sure its key policy grants access to accounts %s", snapshotID, s.config.KmsKeyID, strings.Join(s.config.ShareWithAccounts, ","))
+	}
+
+	s.logger.Info().Msgf("CreateSnapshot: Sharing snapshot %s with accounts %s...", snapshotID, strings.Join(s.config.ShareWithAccounts, ","))
+	permissions := []types.CreateVolumePermission{}
+	for _, accountID := range s.config.ShareWithAccounts {
+		permissions = append(permissions, types.CreateVolumePermission{UserId: aws.String(accountID)})
+	}
+	_, err := s.ec2Client.ModifySnapshotAttribute(ctx, &ec2.ModifySnapshotAttributeInput{
+		SnapshotId:             aws.String(snapshotID),
+		Attribute:              types.SnapshotAttributeNameCreateVolumePermission,
+		CreateVolumePermission: &types.CreateVolumePermissionModifications{Add: permissions},
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to share snapshot %s with accounts %s: %v", snapshotID, strings.Join(s.config.ShareWithAccounts, ","), err)
+	}
+}
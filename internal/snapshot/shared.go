@@ -0,0 +1,63 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// sharedSubdir returns the subdirectory of the shared volume holding the content of path.
+func sharedSubdir(path string) string {
+	return mountPointFileName(path)
+}
+
+// userPaths returns the paths seen by the workflow: the bind-mounted paths in 'shared_volume' mode, the overlay path in
+// 'overlay' mode, or the mount point.
+func (s *AWSSnapshotter) userPaths(mountPoint string) []string {
+	if s.config.SharedVolume {
+		return s.config.SharedPaths
+	}
+	if s.config.Overlay {
+		return []string{s.config.OverlayPath}
+	}
+	return []string{mountPoint}
+}
+
+// bindSharedPaths bind-mounts a subdirectory of the volume mounted at mountPoint onto each path of 'shared_volume'
+// mode, and returns the mapping of paths to subdirectories.
+func (s *AWSSnapshotter) bindSharedPaths(ctx context.Context, mountPoint string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, path := range s.config.SharedPaths {
+		source := filepath.Join(mountPoint, sharedSubdir(path))
+		s.logger.Info().Msgf("bindSharedPaths: Bind-mounting %s to %s...", source, path)
+		if _, err := s.runCommand(ctx, "sudo", "mkdir", "-p", source, path); err != nil {
+			return mapping, fmt.Errorf("failed to create directories for %s: %w", path, err)
+		}
+		if _, err := s.runCommand(ctx, "sudo", "mount", "--bind", source, path); err != nil {
+			return mapping, fmt.Errorf("failed to bind-mount %s to %s: %w", source, path, err)
+		}
+		mapping[path] = sharedSubdir(path)
+	}
+	return mapping, nil
+}
+
+// unbindSharedPaths unmounts the bind mounts recorded in the volume info, before the volume itself is unmounted.
+func (s *AWSSnapshotter) unbindSharedPaths(ctx context.Context, volumeInfo *VolumeInfo) error {
+	paths := make([]string, 0, len(volumeInfo.SharedPaths))
+	for path := range volumeInfo.SharedPaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		s.logger.Info().Msgf("unbindSharedPaths: Unmounting bind mount %s...", path)
+		if _, err := s.runCommand(ctx, "sudo", "umount", path); err != nil {
+			mounted, checkErr := s.isMountPoint(ctx, path)
+			if checkErr != nil || mounted {
+				return fmt.Errorf("failed to unmount bind mount %s: %w", path, err)
+			}
+			s.logger.Warn().Msgf("unbindSharedPaths: Unmount of %s failed but it seems not mounted anymore: %v", path, err)
+		}
+	}
+	return nil
+}
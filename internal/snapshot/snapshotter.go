@@ -14,6 +14,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
 	"github.com/rs/zerolog"
 	runsOnConfig "github.com/runs-on/snapshot/internal/config"
 	"github.com/runs-on/snapshot/internal/utils"
@@ -21,19 +22,35 @@ import (
 
 const (
 	// Tags used for resource identification
-	snapshotTagKeyArch       = "runs-on-snapshot-arch"
-	snapshotTagKeyPlatform   = "runs-on-snapshot-platform"
-	snapshotTagKeyBranch     = "runs-on-snapshot-branch"
-	snapshotTagKeyRepository = "runs-on-snapshot-repository"
-	snapshotTagKeyVersion    = "runs-on-snapshot-version"
+	snapshotTagKeyMode       = "runs-on-snapshot-mode"
+	snapshotTagKeySha        = "runs-on-snapshot-sha"
+	runIDTagKey              = "runs-on-run-id"
+	workflowTagKey           = "runs-on-workflow"
+	jobTagKey                = "runs-on-job"
+	snapshotTagKeyIncomplete = "runs-on-snapshot-incomplete"
+	snapshotTagKeyKept       = "runs-on-snapshot-kept"
+	snapshotTagKeyFsrAzs     = "runs-on-snapshot-fsr-azs"
 	nameTagKey               = "Name"
 	timestampTagKey          = "runs-on-timestamp"
 	ttlTagKey                = "runs-on-delete-after"
 
+	// Suffixes of the tags identifying compatible volumes and snapshots, prefixed with the 'tag_prefix' input (see tagKey)
+	tagKeySuffixArch       = "arch"
+	tagKeySuffixPlatform   = "platform"
+	tagKeySuffixBranch     = "branch"
+	tagKeySuffixRepository = "repository"
+	tagKeySuffixVersion    = "version"
+
+	// resourceSpecificTagCount is the number of tags added on top of the default tags (e.g. Name, TTL)
+	resourceSpecificTagCount = 2
+
+	defaultStateDir                     = "/runs-on"
 	suggestedDeviceName                 = "/dev/sdf" // AWS might assign /dev/xvdf etc.
 	defaultVolumeInUseMaxWaitTime       = 5 * time.Minute
 	defaultVolumeAvailableMaxWaitTime   = 5 * time.Minute
 	defaultSnapshotCompletedMaxWaitTime = 10 * time.Minute
+	defaultDetachVerifyMaxWaitTime      = 1 * time.Minute
+	defaultDetachVerifyInterval         = 3 * time.Second
 )
 
 var defaultSnapshotCompletedWaiterOptions = func(o *ec2.SnapshotCompletedWaiterOptions) {
@@ -58,11 +75,42 @@ type Snapshotter interface {
 	DeleteSnapshot(ctx context.Context, id string) error
 }
 
+// ec2API is the subset of the EC2 client used by AWSSnapshotter.
+type ec2API interface {
+	ec2.DescribeVolumesAPIClient
+	ec2.DescribeSnapshotsAPIClient
+	CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error)
+	AttachVolume(ctx context.Context, params *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error)
+	DetachVolume(ctx context.Context, params *ec2.DetachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DetachVolumeOutput, error)
+	DeleteVolume(ctx context.Context, params *ec2.DeleteVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error)
+	CreateSnapshot(ctx context.Context, params *ec2.CreateSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.CreateSnapshotOutput, error)
+	DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error)
+	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+	DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error)
+	EnableFastSnapshotRestores(ctx context.Context, params *ec2.EnableFastSnapshotRestoresInput, optFns ...func(*ec2.Options)) (*ec2.EnableFastSnapshotRestoresOutput, error)
+	DisableFastSnapshotRestores(ctx context.Context, params *ec2.DisableFastSnapshotRestoresInput, optFns ...func(*ec2.Options)) (*ec2.DisableFastSnapshotRestoresOutput, error)
+	ModifySnapshotAttribute(ctx context.Context, params *ec2.ModifySnapshotAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifySnapshotAttributeOutput, error)
+	ModifySnapshotTier(ctx context.Context, params *ec2.ModifySnapshotTierInput, optFns ...func(*ec2.Options)) (*ec2.ModifySnapshotTierOutput, error)
+	RestoreSnapshotTier(ctx context.Context, params *ec2.RestoreSnapshotTierInput, optFns ...func(*ec2.Options)) (*ec2.RestoreSnapshotTierOutput, error)
+}
+
+// execCommandFunc executes a command and returns its combined output.
+type execCommandFunc func(ctx context.Context, name string, arg ...string) ([]byte, error)
+
+func execCommand(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, arg...).CombinedOutput()
+}
+
 // AWSSnapshotter provides methods to manage EBS snapshots and volumes.
 type AWSSnapshotter struct {
-	logger    *zerolog.Logger
-	config    *runsOnConfig.Config
-	ec2Client *ec2.Client
+	logger       *zerolog.Logger
+	config       *runsOnConfig.Config
+	ec2Client    ec2API
+	eventsClient eventBridgeAPI
+	execCommand  execCommandFunc
+	stateDir     string
+	// skipKeptVolumes is set when a kept volume could not be attached, to restore from the snapshot instead
+	skipKeptVolumes bool
 }
 
 // Snapshot struct from the original file - kept for reference, but not directly used by new funcs
@@ -77,11 +125,22 @@ type RestoreSnapshotOutput struct {
 	VolumeID   string
 	DeviceName string
 	NewVolume  bool
+	SnapshotID string // Snapshot the volume was created from, if any
+	// VolumeSizeGiB is the size of the volume, if known
+	VolumeSizeGiB int32
+	// SnapshotStartTime and SnapshotBranch describe the snapshot the volume was created from, if any
+	SnapshotStartTime time.Time
+	SnapshotBranch    string
+	// SnapshotTags are the tags of the snapshot the volume was created from, if any
+	SnapshotTags map[string]string
+	// DefaultBranchFallback is whether the snapshot was found by falling back on the default branch
+	DefaultBranchFallback bool
 }
 
 // CreateSnapshotOutput holds the results of CreateSnapshot.
 type CreateSnapshotOutput struct {
 	SnapshotID string
+	S3URI      string // Location of the tarball when saved to the S3 fallback instead
 }
 
 // VolumeInfo stores information about the mounted volume
@@ -91,14 +150,72 @@ type VolumeInfo struct {
 	MountPoint   string `json:"mount_point"`
 	AttachmentID string `json:"attachment_id,omitempty"`
 	NewVolume    bool   `json:"new_volume,omitempty"`
+	Backend      string `json:"backend,omitempty"` // Set to "s3" when restored from the S3 fallback, without a volume
+	// SharedPaths maps each path bind-mounted from the volume in 'shared_volume' mode to its subdirectory
+	SharedPaths map[string]string `json:"shared_paths,omitempty"`
+	// OverlayPath is the path on which an overlayfs is mounted in 'overlay' mode, with its upper layer on the volume
+	OverlayPath string `json:"overlay_path,omitempty"`
+	// RawDevice is set in 'raw_device' mode, where the volume is only attached, and never formatted nor mounted
+	RawDevice bool `json:"raw_device,omitempty"`
+	// WriteSignature is the signature of the writes to the device once restored, to detect unchanged volumes
+	WriteSignature string `json:"write_signature,omitempty"`
 }
 
 // NewAWSSnapshotter creates a new AWSSnapshotter instance.
 // It initializes the AWS SDK configuration and fetches EC2 instance metadata.
+// When RUNS_ON_SNAPSHOT_MOCK is set, a fake EC2 client and a no-op command runner are used instead.
 func NewAWSSnapshotter(ctx context.Context, logger *zerolog.Logger, cfg *runsOnConfig.Config) (*AWSSnapshotter, error) {
-	awsConfig, err := utils.GetAWSClientFromEC2IMDS(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	snapshotter := &AWSSnapshotter{
+		logger:      logger,
+		config:      cfg,
+		execCommand: execCommand,
+		stateDir:    defaultStateDir,
+	}
+
+	if isMockMode() {
+		logger.Warn().Msgf("%s is set: using a fake EC2 client and not executing any command", mockEnvVar)
+		snapshotter.stateDir = mockStateDir()
+		fakeClient, err := newFakeEC2Client(snapshotter.stateDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create fake EC2 client: %w", err)
+		}
+		snapshotter.ec2Client = fakeClient
+		snapshotter.eventsClient = fakeEventBridgeClient{}
+		snapshotter.execCommand = noopExecCommand
+		if cfg.InstanceID == "" {
+			cfg.InstanceID = mockInstanceID
+		}
+		if cfg.Az == "" {
+			cfg.Az = mockAz
+		}
+	} else {
+		awsConfig, err := utils.GetAWSClientFromEC2IMDS(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+		}
+		if cfg.AssumeRoleARN != "" {
+			logger.Info().Msgf("Assuming role %s for EC2 operations", cfg.AssumeRoleARN)
+			awsConfig = utils.AssumeRole(awsConfig, cfg.AssumeRoleARN, cfg.AssumeRoleExternalID)
+		}
+		snapshotter.ec2Client = ec2.NewFromConfig(*awsConfig)
+		snapshotter.eventsClient = eventbridge.NewFromConfig(*awsConfig)
+
+		if cfg.InstanceID == "" {
+			instanceID, err := utils.GetInstanceID(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("RUNS_ON_INSTANCE_ID is not set, and failed to get the instance ID: %w", err)
+			}
+			cfg.InstanceID = instanceID
+		}
+
+		// A volume can only be attached to an instance in the same AZ, so the actual instance placement always wins
+		instanceAz, err := utils.GetInstanceAZ(ctx)
+		if err != nil {
+			logger.Warn().Msgf("Unable to fetch instance AZ from IMDS, using configured AZ '%s': %v", cfg.Az, err)
+		} else if instanceAz != cfg.Az {
+			logger.Warn().Msgf("Configured AZ '%s' does not match the instance AZ '%s' from IMDS, using the instance AZ", cfg.Az, instanceAz)
+			cfg.Az = instanceAz
+		}
 	}
 
 	if cfg.InstanceID == "" {
@@ -138,11 +255,11 @@ func NewAWSSnapshotter(ctx context.Context, logger *zerolog.Logger, cfg *runsOnC
 		cfg.VolumeName = fmt.Sprintf("runs-on-volume-%s-%s", sanitizedGithubRef, currentTime.Format("20060102-150405"))
 	}
 
-	return &AWSSnapshotter{
-		logger:    logger,
-		config:    cfg,
-		ec2Client: ec2.NewFromConfig(*awsConfig),
-	}, nil
+	if tagCount := len(snapshotter.defaultTags()) + resourceSpecificTagCount; tagCount > runsOnConfig.MaxTagsPerResource {
+		return nil, fmt.Errorf("too many tags: %d tags would be applied to volumes and snapshots, but AWS allows at most %d. Reduce the number of custom tags", tagCount, runsOnConfig.MaxTagsPerResource)
+	}
+
+	return snapshotter, nil
 }
 
 func (s *AWSSnapshotter) arch() string {
@@ -153,13 +270,43 @@ func (s *AWSSnapshotter) platform() string {
 	return runtime.GOOS
 }
 
+// volumeIops returns the IOPS to request for new volumes, or nil for volume types without provisioned IOPS
+// (gp2, st1, sc1, standard), for which AWS rejects the parameter.
+func (s *AWSSnapshotter) volumeIops() *int32 {
+	switch s.config.VolumeType {
+	case types.VolumeTypeGp3, types.VolumeTypeIo1, types.VolumeTypeIo2:
+		return aws.Int32(s.config.VolumeIops)
+	}
+	return nil
+}
+
+// defaultTags returns the tags applied to every volume and snapshot created by the action.
 func (s *AWSSnapshotter) defaultTags() []types.Tag {
+	tags := s.selectionTags()
+	if s.config.GithubSha != "" {
+		tags = append(tags, types.Tag{Key: aws.String(snapshotTagKeySha), Value: aws.String(s.config.GithubSha)})
+	}
+	if s.config.GithubRunID != "" {
+		tags = append(tags, types.Tag{Key: aws.String(runIDTagKey), Value: aws.String(s.config.GithubRunID)})
+	}
+	if s.config.GithubWorkflow != "" {
+		tags = append(tags, types.Tag{Key: aws.String(workflowTagKey), Value: aws.String(s.config.GithubWorkflow)})
+	}
+	if s.config.GithubJob != "" {
+		tags = append(tags, types.Tag{Key: aws.String(jobTagKey), Value: aws.String(s.config.GithubJob)})
+	}
+	return tags
+}
+
+// selectionTags returns the subset of default tags identifying compatible volumes and snapshots, used as filters when restoring.
+// Tags that change on every run (commit, run ID) must not be part of it.
+func (s *AWSSnapshotter) selectionTags() []types.Tag {
 	tags := []types.Tag{
-		{Key: aws.String(snapshotTagKeyVersion), Value: aws.String(s.config.Version)},
-		{Key: aws.String(snapshotTagKeyRepository), Value: aws.String(s.config.GithubRepository)},
-		{Key: aws.String(snapshotTagKeyBranch), Value: aws.String(s.getSnapshotTagValue())},
-		{Key: aws.String(snapshotTagKeyArch), Value: aws.String(s.arch())},
-		{Key: aws.String(snapshotTagKeyPlatform), Value: aws.String(s.platform())},
+		{Key: aws.String(s.tagKey(tagKeySuffixVersion)), Value: aws.String(s.config.Version)},
+		{Key: aws.String(s.tagKey(tagKeySuffixRepository)), Value: aws.String(s.config.GithubRepository)},
+		{Key: aws.String(s.tagKey(tagKeySuffixBranch)), Value: aws.String(s.getSnapshotTagValue())},
+		{Key: aws.String(s.tagKey(tagKeySuffixArch)), Value: aws.String(s.arch())},
+		{Key: aws.String(s.tagKey(tagKeySuffixPlatform)), Value: aws.String(s.platform())},
 	}
 	for _, tag := range s.config.CustomTags {
 		tags = append(tags, types.Tag{Key: aws.String(tag.Key), Value: aws.String(tag.Value)})
@@ -169,7 +316,7 @@ func (s *AWSSnapshotter) defaultTags() []types.Tag {
 
 // saveVolumeInfo writes volume information to a JSON file
 func (s *AWSSnapshotter) saveVolumeInfo(volumeInfo *VolumeInfo) error {
-	infoPath := getVolumeInfoPath(volumeInfo.MountPoint)
+	infoPath := getVolumeInfoPath(s.stateDir, volumeInfo.MountPoint)
 
 	// Create directory if it doesn't exist
 	if err := os.MkdirAll(filepath.Dir(infoPath), 0755); err != nil {
@@ -190,7 +337,7 @@ func (s *AWSSnapshotter) saveVolumeInfo(volumeInfo *VolumeInfo) error {
 
 // loadVolumeInfo reads volume information from a JSON file
 func (s *AWSSnapshotter) loadVolumeInfo(mountPoint string) (*VolumeInfo, error) {
-	infoPath := getVolumeInfoPath(mountPoint)
+	infoPath := getVolumeInfoPath(s.stateDir, mountPoint)
 	data, err := os.ReadFile(infoPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read volume info file: %w", err)
@@ -204,6 +351,35 @@ func (s *AWSSnapshotter) loadVolumeInfo(mountPoint string) (*VolumeInfo, error)
 	return &volumeInfo, nil
 }
 
+// tagKey returns the key of the selection tag with the given suffix, using the 'tag_prefix' input.
+func (s *AWSSnapshotter) tagKey(suffix string) string {
+	return prefixedTagKey(s.config.TagPrefix, suffix)
+}
+
+// prefixedTagKey returns the key of the selection tag with the given prefix and suffix, e.g. runs-on-snapshot-branch.
+func prefixedTagKey(prefix string, suffix string) string {
+	return prefix + "-" + suffix
+}
+
+// tagMap returns the tags as a map of keys to values.
+func tagMap(tags []types.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return m
+}
+
+// tagValue returns the value of the tag with the given key, if present.
+func tagValue(tags []types.Tag, key string) (string, bool) {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value), true
+		}
+	}
+	return "", false
+}
+
 func (s *AWSSnapshotter) getSnapshotTagValue() string {
 	return fmt.Sprintf("%s", s.config.GithubRef)
 }
@@ -215,25 +391,52 @@ func (s *AWSSnapshotter) getSnapshotTagValueDefaultBranch() string {
 // runCommand executes a shell command and returns its combined output or an error.
 // It now requires a context for potential cancellation if the command runs too long.
 func (s *AWSSnapshotter) runCommand(ctx context.Context, name string, arg ...string) ([]byte, error) {
-	cmd := exec.CommandContext(ctx, name, arg...)
 	s.logger.Info().Msgf("Executing command: %s %s", name, strings.Join(arg, " "))
-	output, err := cmd.CombinedOutput()
+	output, err := s.execCommand(ctx, name, arg...)
 	if err != nil {
 		s.logger.Warn().Msgf("Command failed: %s %s\nOutput:\n%s\nError: %v", name, strings.Join(arg, " "), string(output), err)
 		return output, fmt.Errorf("command '%s %s' failed: %s: %w", name, strings.Join(arg, " "), string(output), err)
 	}
-	// Limit log output size for potentially verbose commands
-	logOutput := string(output)
-	if len(logOutput) > 400 {
-		logOutput = logOutput[:200] + "... (output truncated)"
-	}
-	s.logger.Info().Msgf("Command successful. Output (first 200 chars or less):\n%s", logOutput)
+	// The output of successful commands is only logged at debug level, since it can be verbose
+	s.logger.Info().Msgf("Command successful.")
+	s.logger.Debug().Msgf("Command output:\n%s", string(output))
 	return output, nil
 }
 
+// removeVolumeInfo deletes the volume info JSON file of the mount point, if any.
+func (s *AWSSnapshotter) removeVolumeInfo(mountPoint string) error {
+	if err := os.Remove(getVolumeInfoPath(s.stateDir, mountPoint)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove volume info file: %w", err)
+	}
+	return nil
+}
+
 // getVolumeInfoPath returns the path to the volume info JSON file for a given mount point
-func getVolumeInfoPath(mountPoint string) string {
-	// Replace slashes with hyphens and remove leading/trailing hyphens
-	sanitizedPath := strings.Trim(strings.ReplaceAll(mountPoint, "/", "-"), "-")
-	return filepath.Join("/runs-on", fmt.Sprintf("snapshot-%s.json", sanitizedPath))
+func getVolumeInfoPath(stateDir string, mountPoint string) string {
+	return filepath.Join(stateDir, fmt.Sprintf("snapshot-%s.json", mountPointFileName(mountPoint)))
+}
+
+// mountPointFileName turns a mount point into a file name, joining its sanitized segments with hyphens. Hyphens
+// within a segment are escaped, so that /a-b and /a/b do not collide.
+func mountPointFileName(mountPoint string) string {
+	segments := strings.Split(strings.Trim(mountPoint, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = sanitizeFileName(segment)
+	}
+	return strings.Join(segments, "-")
+}
+
+// sanitizeFileName escapes any byte that is not safe in a file name (spaces, quotes, hyphens, etc.) as _XX, so that
+// distinct mount points always map to distinct file names.
+func sanitizeFileName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
 }
@@ -0,0 +1,208 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/rs/zerolog"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+// commandRecorder records the commands run through the execCommand seam, and returns canned outputs for them.
+type commandRecorder struct {
+	mu       sync.Mutex
+	commands []string
+	// outputs maps a command prefix (e.g. "lsblk -d") to its output
+	outputs map[string]string
+	// failures holds the prefixes of the commands that fail
+	failures []string
+}
+
+func (r *commandRecorder) execCommand(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	command := strings.Join(append([]string{name}, arg...), " ")
+	r.commands = append(r.commands, command)
+	for _, prefix := range r.failures {
+		if strings.HasPrefix(command, prefix) {
+			return []byte{}, errors.New("exit status 1")
+		}
+	}
+	for prefix, output := range r.outputs {
+		if strings.HasPrefix(command, prefix) {
+			return []byte(output), nil
+		}
+	}
+	return []byte{}, nil
+}
+
+// ran returns whether a command starting with prefix was run.
+func (r *commandRecorder) ran(prefix string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, command := range r.commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func testConfig() *runsOnConfig.Config {
+	return &runsOnConfig.Config{
+		Mode:                     runsOnConfig.ModeSnapshot,
+		Version:                  "v1",
+		RestoreVersions:          []string{"v1"},
+		Save:                     true,
+		VolumeType:               types.VolumeTypeGp3,
+		VolumeIops:               3000,
+		VolumeThroughput:         750,
+		VolumeSize:               40,
+		Filesystem:               "ext4",
+		GrowToSnapshot:           true,
+		IncompleteSnapshotPolicy: runsOnConfig.IncompleteSnapshotPolicyTag,
+		GithubRef:                "main",
+		GithubRepository:         "owner/repo",
+		InstanceID:               "i-test",
+		Az:                       "test-az-1a",
+		TagPrefix:                runsOnConfig.DefaultTagPrefix,
+		RunnerConfig:             &runsOnConfig.RunnerConfig{DefaultBranch: "main"},
+	}
+}
+
+// newTestSnapshotter returns a snapshotter backed by the fake EC2 client, with its state in a temporary directory.
+func newTestSnapshotter(t *testing.T, cfg *runsOnConfig.Config) (*AWSSnapshotter, *fakeEC2Client, *commandRecorder) {
+	t.Helper()
+	stateDir := t.TempDir()
+	ec2Client, err := newFakeEC2Client(stateDir)
+	if err != nil {
+		t.Fatalf("failed to create fake EC2 client: %v", err)
+	}
+	recorder := &commandRecorder{outputs: map[string]string{}}
+	logger := zerolog.Nop()
+	return &AWSSnapshotter{
+		logger:       &logger,
+		config:       cfg,
+		ec2Client:    ec2Client,
+		eventsClient: fakeEventBridgeClient{},
+		execCommand:  recorder.execCommand,
+		stateDir:     stateDir,
+	}, ec2Client, recorder
+}
+
+// recordingEC2Client records the inputs of the DescribeSnapshots and CreateVolume calls made to the fake EC2 client.
+type recordingEC2Client struct {
+	*fakeEC2Client
+	describeSnapshotsInputs []*ec2.DescribeSnapshotsInput
+	createVolumeInputs      []*ec2.CreateVolumeInput
+}
+
+func (c *recordingEC2Client) DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	c.describeSnapshotsInputs = append(c.describeSnapshotsInputs, params)
+	return c.fakeEC2Client.DescribeSnapshots(ctx, params, optFns...)
+}
+
+func (c *recordingEC2Client) CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error) {
+	c.createVolumeInputs = append(c.createVolumeInputs, params)
+	return c.fakeEC2Client.CreateVolume(ctx, params, optFns...)
+}
+
+// failingAttachEC2Client makes AttachVolume fail with attachErr for the volumes of failVolumeIDs, optionally after
+// attaching them, as when a previous attach request partially succeeded.
+type failingAttachEC2Client struct {
+	*fakeEC2Client
+	attachErr           error
+	failVolumeIDs       []string
+	attachBeforeFailing bool
+}
+
+func (c *failingAttachEC2Client) AttachVolume(ctx context.Context, params *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error) {
+	if !slices.Contains(c.failVolumeIDs, aws.ToString(params.VolumeId)) {
+		return c.fakeEC2Client.AttachVolume(ctx, params, optFns...)
+	}
+	if c.attachBeforeFailing {
+		if _, err := c.fakeEC2Client.AttachVolume(ctx, params, optFns...); err != nil {
+			return nil, err
+		}
+	}
+	return nil, c.attachErr
+}
+
+// addTestSnapshot adds a completed snapshot of the current branch to the fake EC2 client, started the given time ago.
+func addTestSnapshot(s *AWSSnapshotter, ec2Client *fakeEC2Client, id string, age time.Duration, sizeGiB int32, extraTags ...types.Tag) {
+	ec2Client.state.Snapshots[id] = types.Snapshot{
+		SnapshotId:  aws.String(id),
+		State:       types.SnapshotStateCompleted,
+		StartTime:   aws.Time(time.Now().Add(-age)),
+		VolumeSize:  aws.Int32(sizeGiB),
+		StorageTier: types.StorageTierStandard,
+		Tags:        append(s.selectionTags(), extraTags...),
+	}
+}
+
+// addTestVolume adds an available volume of the current branch in the instance AZ to the fake EC2 client.
+func addTestVolume(s *AWSSnapshotter, ec2Client *fakeEC2Client, id string, extraTags ...types.Tag) {
+	ec2Client.state.Volumes[id] = types.Volume{
+		VolumeId:         aws.String(id),
+		State:            types.VolumeStateAvailable,
+		AvailabilityZone: aws.String(s.config.Az),
+		Size:             aws.Int32(s.config.VolumeSize),
+		VolumeType:       s.config.VolumeType,
+		CreateTime:       aws.Time(time.Now()),
+		Tags:             append(s.selectionTags(), extraTags...),
+	}
+}
+
+func TestMountPointFileName(t *testing.T) {
+	tests := []struct {
+		mountPoint string
+		want       string
+	}{
+		{mountPoint: "/var/lib/docker", want: "var-lib-docker"},
+		{mountPoint: "/var/lib/docker/", want: "var-lib-docker"},
+		{mountPoint: "/a-b", want: "a_2db"},
+		{mountPoint: "/a/b", want: "a-b"},
+		{mountPoint: "/home/runner/my cache", want: "home-runner-my_20cache"},
+		{mountPoint: "/cache_dir", want: "cache_5fdir"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mountPoint, func(t *testing.T) {
+			if got := mountPointFileName(tt.mountPoint); got != tt.want {
+				t.Errorf("mountPointFileName(%q) = %q, want %q", tt.mountPoint, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVolumeIops(t *testing.T) {
+	tests := []struct {
+		volumeType types.VolumeType
+		wantIops   bool
+	}{
+		{volumeType: types.VolumeTypeGp3, wantIops: true},
+		{volumeType: types.VolumeTypeIo2, wantIops: true},
+		{volumeType: types.VolumeTypeGp2},
+		{volumeType: types.VolumeTypeSt1},
+		{volumeType: types.VolumeTypeSc1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.volumeType), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.VolumeType = tt.volumeType
+			s, _, _ := newTestSnapshotter(t, cfg)
+			if got := s.volumeIops(); (got != nil) != tt.wantIops {
+				t.Errorf("volumeIops() = %v, want IOPS %t", got, tt.wantIops)
+			}
+		})
+	}
+}
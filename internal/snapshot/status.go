@@ -0,0 +1,129 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Status describes the snapshots and volumes of the repository, as reported by the --status flag.
+type Status struct {
+	Repository string           `json:"repository"`
+	Branch     string           `json:"branch"`
+	Snapshots  []SnapshotStatus `json:"snapshots"`
+	Volumes    []VolumeStatus   `json:"volumes"`
+}
+
+// SnapshotStatus describes a snapshot. In --status, only the latest snapshot of each branch is listed.
+type SnapshotStatus struct {
+	Branch     string    `json:"branch"`
+	Version    string    `json:"version"`
+	SnapshotID string    `json:"snapshot_id"`
+	State      string    `json:"state"`
+	StartTime  time.Time `json:"start_time"`
+	AgeSeconds int64     `json:"age_seconds"`
+	SizeGiB    int32     `json:"size_gib"`
+	Incomplete bool      `json:"incomplete,omitempty"`
+}
+
+// VolumeStatus describes a volume created by the action.
+type VolumeStatus struct {
+	Branch           string   `json:"branch"`
+	VolumeID         string   `json:"volume_id"`
+	State            string   `json:"state"`
+	AvailabilityZone string   `json:"availability_zone"`
+	SizeGiB          int32    `json:"size_gib"`
+	AttachedTo       []string `json:"attached_to,omitempty"`
+}
+
+// Status lists the latest snapshot of each branch (and version) of the repository, and the volumes tagged by the
+// action for the repository. It does not modify anything.
+func (s *AWSSnapshotter) Status(ctx context.Context) (*Status, error) {
+	filters := []types.Filter{
+		{Name: aws.String(fmt.Sprintf("tag:%s", s.tagKey(tagKeySuffixRepository))), Values: []string{s.config.GithubRepository}},
+	}
+
+	snapshotsOutput, err := s.describeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		Filters:  filters,
+		OwnerIds: s.config.SnapshotOwnerIDs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe snapshots for repository %s: %w", s.config.GithubRepository, err)
+	}
+	volumesOutput, err := s.describeVolumes(ctx, &ec2.DescribeVolumesInput{Filters: filters})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe volumes for repository %s: %w", s.config.GithubRepository, err)
+	}
+
+	return buildStatus(s.config.GithubRepository, s.config.GithubRef, s.config.TagPrefix, snapshotsOutput.Snapshots, volumesOutput.Volumes, time.Now()), nil
+}
+
+// buildStatus keeps the latest snapshot per branch and version, and sorts the result for a stable output.
+func buildStatus(repository, branch, tagPrefix string, snapshots []types.Snapshot, volumes []types.Volume, now time.Time) *Status {
+	status := &Status{Repository: repository, Branch: branch, Snapshots: []SnapshotStatus{}, Volumes: []VolumeStatus{}}
+
+	latest := map[string]SnapshotStatus{}
+	for _, snapshot := range snapshots {
+		snapshotStatus := newSnapshotStatus(snapshot, tagPrefix, now)
+		key := snapshotStatus.Branch + "\x00" + snapshotStatus.Version
+		if existing, ok := latest[key]; ok && !existing.StartTime.Before(snapshotStatus.StartTime) {
+			continue
+		}
+		latest[key] = snapshotStatus
+	}
+	for _, snapshotStatus := range latest {
+		status.Snapshots = append(status.Snapshots, snapshotStatus)
+	}
+	sort.Slice(status.Snapshots, func(i, j int) bool {
+		if status.Snapshots[i].Branch != status.Snapshots[j].Branch {
+			return status.Snapshots[i].Branch < status.Snapshots[j].Branch
+		}
+		return status.Snapshots[i].Version < status.Snapshots[j].Version
+	})
+
+	for _, volume := range volumes {
+		volumeBranch, _ := tagValue(volume.Tags, prefixedTagKey(tagPrefix, tagKeySuffixBranch))
+		volumeStatus := VolumeStatus{
+			Branch:           volumeBranch,
+			VolumeID:         aws.ToString(volume.VolumeId),
+			State:            string(volume.State),
+			AvailabilityZone: aws.ToString(volume.AvailabilityZone),
+			SizeGiB:          aws.ToInt32(volume.Size),
+		}
+		for _, attachment := range volume.Attachments {
+			volumeStatus.AttachedTo = append(volumeStatus.AttachedTo, aws.ToString(attachment.InstanceId))
+		}
+		status.Volumes = append(status.Volumes, volumeStatus)
+	}
+	sort.Slice(status.Volumes, func(i, j int) bool {
+		if status.Volumes[i].Branch != status.Volumes[j].Branch {
+			return status.Volumes[i].Branch < status.Volumes[j].Branch
+		}
+		return status.Volumes[i].VolumeID < status.Volumes[j].VolumeID
+	})
+
+	return status
+}
+
+// newSnapshotStatus describes a snapshot from its tags.
+func newSnapshotStatus(snapshot types.Snapshot, tagPrefix string, now time.Time) SnapshotStatus {
+	branch, _ := tagValue(snapshot.Tags, prefixedTagKey(tagPrefix, tagKeySuffixBranch))
+	version, _ := tagValue(snapshot.Tags, prefixedTagKey(tagPrefix, tagKeySuffixVersion))
+	_, incomplete := tagValue(snapshot.Tags, snapshotTagKeyIncomplete)
+	startTime := aws.ToTime(snapshot.StartTime)
+	return SnapshotStatus{
+		Branch:     branch,
+		Version:    version,
+		SnapshotID: aws.ToString(snapshot.SnapshotId),
+		State:      string(snapshot.State),
+		StartTime:  startTime,
+		AgeSeconds: int64(now.Sub(startTime).Seconds()),
+		SizeGiB:    aws.ToInt32(snapshot.VolumeSize),
+		Incomplete: incomplete,
+	}
+}
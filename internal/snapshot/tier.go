@@ -0,0 +1,81 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// archivedRestoreDays is how long archived snapshots are temporarily restored to the standard tier for
+	archivedRestoreDays = 1
+	// archivedRestoreInterval is the delay between checks of the tier of a snapshot being restored
+	archivedRestoreInterval = 1 * time.Minute
+)
+
+// archiveSnapshot moves the completed snapshot to the archive tier, as requested by 'storage_tier'. Failures are logged
+// only, since the snapshot is still usable in the standard tier.
+func (s *AWSSnapshotter) archiveSnapshot(ctx context.Context, snapshotID string) {
+	s.logger.Info().Msgf("CreateSnapshot: Moving snapshot %s to the archive tier...", snapshotID)
+	_, err := s.ec2Client.ModifySnapshotTier(ctx, &ec2.ModifySnapshotTierInput{
+		SnapshotId:  aws.String(snapshotID),
+		StorageTier: types.TargetStorageTierArchive,
+	})
+	if err != nil {
+		s.logger.Warn().Msgf("Warning: Failed to archive snapshot %s: %v. It stays in the standard tier.", snapshotID, err)
+		return
+	}
+	s.logger.Info().Msgf("CreateSnapshot: Snapshot %s is being archived. It must be restored to the standard tier (e.g. with aws ec2 restore-snapshot-tier) before volumes can be created from it.", snapshotID)
+}
+
+// isArchived returns whether the snapshot is in the archive tier, in which case volumes cannot be created from it
+// until it is restored to the standard tier, which takes hours.
+func isArchived(snapshot types.Snapshot) bool {
+	return snapshot.StorageTier == types.StorageTierArchive
+}
+
+// restoreArchivedSnapshot temporarily restores the archived snapshot to the standard tier, and waits for the restore to
+// complete, up to 'archive_restore_timeout_minutes'. It returns the restored snapshot, or nil if it could not be
+// restored in time, in which case a blank volume is used instead.
+func (s *AWSSnapshotter) restoreArchivedSnapshot(ctx context.Context, snapshot *types.Snapshot) *types.Snapshot {
+	snapshotID := aws.ToString(snapshot.SnapshotId)
+	s.logger.Warn().Msgf("RestoreSnapshot: No snapshot in the standard tier found, restoring archived snapshot %s (%d GiB) to the standard tier for %d day(s). Restores are billed per GiB of data retrieved, and the snapshot is billed at the standard tier rate while restored.", snapshotID, aws.ToInt32(snapshot.VolumeSize), archivedRestoreDays)
+	_, err := s.ec2Client.RestoreSnapshotTier(ctx, &ec2.RestoreSnapshotTierInput{
+		SnapshotId:           aws.String(snapshotID),
+		TemporaryRestoreDays: aws.Int32(archivedRestoreDays),
+	})
+	var apiErr smithy.APIError
+	if err != nil && (!errors.As(err, &apiErr) || apiErr.ErrorCode() != "IncorrectState") {
+		s.logger.Warn().Msgf("Warning: Failed to restore archived snapshot %s: %v. A new volume will be created.", snapshotID, err)
+		return nil
+	} else if err != nil {
+		// A restore is already in progress, e.g. initiated by a previous run
+		s.logger.Info().Msgf("RestoreSnapshot: Snapshot %s is already being restored: %v", snapshotID, err)
+	}
+
+	deadline := time.Now().Add(s.config.ArchivedRestoreTimeout)
+	for {
+		output, err := s.describeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapshotID}})
+		if err != nil {
+			s.logger.Warn().Msgf("Warning: Failed to describe snapshot %s: %v", snapshotID, err)
+		} else if len(output.Snapshots) > 0 && !isArchived(output.Snapshots[0]) {
+			s.logger.Info().Msgf("RestoreSnapshot: Snapshot %s restored to the standard tier.", snapshotID)
+			return &output.Snapshots[0]
+		}
+		if time.Now().Add(archivedRestoreInterval).After(deadline) {
+			s.logger.Warn().Msgf("Warning: Snapshot %s was not restored from the archive tier within %s. A new volume will be created, and the next runs will use the snapshot once restored.", snapshotID, s.config.ArchivedRestoreTimeout)
+			return nil
+		}
+		s.logger.Info().Msgf("RestoreSnapshot: Waiting for snapshot %s to be restored from the archive tier...", snapshotID)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(archivedRestoreInterval):
+		}
+	}
+}
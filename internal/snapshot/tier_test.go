@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	runsOnConfig "github.com/runs-on/snapshot/internal/config"
+)
+
+// pendingRestoreEC2Client accepts restores of archived snapshots without ever completing them, or fails them with
+// restoreErr.
+type pendingRestoreEC2Client struct {
+	*fakeEC2Client
+	restoreErr error
+}
+
+func (c *pendingRestoreEC2Client) RestoreSnapshotTier(ctx context.Context, params *ec2.RestoreSnapshotTierInput, optFns ...func(*ec2.Options)) (*ec2.RestoreSnapshotTierOutput, error) {
+	if c.restoreErr != nil {
+		return nil, c.restoreErr
+	}
+	return &ec2.RestoreSnapshotTierOutput{SnapshotId: params.SnapshotId, RestoreStartTime: aws.Time(time.Now())}, nil
+}
+
+// archiveTestSnapshot moves the snapshot of the fake EC2 client to the archive tier.
+func archiveTestSnapshot(ec2Client *fakeEC2Client, id string) {
+	snapshot := ec2Client.state.Snapshots[id]
+	snapshot.StorageTier = types.StorageTierArchive
+	ec2Client.state.Snapshots[id] = snapshot
+}
+
+func TestArchiveSnapshot(t *testing.T) {
+	s, ec2Client, _ := newTestSnapshotter(t, testConfig())
+	addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+
+	s.archiveSnapshot(context.Background(), "snap-1")
+	if got := ec2Client.state.Snapshots["snap-1"].StorageTier; got != types.StorageTierArchive {
+		t.Errorf("StorageTier = %s, want %s", got, types.StorageTierArchive)
+	}
+
+	// Failures are only logged, as the snapshot stays usable in the standard tier
+	s.archiveSnapshot(context.Background(), "snap-missing")
+}
+
+func TestCreateSnapshotStorageTier(t *testing.T) {
+	tests := []struct {
+		name        string
+		storageTier string
+		want        types.StorageTier
+	}{
+		{name: "standard", storageTier: runsOnConfig.StorageTierStandard, want: types.StorageTierStandard},
+		{name: "archive", storageTier: runsOnConfig.StorageTierArchive, want: types.StorageTierArchive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.StorageTier = tt.storageTier
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+
+			output := restoreAndSnapshot(t, s)
+			snapshot, ok := ec2Client.state.Snapshots[output.SnapshotID]
+			if !ok {
+				t.Fatalf("snapshot %s not found", output.SnapshotID)
+			}
+			if snapshot.StorageTier != tt.want {
+				t.Errorf("StorageTier = %s, want %s", snapshot.StorageTier, tt.want)
+			}
+			if value, _ := tagValue(snapshot.Tags, snapshotTagKeyIncomplete); value == "true" {
+				t.Errorf("snapshot still tagged as incomplete")
+			}
+		})
+	}
+}
+
+func TestRestoreArchivedSnapshot(t *testing.T) {
+	tests := []struct {
+		name         string
+		pending      bool
+		restoreErr   error
+		wantRestored bool
+	}{
+		{name: "restored", wantRestored: true},
+		{name: "restore already in progress", pending: true, restoreErr: &smithy.GenericAPIError{Code: "IncorrectState", Message: "snapshot is already being restored"}},
+		{name: "not restored in time", pending: true},
+		{name: "restore failed", pending: true, restoreErr: errors.New("access denied")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			// Shorter than the check interval, so that pending restores are given up after the first check
+			cfg.ArchivedRestoreTimeout = 30 * time.Second
+			s, ec2Client, _ := newTestSnapshotter(t, cfg)
+			addTestSnapshot(s, ec2Client, "snap-1", time.Hour, 40)
+			archiveTestSnapshot(ec2Client, "snap-1")
+			if tt.pending {
+				s.ec2Client = &pendingRestoreEC2Client{fakeEC2Client: ec2Client, restoreErr: tt.restoreErr}
+			}
+
+			archived := ec2Client.state.Snapshots["snap-1"]
+			restored := s.restoreArchivedSnapshot(context.Background(), &archived)
+			if (restored != nil) != tt.wantRestored {
+				t.Fatalf("restoreArchivedSnapshot() = %q, want restored %t", aws.ToString(snapshotID(restored)), tt.wantRestored)
+			}
+			if restored == nil {
+				return
+			}
+			if isArchived(*restored) {
+				t.Errorf("restored snapshot still in the archive tier")
+			}
+			if restored.RestoreExpiryTime == nil {
+				t.Errorf("RestoreExpiryTime not set")
+			}
+		})
+	}
+}
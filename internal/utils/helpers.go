@@ -3,15 +3,27 @@ package utils
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
+// imdsMaxAttempts bounds the attempts of IMDS requests, including the IMDSv2 token request, which may intermittently
+// fail from containers.
+const imdsMaxAttempts = 5
+
 func PrettyPrint(v interface{}) string {
 	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
@@ -26,13 +38,86 @@ func PrettyPrint(v interface{}) string {
 // This ensures that we always assume RunsOn instance profile IAM role, regardless of what happens in other GHA actions/steps.
 func GetAWSClientFromEC2IMDS(context context.Context) (*aws.Config, error) {
 	provider := ec2rolecreds.New(func(o *ec2rolecreds.Options) {
-		o.Client = imds.New(imds.Options{})
+		o.Client = newIMDSClient()
 	})
 
-	cfg, err := config.LoadDefaultConfig(context, config.WithRegion(os.Getenv("RUNS_ON_AWS_REGION")), config.WithCredentialsProvider(aws.NewCredentialsCache(provider)))
+	region := os.Getenv("RUNS_ON_AWS_REGION")
+	if region == "" {
+		output, err := newIMDSClient().GetRegion(context, &imds.GetRegionInput{})
+		if err != nil {
+			return nil, fmt.Errorf("RUNS_ON_AWS_REGION is not set, and failed to get the region: %w", describeIMDSError(err))
+		}
+		region = output.Region
+	}
+
+	cfg, err := config.LoadDefaultConfig(context, config.WithRegion(region), config.WithCredentialsProvider(aws.NewCredentialsCache(provider)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	return &cfg, nil
 }
+
+// AssumeRole returns a copy of cfg whose credentials are those of the given role, assumed with the credentials of cfg
+// (e.g. the instance profile) and refreshed before they expire. externalID is optional.
+func AssumeRole(cfg *aws.Config, roleARN string, externalID string) *aws.Config {
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(*cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = "runs-on-snapshot"
+		if externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+	})
+	assumed := cfg.Copy()
+	assumed.Credentials = aws.NewCredentialsCache(provider)
+	return &assumed
+}
+
+// GetInstanceAZ returns the availability zone of the current instance, from EC2 IMDS.
+func GetInstanceAZ(ctx context.Context) (string, error) {
+	return getInstanceMetadata(ctx, "placement/availability-zone")
+}
+
+// GetInstanceID returns the ID of the current instance, from EC2 IMDS.
+func GetInstanceID(ctx context.Context) (string, error) {
+	return getInstanceMetadata(ctx, "instance-id")
+}
+
+func getInstanceMetadata(ctx context.Context, path string) (string, error) {
+	output, err := newIMDSClient().GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s: %w", path, describeIMDSError(err))
+	}
+	defer output.Content.Close()
+
+	content, err := io.ReadAll(output.Content)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from IMDS: %w", path, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// newIMDSClient returns an IMDS client that always uses IMDSv2 session tokens (without falling back to IMDSv1, which
+// may be disabled), and retries transient failures.
+func newIMDSClient() *imds.Client {
+	return imds.New(imds.Options{
+		EnableFallback: aws.FalseTernary,
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = imdsMaxAttempts
+		}),
+	})
+}
+
+// describeIMDSError distinguishes IMDS rejecting the request from IMDS being unreachable, which usually means that the
+// hop limit of IMDSv2 responses is too low for containers.
+func describeIMDSError(err error) error {
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) {
+		switch responseErr.HTTPStatusCode() {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("IMDS denied the request (status %d): the IMDSv2 token was rejected or access to IMDS is restricted: %w", responseErr.HTTPStatusCode(), err)
+		default:
+			return fmt.Errorf("IMDS returned status %d: %w", responseErr.HTTPStatusCode(), err)
+		}
+	}
+	return fmt.Errorf("IMDS is unreachable: check that the instance metadata service is enabled, and that its hop limit is at least 2 when running in a container: %w", err)
+}
@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Timeout bounds the whole notification, so that a slow endpoint never holds the job.
+const Timeout = 10 * time.Second
+
+// Event names
+const (
+	EventRestore  = "restore"
+	EventSnapshot = "snapshot"
+)
+
+// Payload is the JSON document posted to the webhook URL.
+type Payload struct {
+	Event                  string  `json:"event"`
+	Repository             string  `json:"repository"`
+	Branch                 string  `json:"branch"`
+	Path                   string  `json:"path"`
+	CacheHit               bool    `json:"cache_hit"`
+	VolumeID               string  `json:"volume_id,omitempty"`
+	SourceSnapshotID       string  `json:"source_snapshot_id,omitempty"`
+	SnapshotID             string  `json:"snapshot_id,omitempty"`
+	RestoreDurationSeconds float64 `json:"restore_duration_seconds,omitempty"`
+	SaveDurationSeconds    float64 `json:"save_duration_seconds,omitempty"`
+	Error                  string  `json:"error,omitempty"`
+}
+
+// Send posts the payload as JSON to url. If authHeader is not empty, it is sent as the Authorization header.
+func Send(ctx context.Context, url string, authHeader string, payload *Payload) error {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "runs-on-snapshot")
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
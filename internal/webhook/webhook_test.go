@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	payload := &Payload{
+		Event:      EventSnapshot,
+		Repository: "owner/repo",
+		Branch:     "main",
+		Path:       "/var/lib/docker",
+		CacheHit:   true,
+		SnapshotID: "snap-1",
+	}
+	tests := []struct {
+		name       string
+		authHeader string
+		status     int
+		wantErr    bool
+	}{
+		{name: "no authorization", status: http.StatusOK},
+		{name: "authorization", authHeader: "Bearer secret", status: http.StatusNoContent},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+		{name: "not modified", status: http.StatusNotModified, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotRequest *http.Request
+			var gotPayload Payload
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotRequest = r
+				if err := json.NewDecoder(r.Body).Decode(&gotPayload); err != nil {
+					t.Errorf("failed to decode webhook body: %v", err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			err := Send(context.Background(), server.URL, tt.authHeader, payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if gotRequest.Method != http.MethodPost {
+				t.Errorf("method = %s, want POST", gotRequest.Method)
+			}
+			if got := gotRequest.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if got := gotRequest.Header.Get("Authorization"); got != tt.authHeader {
+				t.Errorf("Authorization = %q, want %q", got, tt.authHeader)
+			}
+			if !reflect.DeepEqual(&gotPayload, payload) {
+				t.Errorf("payload = %+v, want %+v", gotPayload, *payload)
+			}
+		})
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// Send bounds the notification by Timeout, or by the deadline of the context if it is shorter
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := Send(ctx, server.URL, "", &Payload{Event: EventRestore}); err == nil {
+		t.Fatalf("Send() error = nil, want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed >= Timeout {
+		t.Errorf("Send() returned after %s, want before the deadline of the context", elapsed)
+	}
+}
+
+func TestSendInvalidURL(t *testing.T) {
+	if err := Send(context.Background(), "://invalid", "", &Payload{}); err == nil {
+		t.Errorf("Send() error = nil, want an error for an invalid URL")
+	}
+}
@@ -2,77 +2,400 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/runs-on/snapshot/internal/config"
+	"github.com/runs-on/snapshot/internal/metrics"
+	"github.com/runs-on/snapshot/internal/result"
 	"github.com/runs-on/snapshot/internal/snapshot"
+	"github.com/runs-on/snapshot/internal/utils"
+	"github.com/runs-on/snapshot/internal/webhook"
 	"github.com/sethvargo/go-githubactions"
 )
 
-// handleMainExecution contains the original main logic.
-func handleMainExecution(action *githubactions.Action, ctx context.Context, logger *zerolog.Logger) {
-	cfg := config.NewConfigFromInputs(action)
+// Errors are handled according to their category:
+//   - configuration and validation errors are fatal (see config.NewConfigFromInputs);
+//   - a failed restore in the main step is fatal unless 'continue_on_error' is set, so that the job doesn't silently
+//     run without its cache;
+//   - a failed snapshot in the post step is reported as an error annotation, but is not fatal since the job itself
+//     already succeeded;
+//   - best-effort operations (TTL tagging, pruning, webhook, result and metrics files) only log warnings.
+
+// cancellationCleanupTimeout bounds the cleanup performed on SIGTERM/SIGINT, so that it doesn't hang the runner shutdown.
+const cancellationCleanupTimeout = 30 * time.Second
 
+// handleMainExecution contains the original main logic.
+func handleMainExecution(action *githubactions.Action, ctx context.Context, logger *zerolog.Logger, cfg *config.Config) {
+	res := result.New()
+	failed := false
 	if cfg.Path != "" {
 		action.Infof("Restoring volume for %s...", cfg.Path)
+		pathResult := res.Path(cfg.Path)
+		start := time.Now()
 		snapshotter, err := snapshot.NewAWSSnapshotter(ctx, logger, cfg)
 		if err != nil {
 			action.Errorf("Failed to create snapshotter: %v", err)
+			pathResult.RestoreError = err.Error()
+			failed = true
+		} else if err := checkPermissions(action, ctx, snapshotter, cfg); err != nil {
+			action.Errorf("Permission check failed: %v", err)
+			pathResult.RestoreError = err.Error()
+			failed = true
 		} else {
 			action.Infof("Creating snapshot for %s", cfg.Path)
 			snapshotOutput, err := snapshotter.RestoreSnapshot(ctx, cfg.Path)
+			if errors.Is(err, snapshot.ErrCacheMiss) {
+				action.SetOutput("cache_hit", "false")
+				setSnapshotOutputs(action, nil)
+				pathResult.RestoreError = err.Error()
+				pathResult.RestoreDurationSeconds = time.Since(start).Seconds()
+				notifyWebhook(action, ctx, cfg, webhook.EventRestore, pathResult)
+				saveResult(action, cfg, res)
+				action.Fatalf("No snapshot found for %s and 'fail_on_cache_miss' is set.", cfg.Path)
+			}
+			if err != nil && cfg.FallbackBackend == config.FallbackBackendS3 {
+				action.Warningf("Failed to restore snapshot for %s: %v. Restoring from the S3 fallback instead.", cfg.Path, err)
+				snapshotOutput, err = snapshotter.RestoreFromS3(ctx, cfg.Path)
+			}
 			if err != nil {
 				action.Errorf("Failed to restore snapshot for %s: %v", cfg.Path, err)
+				pathResult.RestoreError = err.Error()
+				failed = true
 			} else {
 				action.Infof("Snapshot restored into volume %s", snapshotOutput.VolumeID)
+				pathResult.VolumeID = snapshotOutput.VolumeID
+				pathResult.SourceSnapshotID = snapshotOutput.SnapshotID
+				pathResult.CacheHit = !snapshotOutput.NewVolume
+				pathResult.VolumeSizeGiB = snapshotOutput.VolumeSizeGiB
+				action.SetOutput("cache_hit", fmt.Sprintf("%t", pathResult.CacheHit))
+				action.SetOutput("device_path", snapshotOutput.DeviceName)
+				setSnapshotOutputs(action, snapshotOutput)
 			}
 		}
+		pathResult.RestoreDurationSeconds = time.Since(start).Seconds()
+		notifyWebhook(action, ctx, cfg, webhook.EventRestore, pathResult)
+	}
+	saveResult(action, cfg, res)
+	if failed {
+		failUnlessContinueOnError(action, cfg, "Restore")
 	}
 
 	action.Infof("Action finished.")
 }
 
 // handlePostExecution contains the logic for the post-execution phase.
-func handlePostExecution(action *githubactions.Action, ctx context.Context, logger *zerolog.Logger) {
+func handlePostExecution(action *githubactions.Action, ctx context.Context, logger *zerolog.Logger, cfg *config.Config) {
 	action.Infof("Running post-execution phase...")
-	cfg := config.NewConfigFromInputs(action)
 
-	if !cfg.Save {
-		action.Infof("Skipping snapshot creation as 'save' is set to false.")
-		action.Infof("Post-execution phase finished.")
-		return
+	res, err := result.Load(cfg.ResultFile)
+	if err != nil {
+		action.Warningf("Failed to load result file, starting from scratch: %v", err)
+		res = result.New()
 	}
 
-	if cfg.Path != "" {
+	failed := false
+	if cfg.Path != "" && (cfg.ReadOnly || cfg.MultiAttach) && cfg.Mode != config.ModePersistentVolume {
+		// Nothing to save, but the volume must still be unmounted and detached, so that it does not stay in use
+		if cfg.MultiAttach {
+			action.Infof("Skipping snapshot creation as the multi-attach volume is shared with other runners, releasing it for %s...", cfg.Path)
+		} else {
+			action.Infof("Skipping snapshot creation as the volume was mounted read-only, releasing it for %s...", cfg.Path)
+		}
+		snapshotter, err := snapshot.NewAWSSnapshotter(ctx, logger, cfg)
+		if err != nil {
+			action.Errorf("Failed to create snapshotter: %v", err)
+			failed = true
+		} else if err := snapshotter.ReleaseVolume(ctx, cfg.Path); err != nil {
+			action.Errorf("Failed to release volume: %v", err)
+			failed = true
+		} else {
+			action.Infof("Volume released for %s.", cfg.Path)
+		}
+	} else if cfg.Path != "" && cfg.Mode == config.ModePersistentVolume {
+		action.Infof("Releasing persistent volume for %s...", cfg.Path)
+		snapshotter, err := snapshot.NewAWSSnapshotter(ctx, logger, cfg)
+		if err != nil {
+			action.Errorf("Failed to create snapshotter: %v", err)
+			failed = true
+		} else if err := snapshotter.ReleaseVolume(ctx, cfg.Path); err != nil {
+			action.Errorf("Failed to release persistent volume: %v", err)
+			failed = true
+		} else {
+			action.Infof("Persistent volume released for %s.", cfg.Path)
+		}
+	} else if cfg.Path != "" && !cfg.Save {
+		action.Infof("Skipping snapshot creation as 'save' is set to false.")
+	} else if cfg.Path != "" {
 		action.Infof("Snapshotting volume for %s...", cfg.Path)
+		pathResult := res.Path(cfg.Path)
+		start := time.Now()
 		snapshotter, err := snapshot.NewAWSSnapshotter(ctx, logger, cfg)
 		if err != nil {
 			action.Errorf("Failed to create snapshotter: %v", err)
+			pathResult.SaveError = err.Error()
+			failed = true
 		} else {
-			snapshot, err := snapshotter.CreateSnapshot(ctx, cfg.Path)
-			if err != nil {
+			snapshotOutput, err := snapshotter.CreateSnapshot(ctx, cfg.Path)
+			if errors.Is(err, snapshot.ErrSnapshotLocked) || errors.Is(err, snapshot.ErrSnapshotUnchanged) {
+				action.Infof("Skipping snapshot: %v.", err)
+			} else if errors.Is(err, snapshot.ErrVolumeNotFound) {
+				action.Warningf("Skipping snapshot: %v.", err)
+			} else if err != nil {
 				action.Errorf("Failed to snapshot volumes: %v", err)
+				pathResult.SaveError = err.Error()
+				failed = true
 			} else {
-				action.Infof("Snapshot created: %s. Note that it might take a few minutes to be available for use.", snapshot.SnapshotID)
+				if snapshotOutput.S3URI != "" {
+					action.Infof("Saved to the S3 fallback: %s", snapshotOutput.S3URI)
+				} else {
+					action.Infof("Snapshot created: %s. Note that it might take a few minutes to be available for use.", snapshotOutput.SnapshotID)
+				}
+				pathResult.SnapshotID = snapshotOutput.SnapshotID
 			}
 		}
+		pathResult.SaveDurationSeconds = time.Since(start).Seconds()
+		notifyWebhook(action, ctx, cfg, webhook.EventSnapshot, pathResult)
+	}
+	saveResult(action, cfg, res)
+	if failed {
+		action.Errorf("Snapshot failed. The job is not failed since it already completed, but the next run may not find an up-to-date snapshot.")
 	}
 	action.Infof("Post-execution phase finished.")
 }
 
+// checkPermissions checks the EC2 permissions upfront in the main step, unless 'check_permissions' is false. Missing
+// permissions are only a warning with the S3 fallback, which takes over when EBS snapshots are not available.
+func checkPermissions(action *githubactions.Action, ctx context.Context, snapshotter *snapshot.AWSSnapshotter, cfg *config.Config) error {
+	if !cfg.CheckPermissions {
+		return nil
+	}
+	err := snapshotter.CheckPermissions(ctx)
+	if err != nil && cfg.FallbackBackend == config.FallbackBackendS3 {
+		action.Warningf("%v. Continuing, since the S3 fallback is configured.", err)
+		return nil
+	}
+	return err
+}
+
+// failUnlessContinueOnError exits with a non-zero code after a failure of the phase, unless 'continue_on_error' is set.
+// Errors have already been reported.
+func failUnlessContinueOnError(action *githubactions.Action, cfg *config.Config, phase string) {
+	if cfg.ContinueOnError {
+		action.Warningf("%s failed, but 'continue_on_error' is set. Continuing.", phase)
+		return
+	}
+	action.Fatalf("%s failed. Set 'continue_on_error' to true to continue anyway.", phase)
+}
+
+// handleStatus prints the snapshots and volumes of the repository as JSON on stdout.
+func handleStatus(action *githubactions.Action, ctx context.Context, logger *zerolog.Logger, cfg *config.Config) {
+	statusLogger := logger.Output(os.Stderr)
+	snapshotter, err := snapshot.NewAWSSnapshotter(ctx, &statusLogger, cfg)
+	if err != nil {
+		action.Fatalf("Failed to create snapshotter: %v", err)
+	}
+	status, err := snapshotter.Status(ctx)
+	if err != nil {
+		action.Fatalf("Failed to get status: %v", err)
+	}
+	fmt.Println(utils.PrettyPrint(status))
+}
+
+// handleListSnapshots prints all the snapshots of the repository as JSON on stdout, after deleting those exceeding the
+// budget if clean is set.
+func handleListSnapshots(action *githubactions.Action, ctx context.Context, logger *zerolog.Logger, cfg *config.Config, clean *snapshot.CleanOptions) {
+	listLogger := logger.Output(os.Stderr)
+	snapshotter, err := snapshot.NewAWSSnapshotter(ctx, &listLogger, cfg)
+	if err != nil {
+		action.Fatalf("Failed to create snapshotter: %v", err)
+	}
+	if clean == nil {
+		list, err := snapshotter.ListSnapshots(ctx)
+		if err != nil {
+			action.Fatalf("Failed to list snapshots: %v", err)
+		}
+		fmt.Println(utils.PrettyPrint(list))
+		return
+	}
+	list, err := snapshotter.CleanSnapshots(ctx, *clean)
+	if list != nil {
+		fmt.Println(utils.PrettyPrint(list))
+	}
+	if err != nil {
+		action.Fatalf("Failed to clean snapshots: %v", err)
+	}
+}
+
+// setSnapshotOutputs sets the age, branch and tags of the snapshot the volume was restored from, and whether it was
+// found by falling back on the default branch, or -1, an empty branch and no tags if the volume was not created from a
+// snapshot.
+func setSnapshotOutputs(action *githubactions.Action, output *snapshot.RestoreSnapshotOutput) {
+	ageSeconds, branch, tags, defaultBranchFallback := int64(-1), "", map[string]string{}, false
+	if output != nil && output.SnapshotID != "" {
+		ageSeconds = int64(time.Since(output.SnapshotStartTime).Seconds())
+		branch = output.SnapshotBranch
+		tags = output.SnapshotTags
+		defaultBranchFallback = output.DefaultBranchFallback
+	}
+	action.SetOutput("snapshot_age_seconds", fmt.Sprintf("%d", ageSeconds))
+	action.SetOutput("snapshot_source_branch", branch)
+	action.SetOutput("snapshot_tags", jsonObject(tags))
+	action.SetOutput("used_default_branch_fallback", fmt.Sprintf("%t", defaultBranchFallback))
+}
+
+// newLogger configures the logger from the 'log_level' and 'log_format' inputs.
+func newLogger(cfg *config.Config) zerolog.Logger {
+	var logger zerolog.Logger
+	if cfg.LogFormat == config.LogFormatConsole {
+		logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
+	} else {
+		logger = zerolog.New(os.Stdout)
+	}
+	return logger.Level(cfg.LogLevel).With().Timestamp().Logger()
+}
+
+// notifyWebhook posts the outcome of the restore or snapshot to the 'webhook_url', if any. Failures are not fatal.
+func notifyWebhook(action *githubactions.Action, ctx context.Context, cfg *config.Config, event string, pathResult *result.PathResult) {
+	if cfg.WebhookURL == "" {
+		return
+	}
+	payload := &webhook.Payload{
+		Event:                  event,
+		Repository:             cfg.GithubRepository,
+		Branch:                 cfg.GithubRef,
+		Path:                   cfg.Path,
+		CacheHit:               pathResult.CacheHit,
+		VolumeID:               pathResult.VolumeID,
+		SourceSnapshotID:       pathResult.SourceSnapshotID,
+		SnapshotID:             pathResult.SnapshotID,
+		RestoreDurationSeconds: pathResult.RestoreDurationSeconds,
+		SaveDurationSeconds:    pathResult.SaveDurationSeconds,
+		Error:                  pathResult.RestoreError,
+	}
+	if event == webhook.EventSnapshot {
+		payload.Error = pathResult.SaveError
+	}
+	if err := webhook.Send(ctx, cfg.WebhookURL, cfg.WebhookAuthHeader, payload); err != nil {
+		action.Warningf("Failed to notify webhook: %v", err)
+	}
+}
+
+// saveResult sets the outputs listing the resources of all paths, and writes the machine-readable result file and the
+// metrics file if configured. Failures are not fatal.
+func saveResult(action *githubactions.Action, cfg *config.Config, res *result.Result) {
+	action.SetOutput("attached_volume_ids", jsonArray(res.AttachedVolumeIDs()))
+	action.SetOutput("created_snapshot_ids", jsonArray(res.CreatedSnapshotIDs()))
+	if err := res.Save(cfg.ResultFile); err != nil {
+		action.Warningf("Failed to write result file %s: %v", cfg.ResultFile, err)
+	}
+	if cfg.MetricsFile != "" {
+		if err := metrics.Write(cfg.MetricsFile, res); err != nil {
+			action.Warningf("Failed to write metrics file %s: %v", cfg.MetricsFile, err)
+		}
+	}
+}
+
+// jsonArray formats values as a compact JSON array, to be parsed with fromJSON in workflows.
+func jsonArray(values []string) string {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+// jsonObject formats values as a compact JSON object, to be parsed with fromJSON in workflows.
+func jsonObject(values map[string]string) string {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// handleCancellation best-effort unmounts and detaches the volume when the job is cancelled,
+// to avoid leaving it attached to a terminating instance.
+func handleCancellation(action *githubactions.Action, logger *zerolog.Logger, cfg *config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancellationCleanupTimeout)
+	defer cancel()
+
+	if cfg.Path == "" {
+		return
+	}
+
+	snapshotter, err := snapshot.NewAWSSnapshotter(ctx, logger, cfg)
+	if err != nil {
+		action.Errorf("Failed to create snapshotter for cleanup: %v", err)
+		return
+	}
+	if err := snapshotter.Cleanup(ctx, cfg.Path); err != nil {
+		action.Errorf("Failed to clean up volume for %s: %v", cfg.Path, err)
+		return
+	}
+	action.Infof("Volume for %s cleaned up.", cfg.Path)
+}
+
 func main() {
-	ctx := context.Background()
-	logger := zerolog.New(os.Stdout).With().Timestamp().Logger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	postFlag := flag.Bool("post", false, "Indicates the post-execution phase")
+	statusFlag := flag.Bool("status", false, "Prints the snapshots and volumes of the repository as JSON, without modifying anything")
+	listSnapshotsFlag := flag.Bool("list-snapshots", false, "Prints all the snapshots of the repository (all branches) as JSON, without modifying anything")
+	cleanSnapshotsFlag := flag.Bool("clean-snapshots", false, "Deletes the snapshots of the repository (all branches) exceeding --max-age-hours or --max-count, and prints them as JSON")
+	maxAgeHoursFlag := flag.Int("max-age-hours", 0, "With --clean-snapshots, deletes the snapshots older than this many hours")
+	maxCountFlag := flag.Int("max-count", 0, "With --clean-snapshots, keeps only this many most recent snapshots for the whole repository")
+	dryRunFlag := flag.Bool("dry-run", false, "With --clean-snapshots, only prints the snapshots that would be deleted")
 	flag.Parse()
 
 	action := githubactions.New()
+	if *statusFlag || *listSnapshotsFlag || *cleanSnapshotsFlag {
+		// Keep stdout for the JSON document
+		action = githubactions.New(githubactions.WithWriter(os.Stderr))
+	}
+	if *cleanSnapshotsFlag && *maxAgeHoursFlag <= 0 && *maxCountFlag <= 0 {
+		action.Fatalf("--clean-snapshots requires a positive --max-age-hours or --max-count")
+	}
+	cfg := config.NewConfigFromInputs(action)
+	logger := newLogger(cfg)
+
+	if *statusFlag {
+		handleStatus(action, ctx, &logger, cfg)
+		return
+	}
+	if *listSnapshotsFlag {
+		handleListSnapshots(action, ctx, &logger, cfg, nil)
+		return
+	}
+	if *cleanSnapshotsFlag {
+		handleListSnapshots(action, ctx, &logger, cfg, &snapshot.CleanOptions{
+			MaxAge:   time.Duration(*maxAgeHoursFlag) * time.Hour,
+			MaxCount: *maxCountFlag,
+			DryRun:   *dryRunFlag,
+		})
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		action.Warningf("Received %s, cleaning up before exiting...", sig)
+		cancel()
+		handleCancellation(action, &logger, cfg)
+		os.Exit(1)
+	}()
 
 	if *postFlag {
-		handlePostExecution(action, ctx, &logger)
+		handlePostExecution(action, ctx, &logger, cfg)
 	} else {
-		handleMainExecution(action, ctx, &logger)
+		handleMainExecution(action, ctx, &logger, cfg)
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/rs/zerolog"
+	"github.com/runs-on/snapshot/internal/config"
+	"github.com/sethvargo/go-githubactions"
+)
+
+// mockEC2State is the part of the state of the mock mode EC2 client checked by the tests.
+type mockEC2State struct {
+	Volumes   map[string]types.Volume   `json:"volumes"`
+	Snapshots map[string]types.Snapshot `json:"snapshots"`
+}
+
+func TestHandlePostExecutionReadOnly(t *testing.T) {
+	tests := []struct {
+		name          string
+		readOnly      bool
+		wantVolumes   int
+		wantSnapshots int
+	}{
+		{name: "read-only volume is released", readOnly: true, wantVolumes: 0, wantSnapshots: 0},
+		// The source volume of the snapshot is left for the TTL reaper, until the snapshot completes
+		{name: "read-write volume is snapshotted", wantVolumes: 1, wantSnapshots: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			t.Setenv("RUNS_ON_SNAPSHOT_MOCK", "1")
+			t.Setenv("TMPDIR", tmpDir)
+			t.Setenv("GITHUB_OUTPUT", filepath.Join(tmpDir, "output"))
+			action := githubactions.New(githubactions.WithWriter(io.Discard))
+			logger := zerolog.Nop()
+			cfg := &config.Config{
+				Path:                     filepath.Join(tmpDir, "cache"),
+				Mode:                     config.ModeSnapshot,
+				Version:                  "v1",
+				RestoreVersions:          []string{"v1"},
+				Save:                     true,
+				ReadOnly:                 tt.readOnly,
+				VolumeType:               types.VolumeTypeGp3,
+				VolumeIops:               3000,
+				VolumeThroughput:         750,
+				VolumeSize:               40,
+				Filesystem:               config.FilesystemExt4,
+				IncompleteSnapshotPolicy: config.IncompleteSnapshotPolicyTag,
+				GithubRef:                "main",
+				GithubRepository:         "owner/repo",
+				TagPrefix:                config.DefaultTagPrefix,
+				RunnerConfig:             &config.RunnerConfig{DefaultBranch: "main"},
+				ResultFile:               filepath.Join(tmpDir, "result.json"),
+			}
+
+			handleMainExecution(action, context.Background(), &logger, cfg)
+			handlePostExecution(action, context.Background(), &logger, cfg)
+
+			data, err := os.ReadFile(filepath.Join(tmpDir, "runs-on-snapshot-mock", "ec2.json"))
+			if err != nil {
+				t.Fatalf("failed to read mock EC2 state: %v", err)
+			}
+			var state mockEC2State
+			if err := json.Unmarshal(data, &state); err != nil {
+				t.Fatalf("failed to unmarshal mock EC2 state: %v", err)
+			}
+			if len(state.Volumes) != tt.wantVolumes {
+				t.Errorf("%d volumes left, want %d", len(state.Volumes), tt.wantVolumes)
+			}
+			if len(state.Snapshots) != tt.wantSnapshots {
+				t.Errorf("%d snapshots, want %d", len(state.Snapshots), tt.wantSnapshots)
+			}
+		})
+	}
+}